@@ -4,13 +4,23 @@ import (
 	"flag"
 	"fmt"
 	"os"
+
+	"github.com/cespedes/knx2mqtt/internal/logging"
 )
 
+var logETS = logging.Get("ets")
+
 func main() {
 	verbose := false
 	flag.BoolVar(&verbose, "v", false, "add verbosity")
+	logOpts := logging.AddFlags(flag.CommandLine)
 	flag.Parse()
 
+	if err := logging.Setup(logOpts, "ets-project-parse"); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
 	if len(flag.Args()) != 1 {
 		fmt.Println("Must use 1 arg.")
 		os.Exit(1)
@@ -20,12 +30,12 @@ func main() {
 
 	ets, err := Uncompress(filename)
 	if err != nil {
-		panic(err)
+		logging.Fatal(logETS, "could not open project", "file", filename, "error", err)
 	}
 
 	k, err := ParseProject(ets.Project)
 	if err != nil {
-		panic(err)
+		logging.Fatal(logETS, "could not parse project", "file", filename, "error", err)
 	}
 
 	PrintProject(k, verbose)
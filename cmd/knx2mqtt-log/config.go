@@ -1,12 +1,12 @@
 package main
 
 import (
-	"bufio"
 	"fmt"
-	"os"
 	"strconv"
 	"strings"
 
+	"github.com/cespedes/knx2mqtt/internal/cfgfile"
+	"github.com/cespedes/knx2mqtt/internal/mqttclient"
 	"github.com/vapourismo/knx-go/knx/cemi"
 )
 
@@ -15,14 +15,21 @@ import (
 logdir /var/log/knx
 port 8001
 mqtt-server 127.0.0.1
+mqtt-version 5
 mqtt-prefix1 control/knx
 mqtt-prefix2 control/rooms
 gateway 192.168.1.11 1/ 2/5/
 	...
+include knx.d/*.cfg
+	...
 device 1.1.10 myroom.thermostat
 	...
 address 2/5/7 9.001 myroom/temperature
 	...
+
+The options of knx2mqtt-pretty (readout, payload, homeassistant,
+homeassistant-entity, entity blocks, aliases and options in addresses)
+are accepted and ignored, so that both can read the same file.
 */
 type addrNameType struct {
 	Name string
@@ -36,6 +43,7 @@ type Gateway struct {
 
 type Config struct {
 	MQTTServer  string
+	MQTTVersion mqttclient.Version
 	MQTTPrefix1 string
 	MQTTPrefix2 string
 	Logdir      string                          // Where to store packet logs
@@ -69,30 +77,31 @@ func ReadConfig(filename string) (*Config, error) {
 	var c Config
 	c.Devices = make(map[cemi.IndividualAddr]string)
 	c.Addresses = make(map[cemi.GroupAddr]addrNameType)
-	f, err := os.Open(filename)
+	lines, err := cfgfile.Read(filename)
 	if err != nil {
 		return nil, err
 	}
-	s := bufio.NewScanner(f)
-	lineNum := 0
-	for s.Scan() {
-		lineNum++
-		line := strings.TrimSpace(s.Text())
-		if i := strings.IndexByte(line, '#'); i >= 0 {
-			// strip comments
-			line = strings.TrimSpace(line[0:i])
-		}
-		if len(line) == 0 {
-			// empty line
+	inEntity := false // the entity blocks are only used by knx2mqtt-pretty
+	for _, line := range lines {
+		// errors cite the file and line, which may be an included one
+		filename, lineNum, tokens := line.File, line.Num, line.Tokens
+		if inEntity {
+			inEntity = tokens[0] != "end"
 			continue
 		}
-		tokens := strings.Fields(line)
 		switch tokens[0] {
 		case "mqtt-server":
 			if len(tokens) != 2 {
 				return nil, fmt.Errorf("syntax error in %s line %d", filename, lineNum)
 			}
 			c.MQTTServer = tokens[1]
+		case "mqtt-version":
+			if len(tokens) != 2 {
+				return nil, fmt.Errorf("syntax error in %s line %d", filename, lineNum)
+			}
+			if err := c.MQTTVersion.Set(tokens[1]); err != nil {
+				return nil, fmt.Errorf("error in %s line %d: %w", filename, lineNum, err)
+			}
 		case "mqtt-prefix1":
 			if len(tokens) != 2 {
 				return nil, fmt.Errorf("syntax error in %s line %d", filename, lineNum)
@@ -126,13 +135,27 @@ func ReadConfig(filename string) (*Config, error) {
 				return nil, fmt.Errorf("error in %s line %d: %w", filename, lineNum, err)
 			}
 			c.Devices[addr] = tokens[2]
+		case "readout", "payload", "homeassistant", "homeassistant-entity":
+			// only used by knx2mqtt-pretty
+		case "entity":
+			inEntity = true
 		case "address":
-			if len(tokens) != 4 {
+			if len(tokens) < 4 {
 				return nil, fmt.Errorf("syntax error in %s line %d", filename, lineNum)
 			}
 			aAddr := tokens[1]
 			aDPT := tokens[2]
-			aName := tokens[3]
+			// the first name; the aliases and options (key=value) are only used by knx2mqtt-pretty
+			var aName string
+			for _, t := range tokens[3:] {
+				if !strings.Contains(t, "=") {
+					aName = t
+					break
+				}
+			}
+			if aName == "" {
+				return nil, fmt.Errorf("syntax error in %s line %d", filename, lineNum)
+			}
 			// fmt.Printf("line %d: new address: %v\n", lineNum, tokens)
 			addr, err := cemi.NewGroupAddrString(aAddr)
 			if err != nil {
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/vapourismo/knx-go/knx/cemi"
+)
+
+// A config file for knx2mqtt-pretty can be read by knx2mqtt-log.
+func TestReadPrettyConfig(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "knx.cfg")
+	err := os.WriteFile(filename, []byte(`
+mqtt-server 127.0.0.1
+mqtt-version 5
+readout 5
+payload json
+homeassistant
+device 1.1.10 myroom.thermostat
+address 2/5/7 9.001 myroom/temperature
+address 2/5/8 20.105 myroom/mode labels=1:heat,3:cool
+address 2/5/9 14.056 myroom/power power deadband=5% max-interval=15m
+entity light myroom/light
+	switch 2/1/1
+	brightness 2/1/3
+end
+homeassistant-entity myroom/temperature sensor state_class=measurement
+`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := ReadConfig(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.MQTTServer != "127.0.0.1" || c.Devices[cemi.NewIndividualAddr3(1, 1, 10)] != "myroom.thermostat" {
+		t.Errorf("wrong config: %+v", c)
+	}
+	want := map[cemi.GroupAddr]addrNameType{
+		cemi.NewGroupAddr3(2, 5, 7): {Name: "myroom/temperature", DPT: "9.001"},
+		cemi.NewGroupAddr3(2, 5, 8): {Name: "myroom/mode", DPT: "20.105"},
+		cemi.NewGroupAddr3(2, 5, 9): {Name: "myroom/power", DPT: "14.056"},
+	}
+	if len(c.Addresses) != len(want) {
+		t.Errorf("addresses: %v", c.Addresses)
+	}
+	for addr, a := range want {
+		if c.Addresses[addr] != a {
+			t.Errorf("address %s: %+v, want %+v", addr, c.Addresses[addr], a)
+		}
+	}
+}
@@ -2,11 +2,12 @@ package main
 
 import (
 	"fmt"
-	"log"
 	"os"
 	"path"
 	"path/filepath"
 	"time"
+
+	"github.com/cespedes/knx2mqtt/internal/logging"
 )
 
 func (s *Server) Log(e Event) {
@@ -17,7 +18,7 @@ func (s *Server) Log(e Event) {
 		os.MkdirAll(filepath.Dir(filename), 0777)
 		s.logFile, err = os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
 		if err != nil {
-			log.Fatal(err)
+			logging.Fatal(logPackets, "could not open log file", "file", filename, "error", err)
 		}
 		s.logFileName = filename
 	}
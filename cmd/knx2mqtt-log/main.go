@@ -4,10 +4,11 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
-	"log"
 	"os"
 	"time"
 
+	"github.com/cespedes/knx2mqtt/internal/logging"
+	"github.com/cespedes/knx2mqtt/internal/mqttclient"
 	"github.com/vapourismo/knx-go/knx"
 	"github.com/vapourismo/knx-go/knx/cemi"
 	"github.com/vapourismo/knx-go/knx/dpt"
@@ -19,9 +20,14 @@ const (
 
 var config *Config
 
-type Server struct {
-	Debug bool
+var (
+	logMQTT    = logging.Get("mqtt")
+	logConfig  = logging.Get("config")
+	logDPT     = logging.Get("dpt")
+	logPackets = logging.Get("packets")
+)
 
+type Server struct {
 	logFile     *os.File
 	logFileName string
 }
@@ -82,11 +88,11 @@ func (e Event) String() string {
 	if nt, ok := config.Addresses[e.Destination]; ok {
 		dp, ok := dpt.Produce(nt.DPT)
 		if !ok {
-			fmt.Printf("Warning: unknown type %v in config file\n", nt.DPT)
+			logDPT.Warn("unknown type in config file", "dpt", nt.DPT, "ga", e.Destination.String())
 			dp = new(UnknownDPT)
 		}
 		if err := dp.Unpack(e.Data); err != nil {
-			fmt.Printf("Network: Error parsing %v for %v\n", e.Data, e.Destination)
+			logDPT.Warn("error parsing data", "data", fmt.Sprint(e.Data), "ga", e.Destination.String(), "dpt", nt.DPT, "error", err)
 		} else {
 			str += " " + nt.Name + "=" + fmt.Sprint(dp)
 		}
@@ -98,34 +104,42 @@ func (e Event) String() string {
 
 func main() {
 	var s Server
-	flag.BoolVar(&s.Debug, "debug", false, "debugging info")
+	logOpts := logging.AddFlags(flag.CommandLine)
 	configFile := flag.String("config", "knx.cfg", "config file")
 	flag.Parse()
 
+	if err := logging.Setup(logOpts, "knx2mqtt-log"); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
 	var err error
 	config, err = ReadConfig(*configFile)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+		logging.Fatal(logConfig, "could not read config", "error", err)
 	}
 	if config.MQTTServer == "" {
-		log.Fatal("No MQTT server specified")
-	}
-	if s.Debug {
-		fmt.Printf("devices: %v\n", config.Devices)
-		fmt.Printf("addresses: %v\n", config.Addresses)
+		logging.Fatal(logConfig, "no MQTT server specified")
 	}
+	logConfig.Debug("configuration read", "devices", len(config.Devices), "addresses", len(config.Addresses))
 
-	client, err := NewMQTTClient(config.MQTTServer, MQTTPort)
+	client, err := mqttclient.New(config.MQTTServer, MQTTPort, mqttclient.Options{Version: config.MQTTVersion})
 	if err != nil {
-		log.Fatal(err)
+		logging.Fatal(logMQTT, "could not connect", "server", config.MQTTServer, "error", err)
 	}
 
-	mqttChan, err := client.Subscribe(fmt.Sprintf("%s/#", config.MQTTPrefix1))
+	// only the events, not the status and command topics
+	mqttChan, err := client.Subscribe(fmt.Sprintf("%s/+/+/+", config.MQTTPrefix1))
+	if err != nil {
+		logging.Fatal(logMQTT, "could not subscribe", "error", err)
+	}
 	for {
 		msg := <-mqttChan
 		var e Event
-		_ = json.Unmarshal(msg.Payload, &e)
+		if err := json.Unmarshal(msg.Payload, &e); err != nil {
+			logMQTT.Debug("ignoring message", "topic", msg.Topic, "error", err)
+			continue
+		}
 		s.Log(e)
 	}
 }
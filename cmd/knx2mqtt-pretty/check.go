@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ConfigProblem is a problem found in the config file which does not prevent
+// using it, such as an unknown DPT or a name used by two addresses.
+type ConfigProblem struct {
+	File string
+	Line int
+	Msg  string
+}
+
+func (p ConfigProblem) String() string {
+	return fmt.Sprintf("%s line %d: %s", p.File, p.Line, p.Msg)
+}
+
+// checkName returns a description of the problem with a name used in MQTT
+// topics (prefix2/<name>), or "" if it is valid.
+func checkName(name string) string {
+	switch {
+	case strings.ContainsAny(name, "+#\x00"):
+		return fmt.Sprintf("name %s has characters not valid in MQTT topics", name)
+	case strings.HasPrefix(name, "/"), strings.HasSuffix(name, "/"), strings.Contains(name, "//"):
+		return fmt.Sprintf("name %s has empty levels", name)
+	case name == "cmd", name == "status":
+		return fmt.Sprintf("name %s is used by knx2mqtt-pretty (prefix2/%s)", name, name)
+	}
+	for _, suffix := range []string{"/set", "/get", "/result"} {
+		if strings.HasSuffix(name, suffix) {
+			return fmt.Sprintf("name %s ends with %s, which is used for commands", name, suffix)
+		}
+	}
+	return ""
+}
+
+// checkConfig prints the problems found in the config file to stdout, or the
+// error reading it to stderr, as requested with -check, and returns the exit status.
+func checkConfig(stdout, stderr io.Writer, c *Config, err error) int {
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	for _, p := range c.Problems {
+		fmt.Fprintln(stdout, p)
+	}
+	if c.MQTTServer == "" {
+		fmt.Fprintln(stdout, "no MQTT server specified")
+		return 1
+	}
+	if len(c.Problems) > 0 {
+		return 1
+	}
+	fmt.Fprintf(stdout, "config ok: %d devices, %d addresses, %d names, %d entities\n",
+		len(c.Devices), len(c.Addresses), len(c.Names), len(c.Entities))
+	return 0
+}
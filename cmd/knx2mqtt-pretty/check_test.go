@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		status int
+		stdout string
+	}{
+		{"ok", `mqtt-server 127.0.0.1
+device 1.1.10 kitchen.thermostat
+address 1/1/1 1.001 kitchen/light
+address 1/1/2 9.001 kitchen/temperature
+entity light kitchen/lamp
+	switch 1/1/1
+end
+`, 0, "config ok: 1 devices, 2 addresses, 2 names, 1 entities\n"},
+		{"problems", `mqtt-server 127.0.0.1
+device 1.1.10 kitchen.thermostat
+device 1.1.10 hall.thermostat
+address 1/1/1 9.0001 kitchen/temperature
+address 1/1/2 1.001 kitchen/light
+address 1/1/3 1.001 kitchen/light
+address 1/1/4 1.001 hall/light/set
+homeassistant-entity hall/lamp switch
+`, 1, `knx.cfg line 3: duplicate device 1.1.10 (first one in knx.cfg line 2)
+knx.cfg line 4: unknown DPT 9.0001
+knx.cfg line 6: name kitchen/light already used by address 1/1/2 in knx.cfg line 5
+knx.cfg line 7: name hall/light/set ends with /set, which is used for commands
+knx.cfg line 8: homeassistant-entity for unknown name hall/lamp
+`},
+		{"no server", "address 1/1/1 1.001 kitchen/light\n", 1, "no MQTT server specified\n"},
+	}
+	for _, test := range tests {
+		dir := t.TempDir()
+		filename := filepath.Join(dir, "knx.cfg")
+		if err := os.WriteFile(filename, []byte(test.config), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		c, err := ReadConfig(filename)
+		var stdout, stderr bytes.Buffer
+		status := checkConfig(&stdout, &stderr, c, err)
+		out := strings.ReplaceAll(stdout.String(), dir+string(filepath.Separator), "")
+		if status != test.status || out != test.stdout || stderr.Len() != 0 {
+			t.Errorf("%s: status %d, stdout:\n%s\nstderr:\n%s\nwant status %d, stdout:\n%s",
+				test.name, status, out, stderr.String(), test.status, test.stdout)
+		}
+	}
+
+	// errors reading it go to stderr
+	var stdout, stderr bytes.Buffer
+	_, err := ReadConfig(filepath.Join(t.TempDir(), "missing.cfg"))
+	if status := checkConfig(&stdout, &stderr, nil, err); status != 1 || stdout.Len() != 0 || stderr.Len() == 0 {
+		t.Errorf("missing file: status %d, stdout %q, stderr %q", status, stdout.String(), stderr.String())
+	}
+}
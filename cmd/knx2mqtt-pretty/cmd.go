@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cespedes/knx2mqtt/internal/mqttclient"
+	"github.com/vapourismo/knx-go/knx"
+)
+
+// commandTopics returns the topic filters to receive the commands sent to
+// prefix2/<name>/set and prefix2/<name>/get.  Names can contain slashes, so
+// there is a filter for each number of levels used in the config file.
+func commandTopics(prefix string, names []string) []string {
+	levels := make(map[int]bool)
+	for _, name := range names {
+		levels[strings.Count(name, "/")+1] = true
+	}
+	var topics []string
+	for n := range levels {
+		wildcards := strings.Repeat("+/", n)
+		topics = append(topics, prefix+"/"+wildcards+"set", prefix+"/"+wildcards+"get")
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+// CommandResult is published in prefix2/<name>/result after a command sent to
+// prefix2/<name>/set or prefix2/<name>/get.
+type CommandResult struct {
+	Command string `json:"command"`
+	Value   string `json:"value,omitempty"`
+	Error   string `json:"error,omitempty"`
+	Time    string `json:"time"`
+}
+
+// parseSetPayload returns the command and the value sent to prefix2/<name>/set.
+// The payload can be a plain value ("on", "21.5", "hello world"), a JSON value
+// ("\"hello world\"", 21.5, true) or a JSON object with the value and,
+// optionally, the command ("write" or "response"):
+//
+//	{"value": 21.5, "command": "response"}
+func parseSetPayload(payload []byte) (knx.GroupCommand, string, error) {
+	payload = bytes.TrimSpace(payload)
+	if len(payload) == 0 {
+		return 0, "", errors.New("empty value")
+	}
+	if !json.Valid(payload) {
+		return knx.GroupWrite, string(payload), nil
+	}
+	var tmp struct {
+		Value   json.RawMessage `json:"value"`
+		Command string          `json:"command"`
+	}
+	command := knx.GroupWrite
+	if payload[0] == '{' {
+		if err := json.Unmarshal(payload, &tmp); err != nil {
+			return 0, "", err
+		}
+		switch strings.ToLower(tmp.Command) {
+		case "", "write":
+		case "response":
+			command = knx.GroupResponse
+		default:
+			return 0, "", fmt.Errorf("invalid command %q", tmp.Command)
+		}
+		if tmp.Value == nil {
+			return 0, "", errors.New("no value in JSON object")
+		}
+		payload = tmp.Value
+	}
+	d := json.NewDecoder(bytes.NewReader(payload))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return 0, "", err
+	}
+	switch v := v.(type) {
+	case string:
+		return command, v, nil
+	case json.Number:
+		return command, v.String(), nil
+	case bool:
+		return command, fmt.Sprint(v), nil
+	default:
+		return 0, "", fmt.Errorf("invalid value %s", payload)
+	}
+}
+
+// sendCommand sends a read, write or response to the group address with the given name.
+func sendCommand(client *mqttclient.Client, command knx.GroupCommand, name string, value string) error {
+	groupAddr, ok := config.Names[name]
+	if !ok {
+		return fmt.Errorf("unknown name %q", name)
+	}
+	nt := config.Addresses[groupAddr]
+	DPT := nt.DPT
+
+	dp, ok := ProduceDPT(DPT)
+	if !ok {
+		return fmt.Errorf("unknown type %s", DPT)
+	}
+	data := []byte{0}
+	if command == knx.GroupResponse || command == knx.GroupWrite {
+		if err := nt.Transform.Set(dp, value); err != nil {
+			return fmt.Errorf("wrong value for DPT %s: %w", DPT, err)
+		}
+		data = dp.Pack()
+	}
+	logMQTT.Info("command received", "command", command.String(), "name", name, "value", value, "ga", groupAddr.String())
+	return sendGroupEvent(client, command, groupAddr, data)
+}
+
+// handleNameCommand handles a message published to prefix2/<name>/set or
+// prefix2/<name>/get, for an address or an entity, and publishes its result
+// in prefix2/<name>/result.
+func handleNameCommand(client *mqttclient.Client, topic string, payload []byte) {
+	path := strings.TrimPrefix(topic, config.MQTTPrefix2+"/")
+	i := strings.LastIndexByte(path, '/')
+	if i < 0 {
+		return
+	}
+	name, action := path[:i], path[i+1:]
+
+	var command knx.GroupCommand
+	var value string
+	var err error
+	if e, ok := config.Entities[name]; ok {
+		switch action {
+		case "get":
+			command = knx.GroupRead
+		case "set":
+			command, value = knx.GroupWrite, string(bytes.TrimSpace(payload))
+		default:
+			return
+		}
+		err = handleEntityCommand(client, e, action, payload)
+		publishResult(client, topic, name, command, value, err)
+		return
+	}
+	switch action {
+	case "get":
+		command = knx.GroupRead
+	case "set":
+		command = knx.GroupWrite
+		var c knx.GroupCommand
+		if c, value, err = parseSetPayload(payload); err == nil {
+			command = c
+		}
+	default:
+		return
+	}
+	if err == nil {
+		err = sendCommand(client, command, name, value)
+	}
+	publishResult(client, topic, name, command, value, err)
+}
+
+// publishResult publishes the result of a command received in topic in prefix2/<name>/result.
+func publishResult(client *mqttclient.Client, topic string, name string, command knx.GroupCommand, value string, err error) {
+	result := CommandResult{Command: command.String(), Value: value, Time: time.Now().Format(time.RFC3339)}
+	if err != nil {
+		logMQTT.Warn("wrong command", "topic", topic, "value", value, "error", err)
+		result.Error = err.Error()
+	}
+	b, _ := json.Marshal(result)
+	resultTopic := fmt.Sprintf("%s/%s/result", config.MQTTPrefix2, name)
+	msg := &mqttclient.Message{Topic: resultTopic, Payload: b, ContentType: "application/json"}
+	if err := client.PublishMessage(msg); err != nil {
+		logMQTT.Error("could not publish", "topic", resultTopic, "error", err)
+	}
+}
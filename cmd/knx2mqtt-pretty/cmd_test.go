@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cespedes/knx2mqtt/internal/mqttclient"
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/vapourismo/knx-go/knx"
+	"github.com/vapourismo/knx-go/knx/cemi"
+)
+
+// useConfig reads a config file with the given contents and makes it the
+// global config during the test.
+func useConfig(t *testing.T, contents string) *Config {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "knx.cfg")
+	if err := os.WriteFile(filename, []byte(contents), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := ReadConfig(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := config
+	config = c
+	t.Cleanup(func() { config = old })
+	return c
+}
+
+// startBroker starts a local MQTT server and returns a client connected to it
+// and the messages published to the given topics.
+func startBroker(t *testing.T, topics ...string) (*mqttclient.Client, chan *mqttclient.Message) {
+	t.Helper()
+	server := mqtt.New(&mqtt.Options{
+		InlineClient: true,
+		Logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	if err := server.AddHook(new(auth.AllowHook), nil); err != nil {
+		t.Fatal(err)
+	}
+	tcp := listeners.NewTCP(listeners.Config{ID: "test", Address: "127.0.0.1:0"})
+	if err := server.AddListener(tcp); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Serve(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+
+	host, port, _ := net.SplitHostPort(tcp.Address())
+	p, _ := strconv.Atoi(port)
+	client, err := mqttclient.New(host, p, mqttclient.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	ch, err := client.Subscribe(topics...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, ch
+}
+
+// receive returns the next message published, or nil if there is none.
+func receive(ch chan *mqttclient.Message) *mqttclient.Message {
+	select {
+	case m := <-ch:
+		return m
+	case <-time.After(time.Second):
+		return nil
+	}
+}
+
+func TestParseSetPayload(t *testing.T) {
+	tests := []struct {
+		payload string
+		command knx.GroupCommand
+		value   string
+		ok      bool
+	}{
+		{"on", knx.GroupWrite, "on", true},
+		{" 21.5\n", knx.GroupWrite, "21.5", true},
+		{"hello world", knx.GroupWrite, "hello world", true},
+		{`"hello world"`, knx.GroupWrite, "hello world", true},
+		{"21.5", knx.GroupWrite, "21.5", true},
+		{"1e3", knx.GroupWrite, "1e3", true},
+		{"true", knx.GroupWrite, "true", true},
+		{`{"value": 21.5}`, knx.GroupWrite, "21.5", true},
+		{`{"value": "on", "command": "write"}`, knx.GroupWrite, "on", true},
+		{`{"value": false, "command": "Response"}`, knx.GroupResponse, "false", true},
+		{"", 0, "", false},
+		{`{"value": 1, "command": "read"}`, 0, "", false},
+		{`{"command": "write"}`, 0, "", false},
+		{`{"value": [1, 2]}`, 0, "", false},
+		{`[1, 2]`, 0, "", false},
+		{"null", 0, "", false},
+	}
+	for _, test := range tests {
+		command, value, err := parseSetPayload([]byte(test.payload))
+		if (err == nil) != test.ok {
+			t.Errorf("%q: error %v", test.payload, err)
+			continue
+		}
+		if test.ok && (command != test.command || value != test.value) {
+			t.Errorf("%q: %v %q, want %v %q", test.payload, command, value, test.command, test.value)
+		}
+	}
+}
+
+func TestCommandTopics(t *testing.T) {
+	got := commandTopics("rooms", []string{"kitchen/light", "doorbell", "kitchen/blind/up", "hall/light"})
+	want := []string{
+		"rooms/+/+/+/get", "rooms/+/+/+/set",
+		"rooms/+/+/get", "rooms/+/+/set",
+		"rooms/+/get", "rooms/+/set",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("topics %v, want %v", got, want)
+	}
+}
+
+func TestHandleNameCommand(t *testing.T) {
+	useConfig(t, `
+mqtt-prefix1 knx
+mqtt-prefix2 rooms
+address 1/2/3 1.001 kitchen/light
+address 1/2/4 9.001 kitchen/temperature
+`)
+	client, ch := startBroker(t, "knx/cmd", "rooms/+/+/result")
+
+	tests := []struct {
+		topic   string
+		payload string
+		sent    *knx.GroupEvent // telegram sent to knx2mqtt
+		result  *CommandResult  // without its time
+	}{
+		{
+			"rooms/kitchen/light/set", "on",
+			&knx.GroupEvent{Command: knx.GroupWrite, Destination: cemi.NewGroupAddr3(1, 2, 3), Data: []byte{1}},
+			&CommandResult{Command: "Write", Value: "on"},
+		},
+		{
+			"rooms/kitchen/temperature/set", `{"value": 21.5, "command": "response"}`,
+			&knx.GroupEvent{Command: knx.GroupResponse, Destination: cemi.NewGroupAddr3(1, 2, 4), Data: []byte{0, 0x0c, 0x33}},
+			&CommandResult{Command: "Response", Value: "21.5"},
+		},
+		{
+			"rooms/kitchen/temperature/get", "",
+			&knx.GroupEvent{Command: knx.GroupRead, Destination: cemi.NewGroupAddr3(1, 2, 4), Data: []byte{0}},
+			&CommandResult{Command: "Read"},
+		},
+		{
+			"rooms/kitchen/light/set", "maybe", nil,
+			&CommandResult{Command: "Write", Value: "maybe", Error: "wrong value for DPT 1.001: SetDPT: maybe is not a bool value"},
+		},
+		{
+			"rooms/kitchen/light/set", `{"value": 1, "command": "read"}`, nil,
+			&CommandResult{Command: "Write", Error: `invalid command "read"`},
+		},
+		{
+			"rooms/kitchen/door/set", "open", nil,
+			&CommandResult{Command: "Write", Value: "open", Error: `unknown name "kitchen/door"`},
+		},
+		{"rooms/kitchen/light/toggle", "", nil, nil},
+	}
+	for _, test := range tests {
+		handleNameCommand(client, test.topic, []byte(test.payload))
+		if test.sent != nil {
+			m := receive(ch)
+			if m == nil || m.Topic != "knx/cmd" {
+				t.Errorf("%s %q: telegram not sent: %+v", test.topic, test.payload, m)
+				continue
+			}
+			var e Event
+			if err := json.Unmarshal(m.Payload, &e); err != nil {
+				t.Errorf("%s %q: %v", test.topic, test.payload, err)
+			} else if e.Command != test.sent.Command || e.Destination != test.sent.Destination || !reflect.DeepEqual(e.Data, test.sent.Data) {
+				t.Errorf("%s %q: sent %+v, want %+v", test.topic, test.payload, e.GroupEvent, *test.sent)
+			}
+		}
+		if test.result == nil {
+			if m := receive(ch); m != nil {
+				t.Errorf("%s %q: published %s %s", test.topic, test.payload, m.Topic, m.Payload)
+			}
+			continue
+		}
+		m := receive(ch)
+		if m == nil || m.Topic != test.topic[:len(test.topic)-3]+"result" {
+			t.Errorf("%s %q: result not published: %+v", test.topic, test.payload, m)
+			continue
+		}
+		var result CommandResult
+		if err := json.Unmarshal(m.Payload, &result); err != nil {
+			t.Errorf("%s %q: %v", test.topic, test.payload, err)
+			continue
+		}
+		if result.Time == "" {
+			t.Errorf("%s %q: result without time", test.topic, test.payload)
+		}
+		result.Time = ""
+		if result != *test.result {
+			t.Errorf("%s %q: result %+v, want %+v", test.topic, test.payload, result, *test.result)
+		}
+	}
+}
@@ -1,12 +1,12 @@
 package main
 
 import (
-	"bufio"
 	"fmt"
-	"os"
 	"strconv"
 	"strings"
 
+	"github.com/cespedes/knx2mqtt/internal/cfgfile"
+	"github.com/cespedes/knx2mqtt/internal/mqttclient"
 	"github.com/vapourismo/knx-go/knx/cemi"
 )
 
@@ -15,18 +15,45 @@ import (
 logdir /var/log/knx
 port 8001
 mqtt-server 127.0.0.1
+mqtt-version 5
 mqtt-prefix1 control/knx
 mqtt-prefix2 control/rooms
 gateway 192.168.1.11 1/ 2/5/
 	...
+readout 5
+payload json
+homeassistant homeassistant
+	...
+include knx.d/*.cfg
+	...
 device 1.1.10 myroom.thermostat
 	...
 address 2/5/7 9.001 myroom/temperature
+address 2/5/8 20.105 myroom/mode labels=1:heat,3:cool
+address 2/5/9 14.056 myroom/power deadband=5% min-interval=10s max-interval=15m
+	...
+entity light myroom/light
+	switch 2/1/1
+	switch-status 2/1/2
+	brightness 2/1/3
+	brightness-status 2/1/4
+end
+	...
+homeassistant-entity myroom/temperature sensor state_class=measurement
 	...
 */
 type addrNameType struct {
-	Names []string
-	DPT   string
+	Names     []string
+	DPT       string
+	Transform *Transform     // nil if there are no options
+	Filter    *PublishFilter // nil if all the values are published
+	Writable  bool           // controlled from MQTT: a switch or a number in Home Assistant
+}
+
+// haEntity is an explicit Home Assistant entity declaration.
+type haEntity struct {
+	Component string            // "sensor", "switch"... or "none" to not publish it
+	Options   map[string]string // added to the discovery payload
 }
 
 type Gateway struct {
@@ -35,14 +62,22 @@ type Gateway struct {
 }
 
 type Config struct {
-	MQTTServer  string
-	MQTTPrefix1 string
-	MQTTPrefix2 string
-	Logdir      string                          // Where to store packet logs
-	Port        int                             // TCP port to listen HTTP requests
-	Devices     map[cemi.IndividualAddr]string  // List of KNX devices
-	Addresses   map[cemi.GroupAddr]addrNameType // List of KNX group addresses
-	Names       map[string]cemi.GroupAddr       // Reverse list (including aliases)
+	MQTTServer    string
+	MQTTVersion   mqttclient.Version
+	MQTTPrefix1   string
+	MQTTPrefix2   string
+	Logdir        string                          // Where to store packet logs
+	Port          int                             // TCP port to listen HTTP requests
+	ReadoutRate   float64                         // Reads per second when reading all addresses (0: no read-out)
+	Payload       string                          // Format of the values published: "string" or "json"
+	HomeAssistant string                          // Home Assistant discovery prefix ("": no discovery)
+	HAEntities    map[string]haEntity             // Explicit Home Assistant entities, by name
+	Devices       map[cemi.IndividualAddr]string  // List of KNX devices
+	Addresses     map[cemi.GroupAddr]addrNameType // List of KNX group addresses
+	Names         map[string]cemi.GroupAddr       // Reverse list (including aliases)
+	Entities      map[string]*Entity              // Groups of addresses controlled together, by name
+	EntityAddrs   map[cemi.GroupAddr][]entityMemberRef
+	Problems      []ConfigProblem // Problems found while reading it
 }
 
 type UnknownDPT []byte
@@ -71,30 +106,69 @@ func ReadConfig(filename string) (*Config, error) {
 	c.Devices = make(map[cemi.IndividualAddr]string)
 	c.Addresses = make(map[cemi.GroupAddr]addrNameType)
 	c.Names = make(map[string]cemi.GroupAddr)
-	f, err := os.Open(filename)
+	c.Payload = "string"
+	c.HAEntities = make(map[string]haEntity)
+	c.Entities = make(map[string]*Entity)
+	c.EntityAddrs = make(map[cemi.GroupAddr][]entityMemberRef)
+	lines, err := cfgfile.Read(filename)
 	if err != nil {
 		return nil, err
 	}
-	s := bufio.NewScanner(f)
-	lineNum := 0
-	for s.Scan() {
-		lineNum++
-		line := strings.TrimSpace(s.Text())
-		if i := strings.IndexByte(line, '#'); i >= 0 {
-			// strip comments
-			line = strings.TrimSpace(line[0:i])
+	var entity *Entity // inside an entity block
+
+	// lines where each thing was declared, to report problems
+	addrLines := make(map[cemi.GroupAddr]cfgfile.Line)
+	nameLines := make(map[string]cfgfile.Line)
+	deviceLines := make(map[cemi.IndividualAddr]cfgfile.Line)
+	deviceNames := make(map[string]cfgfile.Line)
+	entityLines := make(map[string]cfgfile.Line)
+	haLines := make(map[string]cfgfile.Line)
+	var line cfgfile.Line
+	problem := func(format string, a ...interface{}) {
+		c.Problems = append(c.Problems, ConfigProblem{File: line.File, Line: line.Num, Msg: fmt.Sprintf(format, a...)})
+	}
+	for _, line = range lines {
+		// errors cite the file and line, which may be an included one
+		filename, lineNum, tokens := line.File, line.Num, line.Tokens
+		if entity != nil && filename != entityLines[entity.Name].File {
+			return nil, fmt.Errorf("error in %s: entity %s without end", entityLines[entity.Name], entity.Name)
 		}
-		if len(line) == 0 {
-			// empty line
+		if entity != nil {
+			if tokens[0] == "end" {
+				if len(tokens) != 1 || len(entity.Members) == 0 {
+					return nil, fmt.Errorf("syntax error in %s line %d", filename, lineNum)
+				}
+				c.Entities[entity.Name] = entity
+				for i := range entity.Members {
+					m := &entity.Members[i]
+					c.EntityAddrs[m.Addr] = append(c.EntityAddrs[m.Addr], entityMemberRef{entity, m})
+				}
+				entity = nil
+				continue
+			}
+			m, err := parseEntityMember(entity, tokens)
+			if err != nil {
+				return nil, fmt.Errorf("error in %s line %d: %w", filename, lineNum, err)
+			}
+			if _, ok := ProduceDPT(m.DPT); !ok {
+				problem("unknown DPT %s", m.DPT)
+			}
+			entity.Members = append(entity.Members, m)
 			continue
 		}
-		tokens := strings.Fields(line)
 		switch tokens[0] {
 		case "mqtt-server":
 			if len(tokens) != 2 {
 				return nil, fmt.Errorf("syntax error in %s line %d", filename, lineNum)
 			}
 			c.MQTTServer = tokens[1]
+		case "mqtt-version":
+			if len(tokens) != 2 {
+				return nil, fmt.Errorf("syntax error in %s line %d", filename, lineNum)
+			}
+			if err := c.MQTTVersion.Set(tokens[1]); err != nil {
+				return nil, fmt.Errorf("error in %s line %d: %w", filename, lineNum, err)
+			}
 		case "mqtt-prefix1":
 			if len(tokens) != 2 {
 				return nil, fmt.Errorf("syntax error in %s line %d", filename, lineNum)
@@ -118,6 +192,62 @@ func ReadConfig(filename string) (*Config, error) {
 			if err != nil {
 				return nil, fmt.Errorf("%s line %d: %w", filename, lineNum, err)
 			}
+		case "readout":
+			if len(tokens) > 2 {
+				return nil, fmt.Errorf("syntax error in %s line %d", filename, lineNum)
+			}
+			c.ReadoutRate = 5
+			if len(tokens) == 2 {
+				c.ReadoutRate, err = strconv.ParseFloat(tokens[1], 64)
+				if err != nil || c.ReadoutRate <= 0 {
+					return nil, fmt.Errorf("%s line %d: invalid read-out rate %q", filename, lineNum, tokens[1])
+				}
+			}
+		case "payload":
+			if len(tokens) != 2 || (tokens[1] != "string" && tokens[1] != "json") {
+				return nil, fmt.Errorf("syntax error in %s line %d: payload must be string or json", filename, lineNum)
+			}
+			c.Payload = tokens[1]
+		case "homeassistant":
+			if len(tokens) > 2 {
+				return nil, fmt.Errorf("syntax error in %s line %d", filename, lineNum)
+			}
+			c.HomeAssistant = "homeassistant"
+			if len(tokens) == 2 {
+				c.HomeAssistant = tokens[1]
+			}
+		case "homeassistant-entity":
+			if len(tokens) < 3 {
+				return nil, fmt.Errorf("syntax error in %s line %d", filename, lineNum)
+			}
+			e := haEntity{Component: tokens[2], Options: make(map[string]string)}
+			for _, opt := range tokens[3:] {
+				i := strings.IndexByte(opt, '=')
+				if i <= 0 {
+					return nil, fmt.Errorf("syntax error in %s line %d: option %q must be key=value", filename, lineNum, opt)
+				}
+				e.Options[opt[:i]] = opt[i+1:]
+			}
+			if l, ok := haLines[tokens[1]]; ok {
+				problem("duplicate homeassistant-entity %s (first one in %s)", tokens[1], l)
+			}
+			haLines[tokens[1]] = line
+			c.HAEntities[tokens[1]] = e
+		case "entity":
+			if len(tokens) != 3 {
+				return nil, fmt.Errorf("syntax error in %s line %d", filename, lineNum)
+			}
+			if _, ok := entityRoles[tokens[1]]; !ok {
+				return nil, fmt.Errorf("error in %s line %d: unknown entity type %s", filename, lineNum, tokens[1])
+			}
+			if _, ok := c.Entities[tokens[2]]; ok {
+				return nil, fmt.Errorf("error in %s line %d: duplicate entity %s", filename, lineNum, tokens[2])
+			}
+			if msg := checkName(tokens[2]); msg != "" {
+				problem("%s", msg)
+			}
+			entityLines[tokens[2]] = line
+			entity = &Entity{Type: tokens[1], Name: tokens[2]}
 		case "device":
 			if len(tokens) != 3 {
 				return nil, fmt.Errorf("syntax error in %s line %d", filename, lineNum)
@@ -127,6 +257,14 @@ func ReadConfig(filename string) (*Config, error) {
 			if err != nil {
 				return nil, fmt.Errorf("error in %s line %d: %w", filename, lineNum, err)
 			}
+			if l, ok := deviceLines[addr]; ok {
+				problem("duplicate device %s (first one in %s)", addr, l)
+			}
+			if l, ok := deviceNames[tokens[2]]; ok {
+				problem("device name %s already used in %s", tokens[2], l)
+			}
+			deviceLines[addr] = line
+			deviceNames[tokens[2]] = line
 			c.Devices[addr] = tokens[2]
 		case "address":
 			if len(tokens) < 4 {
@@ -134,21 +272,101 @@ func ReadConfig(filename string) (*Config, error) {
 			}
 			aAddr := tokens[1]
 			aDPT := tokens[2]
-			aName := tokens[3]
+			// names and aliases, and options (key=value)
+			var names, options []string
+			for _, t := range tokens[3:] {
+				if strings.Contains(t, "=") {
+					options = append(options, t)
+				} else {
+					names = append(names, t)
+				}
+			}
+			if len(names) == 0 {
+				return nil, fmt.Errorf("syntax error in %s line %d", filename, lineNum)
+			}
 			// fmt.Printf("line %d: new address: %v\n", lineNum, tokens)
 			addr, err := cemi.NewGroupAddrString(aAddr)
 			if err != nil {
 				return nil, fmt.Errorf("error in %s line %d: %w", filename, lineNum, err)
 			}
-			c.Addresses[addr] = addrNameType{Names: tokens[3:], DPT: aDPT}
-			c.Names[aName] = addr
-			// Add aliases:
-			for i := 4; i < len(tokens); i++ {
-				c.Names[tokens[i]] = addr
+			writable, options, err := parseWritable(options)
+			if err != nil {
+				return nil, fmt.Errorf("error in %s line %d: %w", filename, lineNum, err)
+			}
+			filter, options, err := ParsePublishFilter(options)
+			if err != nil {
+				return nil, fmt.Errorf("error in %s line %d: %w", filename, lineNum, err)
+			}
+			transform, err := ParseTransform(options)
+			if err != nil {
+				return nil, fmt.Errorf("error in %s line %d: %w", filename, lineNum, err)
+			}
+			if _, ok := ProduceDPT(aDPT); !ok {
+				problem("unknown DPT %s", aDPT)
+			}
+			if l, ok := addrLines[addr]; ok {
+				// the names of both lines are kept for commands, but the
+				// values are only published with the names and options of this one
+				problem("duplicate address %s (first one in %s)", addr, l)
+			}
+			addrLines[addr] = line
+			c.Addresses[addr] = addrNameType{Names: names, DPT: aDPT, Transform: transform, Filter: filter, Writable: writable}
+			// Add names and aliases:
+			for _, name := range names {
+				if msg := checkName(name); msg != "" {
+					problem("%s", msg)
+				}
+				if other, ok := c.Names[name]; ok && other != addr {
+					problem("name %s already used by address %s in %s", name, other, nameLines[name])
+				}
+				nameLines[name] = line
+				c.Names[name] = addr
 			}
 		default:
 			return nil, fmt.Errorf("syntax error in %s line %d: unrecognized token %s", filename, lineNum, tokens[0])
 		}
 	}
+	if entity != nil {
+		return nil, fmt.Errorf("error in %s: entity %s without end", entityLines[entity.Name], entity.Name)
+	}
+	for name := range c.Entities {
+		if _, ok := c.Names[name]; ok {
+			return nil, fmt.Errorf("error in %s: %s is the name of an entity and of an address (%s)", entityLines[name], name, nameLines[name])
+		}
+	}
+	for _, line = range lines {
+		if line.Tokens[0] != "homeassistant-entity" {
+			continue
+		}
+		if l := haLines[line.Tokens[1]]; l.File != line.File || l.Num != line.Num {
+			// a duplicate one
+			continue
+		}
+		name := line.Tokens[1]
+		_, isAddr := c.Names[name]
+		_, isEntity := c.Entities[name]
+		if !isAddr && !isEntity {
+			problem("homeassistant-entity for unknown name %s", name)
+		}
+	}
 	return &c, nil
 }
+
+// parseWritable takes the option "writable=bool" from the options of an address line
+// and returns its value and the rest of the options.
+func parseWritable(options []string) (bool, []string, error) {
+	var writable bool
+	var rest []string
+	for _, opt := range options {
+		value, ok := strings.CutPrefix(opt, "writable=")
+		if !ok {
+			rest = append(rest, opt)
+			continue
+		}
+		var err error
+		if writable, err = strconv.ParseBool(value); err != nil {
+			return false, nil, fmt.Errorf("invalid option %s: %w", opt, err)
+		}
+	}
+	return writable, rest, nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/vapourismo/knx-go/knx/cemi"
+)
+
+func TestDuplicateAddress(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "knx.cfg")
+	err := os.WriteFile(filename, []byte(`
+address 1/1/3 1.001 kitchen/light
+address 1/1/3 1.001 kitchen/lamp
+`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := ReadConfig(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := cemi.NewGroupAddr3(1, 1, 3)
+	if len(c.Problems) != 1 {
+		t.Errorf("problems: %v", c.Problems)
+	}
+	// both names can be used in commands, and the values are published with the last one
+	if c.Names["kitchen/light"] != addr || c.Names["kitchen/lamp"] != addr {
+		t.Errorf("names: %v", c.Names)
+	}
+	if names := c.Addresses[addr].Names; len(names) != 1 || names[0] != "kitchen/lamp" {
+		t.Errorf("names published: %v", names)
+	}
+}
+
+// Problems in included files are reported with their name and line.
+func TestIncludedProblem(t *testing.T) {
+	dir := t.TempDir()
+	included := filepath.Join(dir, "knx.d", "kitchen.cfg")
+	if err := os.Mkdir(filepath.Dir(included), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(included, []byte("address 1/1/1 1.001 kitchen/light\n\naddress 1/1/2 9.0001 kitchen/temperature\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(dir, "knx.cfg")
+	if err := os.WriteFile(filename, []byte("mqtt-server 127.0.0.1\ninclude knx.d/*.cfg\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := ReadConfig(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ConfigProblem{{File: included, Line: 3, Msg: "unknown DPT 9.0001"}}
+	if !reflect.DeepEqual(c.Problems, want) {
+		t.Errorf("problems %v, want %v", c.Problems, want)
+	}
+}
@@ -1,17 +1,41 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"reflect"
 	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/vapourismo/knx-go/knx/dpt"
 )
 
-// GetDPT returns the text representation of the internal value stored in a dpt.DatapointValue
-// It works only if its underlying type is a bool, integer or float.
+// GetDPTAsString returns the text representation of the value stored in a dpt.DatapointValue,
+// without units, in the same format accepted by SetDPTFromString.
 func GetDPTAsString(v dpt.DatapointValue) string {
+	switch d := v.(type) {
+	case *DPT_3007, *DPT_3008, *DPT_10001, *DPT_11001, *DPT_16000, *DPT_16001, *DPT_232600:
+		return fmt.Sprint(d)
+	case *DPT_19001:
+		return d.Time.Format("2006-01-02 15:04:05")
+	case *dpt.DPT_251600:
+		channels := []struct {
+			value uint8
+			valid bool
+		}{{d.Red, d.RedValid}, {d.Green, d.GreenValid}, {d.Blue, d.BlueValid}, {d.White, d.WhiteValid}}
+		var s []string
+		for _, c := range channels {
+			if c.valid {
+				s = append(s, fmt.Sprint(c.value))
+			} else {
+				s = append(s, "")
+			}
+		}
+		return strings.Join(s, ",")
+	}
+
 	Val := reflect.ValueOf(v)
 	if Val.Kind() != reflect.Ptr {
 		return "" // Error: input value is not a pointer
@@ -19,20 +43,116 @@ func GetDPTAsString(v dpt.DatapointValue) string {
 	Val = Val.Elem()
 	switch Val.Kind() {
 	case reflect.Bool:
-		return strconv.FormatBool(Val.Elem().Bool())
+		return strconv.FormatBool(Val.Bool())
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-		return fmt.Sprint(Val.Elem().Int())
+		return fmt.Sprint(Val.Int())
 	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
-		return fmt.Sprint(Val.Elem().Uint())
+		return fmt.Sprint(Val.Uint())
 	case reflect.Float32, reflect.Float64:
-		return fmt.Sprintf("%f", Val.Elem().Float())
+		if Val.Kind() == reflect.Float32 {
+			// float32 values computed by knx-go are not always the closest to the real ones
+			return strconv.FormatFloat(Val.Float(), 'g', 7, 32)
+		}
+		return strconv.FormatFloat(Val.Float(), 'g', -1, 64)
 	default:
 		return fmt.Sprint(v.Pack())
 	}
 }
 
-// SetDPT sets the internal value of d to value.  Its kind must be integer, float or bool.
+// GetDPTValue returns the value stored in a dpt.DatapointValue as a bool or
+// a float64 if it is a boolean or a number, or else as a string.
+func GetDPTValue(v dpt.DatapointValue) interface{} {
+	s := GetDPTAsString(v)
+	Val := reflect.ValueOf(v)
+	if Val.Kind() != reflect.Ptr {
+		return s
+	}
+	switch Val.Elem().Kind() {
+	case reflect.Bool:
+		return Val.Elem().Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		// parsed from its text representation, to avoid float32 rounding errors
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return f
+		}
+	}
+	return s
+}
+
+// copyDPT returns a new dpt.DatapointValue with the same value as v,
+// to be changed without changing v.
+func copyDPT(v dpt.DatapointValue) dpt.DatapointValue {
+	Val := reflect.ValueOf(v)
+	if Val.Kind() != reflect.Ptr {
+		return v
+	}
+	c := reflect.New(Val.Elem().Type())
+	c.Elem().Set(Val.Elem())
+	return c.Interface().(dpt.DatapointValue)
+}
+
+// SetDPTFromString sets the value of d to value.
+// It works with all the types in the knx-go dpt package and the ones in dpt_extra.go.
 func SetDPTFromString(d dpt.DatapointValue, value string) error {
+	var err error
+	switch d := d.(type) {
+	case *DPT_3007:
+		d.Increase, d.Step, err = parseStep(value, "increase", "decrease")
+	case *DPT_3008:
+		d.Down, d.Step, err = parseStep(value, "down", "up")
+	case *DPT_10001:
+		*d, err = parseTimeOfDay(value)
+	case *DPT_11001:
+		var t time.Time
+		t, err = time.Parse("2006-01-02", value)
+		*d = DPT_11001{Year: uint16(t.Year()), Month: uint8(t.Month()), Day: uint8(t.Day())}
+		if err == nil && (t.Year() < 1990 || t.Year() > 2089) {
+			err = fmt.Errorf("SetDPT: year %d out of range", t.Year())
+		}
+	case *DPT_16000:
+		err = checkString(value, 127)
+		*d = DPT_16000(value)
+	case *DPT_16001:
+		err = checkString(value, 255)
+		*d = DPT_16001(value)
+	case *DPT_19001:
+		value = strings.Replace(value, "T", " ", 1)
+		var t time.Time
+		t, err = time.ParseInLocation("2006-01-02 15:04:05", value, time.Local)
+		*d = DPT_19001{Time: t}
+		if err == nil && (t.Year() < 1900 || t.Year() > 2155) {
+			err = fmt.Errorf("SetDPT: year %d out of range", t.Year())
+		}
+	case *DPT_232600:
+		var c []uint8
+		c, err = parseColour(value, 3)
+		if err == nil {
+			*d = DPT_232600{Red: c[0], Green: c[1], Blue: c[2]}
+		}
+	case *dpt.DPT_251600:
+		err = parseRGBW(d, value)
+	default:
+		err = setDPTByKind(d, value)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Normalize, unless that changes what is sent: the scaled types in knx-go
+	// (such as 5.001) truncate when packing, so their unpacked values may not
+	// be packed again as the same data.
+	orig := reflect.ValueOf(d).Elem().Interface()
+	data := d.Pack()
+	if d.Unpack(data) != nil || !bytes.Equal(d.Pack(), data) {
+		reflect.ValueOf(d).Elem().Set(reflect.ValueOf(orig))
+	}
+	return nil
+}
+
+// setDPTByKind sets the internal value of d to value.  Its kind must be integer, float or bool.
+func setDPTByKind(d dpt.DatapointValue, value string) error {
 	Val := reflect.ValueOf(d)
 	if Val.Kind() != reflect.Ptr {
 		return fmt.Errorf("SetDPT: input variable is not a pointer")
@@ -53,24 +173,16 @@ func SetDPTFromString(d dpt.DatapointValue, value string) error {
 		}
 		Val.Elem().SetBool(b)
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-		i, err := strconv.ParseInt(value, 10, 64)
+		i, err := strconv.ParseInt(value, 10, Val.Elem().Type().Bits())
 		if err != nil {
 			return err
 		}
 		Val.Elem().SetInt(i)
 	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
-		u, err := strconv.ParseUint(value, 10, 64)
+		// labels such as "heat" or "cool" are set in the config file (see Transform)
+		u, err := strconv.ParseUint(value, 10, Val.Elem().Type().Bits())
 		if err != nil {
-			switch strings.ToLower(value) { // for DPT 20.105 (HVACContrMode):
-			case "heat":
-				u = 1
-			case "cool":
-				u = 3
-			case "fan", "fan only", "fan-only":
-				u = 9
-			default:
-				return err
-			}
+			return err
 		}
 		Val.Elem().SetUint(u)
 	case reflect.Float32, reflect.Float64:
@@ -82,8 +194,143 @@ func SetDPTFromString(d dpt.DatapointValue, value string) error {
 	default:
 		return fmt.Errorf("SetDPT: cannot set element (underlying type %v)", Val.Elem().Kind())
 	}
+	return nil
+}
+
+// parseStep parses a step control (DPT 3.xxx): "stop", or one of the two
+// directions optionally followed by the step code (1 by default).
+func parseStep(value string, on, off string) (bool, uint8, error) {
+	fields := strings.Fields(strings.ToLower(value))
+	if len(fields) == 0 || len(fields) > 2 {
+		return false, 0, fmt.Errorf("SetDPT: %q is not a step control", value)
+	}
+	if len(fields) == 1 && (fields[0] == "stop" || fields[0] == "0") {
+		return false, 0, nil
+	}
+	var dir bool
+	switch fields[0] {
+	case on:
+		dir = true
+	case off:
+		dir = false
+	default:
+		return false, 0, fmt.Errorf("SetDPT: %q is not a step control (%s, %s or stop)", value, on, off)
+	}
+	step := uint64(1)
+	if len(fields) == 2 {
+		var err error
+		step, err = strconv.ParseUint(fields[1], 10, 8)
+		if err != nil || step < 1 || step > 7 {
+			return false, 0, fmt.Errorf("SetDPT: invalid step code in %q (must be 1 to 7)", value)
+		}
+	}
+	return dir, uint8(step), nil
+}
+
+// parseTimeOfDay parses a time ("15:04:05" or "15:04"), optionally preceded by the day of the week.
+func parseTimeOfDay(value string) (DPT_10001, error) {
+	var d DPT_10001
+	fields := strings.Fields(value)
+	if len(fields) == 2 {
+		for i, w := range weekdays {
+			if i > 0 && strings.EqualFold(fields[0], w) {
+				d.Weekday = uint8(i)
+			}
+		}
+		if d.Weekday == 0 {
+			return d, fmt.Errorf("SetDPT: invalid day of the week %q", fields[0])
+		}
+		fields = fields[1:]
+	}
+	if len(fields) != 1 {
+		return d, fmt.Errorf("SetDPT: %q is not a time of day", value)
+	}
+	t, err := time.Parse("15:04:05", fields[0])
+	if err != nil {
+		t, err = time.Parse("15:04", fields[0])
+	}
+	if err != nil {
+		return d, fmt.Errorf("SetDPT: %q is not a time of day", value)
+	}
+	d.Hour, d.Minute, d.Second = uint8(t.Hour()), uint8(t.Minute()), uint8(t.Second())
+	return d, nil
+}
+
+// checkString returns an error if s does not fit in a DPT 16.xxx value.
+func checkString(s string, max rune) error {
+	if utf8.RuneCountInString(s) > 14 {
+		return fmt.Errorf("SetDPT: %q is longer than 14 characters", s)
+	}
+	for _, r := range s {
+		if r > max {
+			return fmt.Errorf("SetDPT: character %q cannot be encoded", r)
+		}
+	}
+	return nil
+}
+
+// parseColour parses n components, as "#rrggbb..." or as decimal numbers separated by commas.
+func parseColour(value string, n int) ([]uint8, error) {
+	c := make([]uint8, n)
+	if strings.HasPrefix(value, "#") {
+		if len(value) != 1+2*n {
+			return nil, fmt.Errorf("SetDPT: %q is not a colour", value)
+		}
+		for i := range c {
+			v, err := strconv.ParseUint(value[1+2*i:3+2*i], 16, 8)
+			if err != nil {
+				return nil, fmt.Errorf("SetDPT: %q is not a colour", value)
+			}
+			c[i] = uint8(v)
+		}
+		return c, nil
+	}
+	fields := strings.Split(value, ",")
+	if len(fields) != n {
+		return nil, fmt.Errorf("SetDPT: %q is not a colour", value)
+	}
+	for i, f := range fields {
+		v, err := strconv.ParseUint(strings.TrimSpace(f), 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("SetDPT: %q is not a colour", value)
+		}
+		c[i] = uint8(v)
+	}
+	return c, nil
+}
 
-	// Normalize:
-	d.Unpack(d.Pack())
+// parseRGBW parses a DPT 251.600 value: "#rrggbbww", or "r,g,b,w" where
+// an empty component is not valid.
+func parseRGBW(d *dpt.DPT_251600, value string) error {
+	var c [4]uint8
+	var valid [4]bool
+	if strings.HasPrefix(value, "#") {
+		v, err := parseColour(value, 4)
+		if err != nil {
+			return err
+		}
+		copy(c[:], v)
+		valid = [4]bool{true, true, true, true}
+	} else {
+		fields := strings.Split(value, ",")
+		if len(fields) != 4 {
+			return fmt.Errorf("SetDPT: %q is not a RGBW colour", value)
+		}
+		for i, f := range fields {
+			f = strings.TrimSpace(f)
+			if f == "" {
+				continue
+			}
+			v, err := strconv.ParseUint(f, 10, 8)
+			if err != nil {
+				return fmt.Errorf("SetDPT: %q is not a RGBW colour", value)
+			}
+			c[i], valid[i] = uint8(v), true
+		}
+	}
+	*d = dpt.DPT_251600{
+		Red: c[0], Green: c[1], Blue: c[2], White: c[3],
+		RedValid: valid[0], GreenValid: valid[1], BlueValid: valid[2], WhiteValid: valid[3],
+	}
 	return nil
 }
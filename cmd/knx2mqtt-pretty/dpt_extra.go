@@ -0,0 +1,405 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/vapourismo/knx-go/knx/dpt"
+)
+
+// Datapoint types not implemented by knx-go.
+// As in knx-go, values longer than 6 bits are packed after a leading 0 byte.
+
+var errInvalidLength = errors.New("given application data has invalid length")
+
+var extraDPTs = map[string]func() dpt.DatapointValue{
+	"3.007":   func() dpt.DatapointValue { return new(DPT_3007) },
+	"3.008":   func() dpt.DatapointValue { return new(DPT_3008) },
+	"10.001":  func() dpt.DatapointValue { return new(DPT_10001) },
+	"11.001":  func() dpt.DatapointValue { return new(DPT_11001) },
+	"16.000":  func() dpt.DatapointValue { return new(DPT_16000) },
+	"16.001":  func() dpt.DatapointValue { return new(DPT_16001) },
+	"19.001":  func() dpt.DatapointValue { return new(DPT_19001) },
+	"20.102":  func() dpt.DatapointValue { return new(DPT_20102) },
+	"20.105":  func() dpt.DatapointValue { return new(DPT_20105) },
+	"232.600": func() dpt.DatapointValue { return new(DPT_232600) },
+}
+
+// ProduceDPT creates a value of the given datapoint type ("9.001").
+func ProduceDPT(name string) (dpt.DatapointValue, bool) {
+	if f, ok := extraDPTs[name]; ok {
+		return f(), true
+	}
+	return dpt.Produce(name)
+}
+
+// DPT_3007 represents DPT 3.007 / Dimming control.
+// Step is the step code: 0 stops, 1 to 7 are 100%, 50%... 1.56% steps.
+type DPT_3007 struct {
+	Increase bool
+	Step     uint8
+}
+
+func (d DPT_3007) Pack() []byte {
+	return packB1U3(d.Increase, d.Step)
+}
+
+func (d *DPT_3007) Unpack(data []byte) error {
+	return unpackB1U3(data, &d.Increase, &d.Step)
+}
+
+func (d DPT_3007) Unit() string {
+	return ""
+}
+
+func (d DPT_3007) String() string {
+	switch {
+	case d.Step == 0:
+		return "stop"
+	case d.Increase:
+		return fmt.Sprintf("increase %d", d.Step)
+	default:
+		return fmt.Sprintf("decrease %d", d.Step)
+	}
+}
+
+// DPT_3008 represents DPT 3.008 / Blind control.
+type DPT_3008 struct {
+	Down bool
+	Step uint8
+}
+
+func (d DPT_3008) Pack() []byte {
+	return packB1U3(d.Down, d.Step)
+}
+
+func (d *DPT_3008) Unpack(data []byte) error {
+	return unpackB1U3(data, &d.Down, &d.Step)
+}
+
+func (d DPT_3008) Unit() string {
+	return ""
+}
+
+func (d DPT_3008) String() string {
+	switch {
+	case d.Step == 0:
+		return "stop"
+	case d.Down:
+		return fmt.Sprintf("down %d", d.Step)
+	default:
+		return fmt.Sprintf("up %d", d.Step)
+	}
+}
+
+func packB1U3(b bool, u uint8) []byte {
+	v := u & 7
+	if b {
+		v |= 8
+	}
+	return []byte{v}
+}
+
+func unpackB1U3(data []byte, b *bool, u *uint8) error {
+	if len(data) != 1 {
+		return errInvalidLength
+	}
+	*b = data[0]&8 != 0
+	*u = data[0] & 7
+	return nil
+}
+
+var weekdays = []string{"", "Mon", "Tue", "Wed", "Thu", "Fri", "Sat", "Sun"}
+
+// DPT_10001 represents DPT 10.001 / Time of day.
+// Weekday is 0 (no day) or 1 (Monday) to 7 (Sunday).
+type DPT_10001 struct {
+	Weekday uint8
+	Hour    uint8
+	Minute  uint8
+	Second  uint8
+}
+
+func (d DPT_10001) Pack() []byte {
+	return []byte{0, d.Weekday<<5 | d.Hour&31, d.Minute & 63, d.Second & 63}
+}
+
+func (d *DPT_10001) Unpack(data []byte) error {
+	if len(data) != 4 {
+		return errInvalidLength
+	}
+	*d = DPT_10001{
+		Weekday: data[1] >> 5,
+		Hour:    data[1] & 31,
+		Minute:  data[2] & 63,
+		Second:  data[3] & 63,
+	}
+	if d.Hour > 23 || d.Minute > 59 || d.Second > 59 {
+		return fmt.Errorf("invalid time %02d:%02d:%02d", d.Hour, d.Minute, d.Second)
+	}
+	return nil
+}
+
+func (d DPT_10001) Unit() string {
+	return ""
+}
+
+func (d DPT_10001) String() string {
+	s := fmt.Sprintf("%02d:%02d:%02d", d.Hour, d.Minute, d.Second)
+	if d.Weekday > 0 {
+		s = weekdays[d.Weekday] + " " + s
+	}
+	return s
+}
+
+// DPT_11001 represents DPT 11.001 / Date.
+type DPT_11001 struct {
+	Year  uint16
+	Month uint8
+	Day   uint8
+}
+
+func (d DPT_11001) Pack() []byte {
+	return []byte{0, d.Day & 31, d.Month & 15, uint8(d.Year % 100)}
+}
+
+func (d *DPT_11001) Unpack(data []byte) error {
+	if len(data) != 4 {
+		return errInvalidLength
+	}
+	*d = DPT_11001{
+		Day:   data[1] & 31,
+		Month: data[2] & 15,
+		Year:  2000 + uint16(data[3]&127),
+	}
+	// years 1990 to 2089
+	if data[3]&127 >= 90 {
+		d.Year -= 100
+	}
+	if d.Day == 0 || d.Month == 0 || d.Month > 12 {
+		return fmt.Errorf("invalid date %04d-%02d-%02d", d.Year, d.Month, d.Day)
+	}
+	return nil
+}
+
+func (d DPT_11001) Unit() string {
+	return ""
+}
+
+func (d DPT_11001) String() string {
+	return fmt.Sprintf("%04d-%02d-%02d", d.Year, d.Month, d.Day)
+}
+
+// DPT_16000 represents DPT 16.000 / Character string (ASCII), up to 14 characters.
+type DPT_16000 string
+
+func (d DPT_16000) Pack() []byte {
+	return packString(string(d), 127)
+}
+
+func (d *DPT_16000) Unpack(data []byte) error {
+	s, err := unpackString(data)
+	*d = DPT_16000(s)
+	return err
+}
+
+func (d DPT_16000) Unit() string {
+	return ""
+}
+
+func (d DPT_16000) String() string {
+	return string(d)
+}
+
+// DPT_16001 represents DPT 16.001 / Character string (ISO 8859-1), up to 14 characters.
+type DPT_16001 string
+
+func (d DPT_16001) Pack() []byte {
+	return packString(string(d), 255)
+}
+
+func (d *DPT_16001) Unpack(data []byte) error {
+	s, err := unpackString(data)
+	*d = DPT_16001(s)
+	return err
+}
+
+func (d DPT_16001) Unit() string {
+	return ""
+}
+
+func (d DPT_16001) String() string {
+	return string(d)
+}
+
+// packString encodes the first 14 characters of s, replacing the ones
+// above max with '?', and pads them with zeros.
+func packString(s string, max rune) []byte {
+	b := make([]byte, 15)
+	i := 1
+	for _, r := range s {
+		if i == len(b) {
+			break
+		}
+		if r > max {
+			r = '?'
+		}
+		b[i] = byte(r)
+		i++
+	}
+	return b
+}
+
+func unpackString(data []byte) (string, error) {
+	if len(data) != 15 {
+		return "", errInvalidLength
+	}
+	var b strings.Builder
+	for _, c := range data[1:] {
+		if c == 0 {
+			break
+		}
+		b.WriteRune(rune(c))
+	}
+	return b.String(), nil
+}
+
+// DPT_19001 represents DPT 19.001 / Date and time, in local time.
+// Fault is set if the clock sending it reports an error.
+type DPT_19001 struct {
+	Time  time.Time
+	Fault bool
+}
+
+func (d DPT_19001) Pack() []byte {
+	t := d.Time
+	weekday := uint8(t.Weekday())
+	if weekday == 0 {
+		weekday = 7
+	}
+	// working day and quality of clock are not known
+	flags := uint8(0x20)
+	if d.Fault {
+		flags |= 0x80
+	}
+	if t.IsDST() {
+		flags |= 0x01
+	}
+	return []byte{0, uint8(t.Year() - 1900), uint8(t.Month()), uint8(t.Day()),
+		weekday<<5 | uint8(t.Hour()), uint8(t.Minute()), uint8(t.Second()), flags, 0}
+}
+
+func (d *DPT_19001) Unpack(data []byte) error {
+	if len(data) != 9 {
+		return errInvalidLength
+	}
+	year := 1900 + int(data[1])
+	month := time.Month(data[2] & 15)
+	day := int(data[3] & 31)
+	hour, min, sec := int(data[4]&31), int(data[5]&63), int(data[6]&63)
+	flags := data[7]
+	if flags&0x10 != 0 { // no year
+		year = time.Now().Year()
+	}
+	if flags&0x08 != 0 { // no date
+		month, day = 1, 1
+	}
+	if flags&0x02 != 0 { // no time
+		hour, min, sec = 0, 0, 0
+	}
+	*d = DPT_19001{
+		Time:  time.Date(year, month, day, hour, min, sec, 0, time.Local),
+		Fault: flags&0x80 != 0,
+	}
+	return nil
+}
+
+func (d DPT_19001) Unit() string {
+	return ""
+}
+
+func (d DPT_19001) String() string {
+	s := d.Time.Format("2006-01-02 15:04:05")
+	if d.Fault {
+		s += " (fault)"
+	}
+	return s
+}
+
+// DPT_20102 represents DPT 20.102 / HVAC mode: 0 is auto, 1 comfort,
+// 2 standby, 3 economy and 4 building protection.  The names of the
+// values can be set with "labels" in the config file.
+type DPT_20102 uint8
+
+func (d DPT_20102) Pack() []byte {
+	return []byte{0, uint8(d)}
+}
+
+func (d *DPT_20102) Unpack(data []byte) error {
+	if len(data) != 2 {
+		return errInvalidLength
+	}
+	*d = DPT_20102(data[1])
+	return nil
+}
+
+func (d DPT_20102) Unit() string {
+	return ""
+}
+
+func (d DPT_20102) String() string {
+	return fmt.Sprint(uint8(d))
+}
+
+// DPT_20105 represents DPT 20.105 / HVAC control mode: 0 is auto, 1 heat,
+// 3 cool, 6 off, 9 fan only...
+type DPT_20105 uint8
+
+func (d DPT_20105) Pack() []byte {
+	return []byte{0, uint8(d)}
+}
+
+func (d *DPT_20105) Unpack(data []byte) error {
+	if len(data) != 2 {
+		return errInvalidLength
+	}
+	*d = DPT_20105(data[1])
+	return nil
+}
+
+func (d DPT_20105) Unit() string {
+	return ""
+}
+
+func (d DPT_20105) String() string {
+	return fmt.Sprint(uint8(d))
+}
+
+// DPT_232600 represents DPT 232.600 / Colour RGB.
+type DPT_232600 struct {
+	Red   uint8
+	Green uint8
+	Blue  uint8
+}
+
+func (d DPT_232600) Pack() []byte {
+	return []byte{0, d.Red, d.Green, d.Blue}
+}
+
+func (d *DPT_232600) Unpack(data []byte) error {
+	if len(data) != 4 {
+		return errInvalidLength
+	}
+	*d = DPT_232600{Red: data[1], Green: data[2], Blue: data[3]}
+	return nil
+}
+
+func (d DPT_232600) Unit() string {
+	return ""
+}
+
+func (d DPT_232600) String() string {
+	return fmt.Sprintf("#%02x%02x%02x", d.Red, d.Green, d.Blue)
+}
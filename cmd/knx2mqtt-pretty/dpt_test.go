@@ -0,0 +1,115 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/vapourismo/knx-go/knx/dpt"
+)
+
+// dptSample is a value given to SetDPTFromString and the one expected
+// from GetDPTAsString after packing and unpacking it.
+type dptSample struct {
+	value, want string
+}
+
+// dptSamples has the values to test for each datapoint type, by its main number
+// ("9") unless there are values for the specific type ("5.001").
+var dptSamples = map[string][]dptSample{
+	"1":     {{"true", "true"}, {"off", "false"}, {"1", "true"}},
+	"5":     {{"0", "0"}, {"200", "200"}, {"255", "255"}},
+	"5.001": {{"0", "0"}, {"100", "100"}, {"50", "49.80392"}},
+	"5.003": {{"0", "0"}, {"360", "360"}},
+	"7":     {{"0", "0"}, {"65535", "65535"}},
+	"9":     {{"21.5", "21.5"}, {"0", "0"}, {"0.01", "0.01"}},
+	"9.001": {{"21.5", "21.5"}, {"-7.5", "-7.5"}, {"-273", "-272.96"}}, // 2-byte floats lose precision
+	"12":    {{"0", "0"}, {"4294967295", "4294967295"}},
+	"13":    {{"42", "42"}, {"-2147483648", "-2147483648"}},
+	"14":    {{"1013.25", "1013.25"}, {"-0.5", "-0.5"}},
+	"17":    {{"0", "0"}, {"63", "63"}},
+	"18":    {{"5", "5"}, {"130", "130"}},
+	"251":   {{"1,2,3,4", "1,2,3,4"}, {"#ff000080", "255,0,0,128"}, {",,,255", ",,,255"}},
+
+	"3.007":   {{"increase 3", "increase 3"}, {"decrease", "decrease 1"}, {"stop", "stop"}},
+	"3.008":   {{"down 7", "down 7"}, {"up", "up 1"}, {"stop", "stop"}},
+	"10.001":  {{"Tue 08:30:00", "Tue 08:30:00"}, {"23:59", "23:59:00"}},
+	"11.001":  {{"2024-02-29", "2024-02-29"}, {"1990-01-01", "1990-01-01"}, {"2089-12-31", "2089-12-31"}},
+	"16.000":  {{"Hello KNX", "Hello KNX"}, {"", ""}, {"14 characters!", "14 characters!"}},
+	"16.001":  {{"Größe", "Größe"}},
+	"19.001":  {{"2024-06-01 12:34:56", "2024-06-01 12:34:56"}, {"2024-12-31T23:59:59", "2024-12-31 23:59:59"}},
+	"20.102":  {{"3", "3"}},
+	"20.105":  {{"6", "6"}},
+	"232.600": {{"#ff8000", "#ff8000"}, {"0,128,255", "#0080ff"}},
+}
+
+// dptTypes returns all the datapoint types supported: the ones in knx-go and the extra ones.
+func dptTypes() []string {
+	names := dpt.ListSupportedTypes()
+	for name := range extraDPTs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestDPTRoundTrip(t *testing.T) {
+	for _, name := range dptTypes() {
+		samples, ok := dptSamples[name]
+		if !ok {
+			samples, ok = dptSamples[strings.Split(name, ".")[0]]
+		}
+		if !ok {
+			t.Errorf("%s: no values to test", name)
+			continue
+		}
+		for _, s := range samples {
+			d, ok := ProduceDPT(name)
+			if !ok {
+				t.Fatalf("%s: unknown datapoint type", name)
+			}
+			if err := SetDPTFromString(d, s.value); err != nil {
+				t.Errorf("%s: SetDPTFromString(%q): %v", name, s.value, err)
+				continue
+			}
+			data := d.Pack()
+			u, _ := ProduceDPT(name)
+			if err := u.Unpack(data); err != nil {
+				t.Errorf("%s: %q packed as % x: %v", name, s.value, data, err)
+				continue
+			}
+			if got := GetDPTAsString(u); got != s.want {
+				t.Errorf("%s: %q packed as % x is %q, want %q", name, s.value, data, got, s.want)
+			}
+		}
+	}
+}
+
+func TestDPTInvalid(t *testing.T) {
+	tests := []struct {
+		name, value string
+	}{
+		{"1.001", "maybe"},
+		{"3.007", "increase 8"},
+		{"3.008", "sideways"},
+		{"5.004", "256"},
+		{"9.001", "warm"},
+		{"10.001", "Someday 10:00"},
+		{"10.001", "25:00"},
+		{"11.001", "1989-12-31"},
+		{"16.000", "Größe"},
+		{"16.000", "15 characters!!"},
+		{"19.001", "2024-06-01"},
+		{"232.600", "#ff80"},
+		{"251.600", "1,2,3"},
+	}
+	for _, test := range tests {
+		d, ok := ProduceDPT(test.name)
+		if !ok {
+			t.Fatalf("%s: unknown datapoint type", test.name)
+		}
+		if err := SetDPTFromString(d, test.value); err == nil {
+			t.Errorf("%s: SetDPTFromString(%q) = %q, want error", test.name, test.value, GetDPTAsString(d))
+		}
+	}
+}
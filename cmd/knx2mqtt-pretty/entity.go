@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cespedes/knx2mqtt/internal/mqttclient"
+	"github.com/vapourismo/knx-go/knx"
+	"github.com/vapourismo/knx-go/knx/cemi"
+)
+
+// Entity is a group of addresses which are controlled together, such as
+// the ones of a light or a blind.  Its state is published as a JSON object
+// in prefix2/<name>, and commands to any of its addresses are sent to
+// prefix2/<name>/set.
+type Entity struct {
+	Type    string // "light", "cover", "climate" or "switch"
+	Name    string
+	Members []EntityMember
+}
+
+// EntityMember is one of the addresses of an entity.
+type EntityMember struct {
+	Role string // "switch", "switch-status", "brightness"...
+	Addr cemi.GroupAddr
+	DPT  string
+}
+
+type roleKind int
+
+const (
+	roleCommand roleKind = iota // only used to send commands
+	roleStatus                  // only used to report the state
+	roleBoth                    // used to send commands, and to report the state if there is no status address
+)
+
+// entityRole is the definition of a role in a type of entity.
+type entityRole struct {
+	Key  string // key in the state and in the commands
+	DPT  string // default DPT
+	Kind roleKind
+}
+
+// entityRoles are the roles of the addresses in each type of entity.
+var entityRoles = map[string]map[string]entityRole{
+	"light": {
+		"switch":            {"state", "1.001", roleBoth},
+		"switch-status":     {"state", "1.001", roleStatus},
+		"brightness":        {"brightness", "5.001", roleBoth},
+		"brightness-status": {"brightness", "5.001", roleStatus},
+	},
+	"switch": {
+		"switch":        {"state", "1.001", roleBoth},
+		"switch-status": {"state", "1.001", roleStatus},
+	},
+	"cover": {
+		"up-down":         {"state", "1.008", roleCommand},
+		"stop":            {"state", "1.010", roleCommand},
+		"position":        {"position", "5.001", roleBoth},
+		"position-status": {"position", "5.001", roleStatus},
+	},
+	"climate": {
+		"temperature":     {"current_temperature", "9.001", roleStatus},
+		"setpoint":        {"temperature", "9.001", roleBoth},
+		"setpoint-status": {"temperature", "9.001", roleStatus},
+		"mode":            {"mode", "1.100", roleBoth},
+		"mode-status":     {"mode", "1.100", roleStatus},
+	},
+}
+
+// Member returns the member of e with the given role, or nil.
+func (e *Entity) Member(role string) *EntityMember {
+	for i := range e.Members {
+		if e.Members[i].Role == role {
+			return &e.Members[i]
+		}
+	}
+	return nil
+}
+
+// Reports returns whether the member with the given role is used to report
+// the state of e.
+func (e *Entity) Reports(role string) bool {
+	r := entityRoles[e.Type][role]
+	switch r.Kind {
+	case roleStatus:
+		return true
+	case roleBoth:
+		for _, m := range e.Members {
+			if m.Role != role && entityRoles[e.Type][m.Role].Key == r.Key && entityRoles[e.Type][m.Role].Kind == roleStatus {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// parseEntityMember parses a line "<role> <address> [DPT]" in an entity block.
+func parseEntityMember(e *Entity, tokens []string) (EntityMember, error) {
+	if len(tokens) < 2 || len(tokens) > 3 {
+		return EntityMember{}, errors.New("syntax error")
+	}
+	r, ok := entityRoles[e.Type][tokens[0]]
+	if !ok {
+		return EntityMember{}, fmt.Errorf("unknown role %s in %s", tokens[0], e.Type)
+	}
+	if e.Member(tokens[0]) != nil {
+		return EntityMember{}, fmt.Errorf("duplicate role %s in %s", tokens[0], e.Name)
+	}
+	addr, err := cemi.NewGroupAddrString(tokens[1])
+	if err != nil {
+		return EntityMember{}, err
+	}
+	m := EntityMember{Role: tokens[0], Addr: addr, DPT: r.DPT}
+	if len(tokens) == 3 {
+		m.DPT = tokens[2]
+	}
+	return m, nil
+}
+
+// entityMemberRef is a reference to a member of an entity, from its address.
+type entityMemberRef struct {
+	Entity *Entity
+	Member *EntityMember
+}
+
+// entityValue returns the value of a member, as it is published in the state of the entity.
+func entityValue(key string, e Event, DPT string) (interface{}, error) {
+	dp, ok := ProduceDPT(DPT)
+	if !ok {
+		return nil, fmt.Errorf("unknown type %s", DPT)
+	}
+	if err := dp.Unpack(e.Data); err != nil {
+		return nil, err
+	}
+	v := GetDPTValue(dp)
+	switch key {
+	case "state":
+		if b, ok := v.(bool); ok {
+			if b {
+				return "ON", nil
+			}
+			return "OFF", nil
+		}
+	case "mode":
+		return strings.ToLower(fmt.Sprint(dp)), nil
+	}
+	return v, nil
+}
+
+// updateEntities updates the state of the entities with a member in the
+// destination of e, and publishes it.
+func (s *Server) updateEntities(client *mqttclient.Client, e Event) {
+	for _, ref := range config.EntityAddrs[e.Destination] {
+		if !ref.Entity.Reports(ref.Member.Role) {
+			continue
+		}
+		key := entityRoles[ref.Entity.Type][ref.Member.Role].Key
+		value, err := entityValue(key, e, ref.Member.DPT)
+		if err != nil {
+			logDPT.Warn("error parsing data", "data", fmt.Sprint(e.Data), "ga", e.Destination.String(), "dpt", ref.Member.DPT, "error", err)
+			continue
+		}
+		if s.entityState == nil {
+			s.entityState = make(map[string]map[string]interface{})
+		}
+		state := s.entityState[ref.Entity.Name]
+		if state == nil {
+			state = make(map[string]interface{})
+			s.entityState[ref.Entity.Name] = state
+		}
+		state[key] = value
+		b, _ := json.Marshal(state)
+		topic := fmt.Sprintf("%s/%s", config.MQTTPrefix2, ref.Entity.Name)
+		if err := client.PublishRetain(topic, string(b)); err != nil {
+			logMQTT.Error("could not publish", "topic", topic, "error", err)
+		}
+	}
+}
+
+// entityWrite returns the member and the value to write to set key to value.
+func (e *Entity) entityWrite(key string, value string) (*EntityMember, string, error) {
+	if key == "state" {
+		if e.Type == "cover" {
+			role := "up-down"
+			switch strings.ToUpper(value) {
+			case "OPEN":
+				value = "up"
+			case "CLOSE":
+				value = "down"
+			case "STOP":
+				role, value = "stop", "1"
+			default:
+				return nil, "", fmt.Errorf("invalid state %q (must be OPEN, CLOSE or STOP)", value)
+			}
+			if m := e.Member(role); m != nil {
+				return m, value, nil
+			}
+			return nil, "", fmt.Errorf("%s has no %s address", e.Name, role)
+		}
+		switch strings.ToUpper(value) {
+		case "ON":
+			value = "true"
+		case "OFF":
+			value = "false"
+		}
+	}
+	for i, m := range e.Members {
+		r := entityRoles[e.Type][m.Role]
+		if r.Key == key && r.Kind != roleStatus {
+			return &e.Members[i], value, nil
+		}
+	}
+	return nil, "", fmt.Errorf("%s cannot set %q", e.Name, key)
+}
+
+// parseEntityPayload returns the values sent to prefix2/<name>/set for an entity.
+// The payload can be a JSON object ({"state":"ON","brightness":50}) or
+// a plain value, which is the state ("ON", "OFF", "OPEN", "CLOSE", "STOP").
+func parseEntityPayload(payload []byte) (map[string]string, error) {
+	payload = bytes.TrimSpace(payload)
+	if len(payload) == 0 {
+		return nil, errors.New("empty value")
+	}
+	if payload[0] != '{' {
+		_, value, err := parseSetPayload(payload)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]string{"state": value}, nil
+	}
+	d := json.NewDecoder(bytes.NewReader(payload))
+	d.UseNumber()
+	var tmp map[string]interface{}
+	if err := d.Decode(&tmp); err != nil {
+		return nil, err
+	}
+	values := make(map[string]string)
+	for k, v := range tmp {
+		switch v := v.(type) {
+		case string:
+			values[k] = v
+		case json.Number:
+			values[k] = v.String()
+		case bool:
+			values[k] = fmt.Sprint(v)
+		default:
+			return nil, fmt.Errorf("invalid value for %s", k)
+		}
+	}
+	return values, nil
+}
+
+// handleEntityCommand handles a message published to prefix2/<name>/set or
+// prefix2/<name>/get for an entity: a set is sent to the addresses of the
+// values in it, and a get reads the addresses which report its state.
+func handleEntityCommand(client *mqttclient.Client, e *Entity, action string, payload []byte) error {
+	if action == "get" {
+		for _, m := range e.Members {
+			if e.Reports(m.Role) {
+				if err := sendGroupEvent(client, knx.GroupRead, m.Addr, []byte{0}); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	values, err := parseEntityPayload(payload)
+	if err != nil {
+		return err
+	}
+	// the state first (for example, to turn a light on before setting its brightness)
+	var keys []string
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i] == "state" || keys[j] == "state" {
+			return keys[i] == "state"
+		}
+		return keys[i] < keys[j]
+	})
+	type write struct {
+		m     *EntityMember
+		value string
+	}
+	var writes []write
+	for _, k := range keys {
+		m, value, err := e.entityWrite(k, values[k])
+		if err != nil {
+			return err
+		}
+		writes = append(writes, write{m, value})
+	}
+	// check all the values before sending any of them
+	var events []knx.GroupEvent
+	for _, w := range writes {
+		dp, ok := ProduceDPT(w.m.DPT)
+		if !ok {
+			return fmt.Errorf("unknown type %s", w.m.DPT)
+		}
+		if err := SetDPTFromString(dp, w.value); err != nil {
+			return fmt.Errorf("wrong value for %s (DPT %s): %w", w.m.Role, w.m.DPT, err)
+		}
+		events = append(events, knx.GroupEvent{Command: knx.GroupWrite, Destination: w.m.Addr, Data: dp.Pack()})
+	}
+	for _, ev := range events {
+		logMQTT.Info("command received", "command", ev.Command.String(), "name", e.Name, "ga", ev.Destination.String())
+		if err := sendGroupEvent(client, ev.Command, ev.Destination, ev.Data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendGroupEvent publishes a command in prefix1/cmd, to be sent to KNX by knx2mqtt.
+func sendGroupEvent(client *mqttclient.Client, command knx.GroupCommand, addr cemi.GroupAddr, data []byte) error {
+	topic := fmt.Sprintf("%s/cmd", config.MQTTPrefix1)
+	groupEvent := knx.GroupEvent{Command: command, Destination: addr, Data: data}
+	event := Event{Time: time.Now(), GroupEvent: groupEvent}
+	b, _ := event.MarshalJSON()
+	return client.PublishMessage(&mqttclient.Message{
+		Topic:       topic,
+		Payload:     b,
+		ContentType: "application/json",
+		Expiry:      CommandExpiry,
+	})
+}
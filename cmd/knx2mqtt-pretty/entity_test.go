@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/cespedes/knx2mqtt/internal/mqttclient"
+	"github.com/vapourismo/knx-go/knx"
+	"github.com/vapourismo/knx-go/knx/cemi"
+)
+
+const entityTestConfig = `
+mqtt-prefix1 knx
+mqtt-prefix2 rooms
+entity light kitchen/lamp
+	switch 2/1/1
+	switch-status 2/1/2
+	brightness 2/1/3
+end
+entity cover kitchen/blind
+	up-down 2/2/1
+	stop 2/2/2
+	position 2/2/3 5.001
+end
+entity cover hall/blind
+	up-down 2/2/11
+end
+entity climate kitchen/climate
+	temperature 2/3/1
+	setpoint 2/3/2
+	mode 2/3/3
+end
+entity climate hall/climate
+	temperature 2/3/1
+	setpoint 2/3/12 9.001
+end
+`
+
+func TestEntityConfig(t *testing.T) {
+	c := useConfig(t, entityTestConfig)
+	lamp := c.Entities["kitchen/lamp"]
+	if lamp == nil || lamp.Type != "light" {
+		t.Fatalf("entities: %v", c.Entities)
+	}
+	want := []EntityMember{
+		{"switch", cemi.NewGroupAddr3(2, 1, 1), "1.001"},
+		{"switch-status", cemi.NewGroupAddr3(2, 1, 2), "1.001"},
+		{"brightness", cemi.NewGroupAddr3(2, 1, 3), "5.001"},
+	}
+	if !reflect.DeepEqual(lamp.Members, want) {
+		t.Errorf("members %v, want %v", lamp.Members, want)
+	}
+	// an address can be in several entities
+	refs := c.EntityAddrs[cemi.NewGroupAddr3(2, 3, 1)]
+	if len(refs) != 2 || refs[0].Entity.Name != "kitchen/climate" || refs[1].Entity.Name != "hall/climate" || refs[1].Member.Role != "temperature" {
+		t.Errorf("entities of 2/3/1: %v", refs)
+	}
+
+	errors := []struct {
+		name   string
+		config string
+		err    string
+	}{
+		{"unknown type", "entity fan x\nend\n", "unknown entity type fan"},
+		{"unknown role", "entity light x\n\tcolour 1/1/1\nend\n", "unknown role colour in light"},
+		{"duplicate role", "entity light x\n\tswitch 1/1/1\n\tswitch 1/1/2\nend\n", "duplicate role switch in x"},
+		{"no members", "entity light x\nend\n", "syntax error"},
+		{"no end", "entity light x\n\tswitch 1/1/1\n", "entity x without end"},
+		{"member syntax", "entity light x\n\tswitch 1/1/1 1.001 extra\nend\n", "syntax error"},
+		{"duplicate entity", "entity light x\n\tswitch 1/1/1\nend\nentity switch x\n\tswitch 1/1/2\nend\n", "duplicate entity x"},
+		{"name of an address", "address 1/1/2 1.001 x\nentity light x\n\tswitch 1/1/1\nend\n", "is the name of an entity and of an address"},
+	}
+	for _, test := range errors {
+		filename := filepath.Join(t.TempDir(), "knx.cfg")
+		if err := os.WriteFile(filename, []byte(test.config), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ReadConfig(filename); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: error %v, want %q", test.name, err, test.err)
+		}
+	}
+}
+
+func TestEntityReports(t *testing.T) {
+	c := useConfig(t, entityTestConfig)
+	tests := []struct {
+		entity, role string
+		reports      bool
+	}{
+		{"kitchen/lamp", "switch", false}, // it has a status address
+		{"kitchen/lamp", "switch-status", true},
+		{"kitchen/lamp", "brightness", true},
+		{"kitchen/blind", "up-down", false},
+		{"kitchen/blind", "stop", false},
+		{"kitchen/blind", "position", true},
+		{"kitchen/climate", "temperature", true},
+		{"kitchen/climate", "setpoint", true},
+	}
+	for _, test := range tests {
+		if r := c.Entities[test.entity].Reports(test.role); r != test.reports {
+			t.Errorf("%s %s: reports %v", test.entity, test.role, r)
+		}
+	}
+}
+
+func TestEntityWrite(t *testing.T) {
+	c := useConfig(t, entityTestConfig)
+	tests := []struct {
+		entity, key, value string
+		role, write        string // role of the member written, and the value written
+	}{
+		{"kitchen/lamp", "state", "ON", "switch", "true"},
+		{"kitchen/lamp", "state", "off", "switch", "false"},
+		{"kitchen/lamp", "brightness", "50", "brightness", "50"},
+		{"kitchen/blind", "state", "OPEN", "up-down", "up"},
+		{"kitchen/blind", "state", "close", "up-down", "down"},
+		{"kitchen/blind", "state", "STOP", "stop", "1"},
+		{"kitchen/blind", "position", "30", "position", "30"},
+		{"kitchen/climate", "temperature", "21.5", "setpoint", "21.5"},
+		{"kitchen/climate", "mode", "heat", "mode", "heat"},
+		{"hall/blind", "state", "STOP", "", ""},                  // no stop address
+		{"kitchen/blind", "state", "ON", "", ""},                 // not a cover state
+		{"kitchen/climate", "current_temperature", "20", "", ""}, // only a status
+		{"kitchen/lamp", "color", "red", "", ""},
+	}
+	for _, test := range tests {
+		m, value, err := c.Entities[test.entity].entityWrite(test.key, test.value)
+		if test.role == "" {
+			if err == nil {
+				t.Errorf("%s %s=%s: written to %s", test.entity, test.key, test.value, m.Role)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s %s=%s: %v", test.entity, test.key, test.value, err)
+			continue
+		}
+		if m.Role != test.role || value != test.write {
+			t.Errorf("%s %s=%s: %s=%s, want %s=%s", test.entity, test.key, test.value, m.Role, value, test.role, test.write)
+		}
+	}
+}
+
+func TestParseEntityPayload(t *testing.T) {
+	tests := []struct {
+		payload string
+		values  map[string]string
+	}{
+		{"ON", map[string]string{"state": "ON"}},
+		{` "STOP"`, map[string]string{"state": "STOP"}},
+		{`{"state":"ON","brightness":50}`, map[string]string{"state": "ON", "brightness": "50"}},
+		{`{"temperature":21.5,"mode":"heat","window":false}`, map[string]string{"temperature": "21.5", "mode": "heat", "window": "false"}},
+		{"", nil},
+		{`{"state":`, nil},
+		{`{"state":["ON"]}`, nil},
+		{`{"state":null}`, nil},
+	}
+	for _, test := range tests {
+		values, err := parseEntityPayload([]byte(test.payload))
+		if test.values == nil {
+			if err == nil {
+				t.Errorf("%q: %v", test.payload, values)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(values, test.values) {
+			t.Errorf("%q: %v %v, want %v", test.payload, values, err, test.values)
+		}
+	}
+}
+
+// receiveEvents returns the next n telegrams sent to knx2mqtt.
+func receiveEvents(t *testing.T, ch chan *mqttclient.Message, n int) []knx.GroupEvent {
+	t.Helper()
+	var events []knx.GroupEvent
+	for m := receive(ch); m != nil; m = receive(ch) {
+		var e Event
+		if err := json.Unmarshal(m.Payload, &e); err != nil {
+			t.Fatalf("%s: %v", m.Payload, err)
+		}
+		events = append(events, e.GroupEvent)
+		if len(events) == n {
+			break
+		}
+	}
+	return events
+}
+
+func TestHandleEntityCommand(t *testing.T) {
+	c := useConfig(t, entityTestConfig)
+	client, ch := startBroker(t, "knx/cmd")
+	write := func(addr cemi.GroupAddr, data ...byte) knx.GroupEvent {
+		return knx.GroupEvent{Command: knx.GroupWrite, Destination: addr, Data: data}
+	}
+	read := func(addr cemi.GroupAddr) knx.GroupEvent {
+		return knx.GroupEvent{Command: knx.GroupRead, Destination: addr, Data: []byte{0}}
+	}
+	tests := []struct {
+		entity, action, payload string
+		sent                    []knx.GroupEvent
+		ok                      bool
+	}{
+		// the state first, and then the rest in order
+		{"kitchen/lamp", "set", `{"brightness":100,"state":"ON"}`, []knx.GroupEvent{
+			write(cemi.NewGroupAddr3(2, 1, 1), 1),
+			write(cemi.NewGroupAddr3(2, 1, 3), 0, 255),
+		}, true},
+		{"kitchen/lamp", "set", "OFF", []knx.GroupEvent{write(cemi.NewGroupAddr3(2, 1, 1), 0)}, true},
+		{"kitchen/blind", "set", "OPEN", []knx.GroupEvent{write(cemi.NewGroupAddr3(2, 2, 1), 0)}, true},
+		{"kitchen/blind", "set", "CLOSE", []knx.GroupEvent{write(cemi.NewGroupAddr3(2, 2, 1), 1)}, true},
+		{"kitchen/blind", "set", "STOP", []knx.GroupEvent{write(cemi.NewGroupAddr3(2, 2, 2), 1)}, true},
+		{"kitchen/climate", "set", `{"temperature":21.5,"mode":"cool"}`, []knx.GroupEvent{
+			write(cemi.NewGroupAddr3(2, 3, 3), 0),
+			write(cemi.NewGroupAddr3(2, 3, 2), 0, 0x0c, 0x33),
+		}, true},
+		// the addresses which report the state
+		{"kitchen/lamp", "get", "", []knx.GroupEvent{read(cemi.NewGroupAddr3(2, 1, 2)), read(cemi.NewGroupAddr3(2, 1, 3))}, true},
+		// nothing is sent if any value is wrong
+		{"kitchen/lamp", "set", `{"state":"ON","brightness":"lots"}`, nil, false},
+		{"kitchen/blind", "set", `{"state":"OPEN","tilt":50}`, nil, false},
+		{"hall/blind", "set", "STOP", nil, false},
+	}
+	for _, test := range tests {
+		err := handleEntityCommand(client, c.Entities[test.entity], test.action, []byte(test.payload))
+		if (err == nil) != test.ok {
+			t.Errorf("%s %s %s: error %v", test.entity, test.action, test.payload, err)
+		}
+		if len(test.sent) == 0 {
+			// anything sent would be received in the next test
+			continue
+		}
+		if sent := receiveEvents(t, ch, len(test.sent)); !reflect.DeepEqual(sent, test.sent) {
+			t.Errorf("%s %s %s: sent %v, want %v", test.entity, test.action, test.payload, sent, test.sent)
+		}
+	}
+	if m := receive(ch); m != nil {
+		t.Errorf("sent %s", m.Payload)
+	}
+}
+
+// A value received from an address in several entities updates all of them.
+func TestUpdateEntities(t *testing.T) {
+	useConfig(t, entityTestConfig)
+	client, ch := startBroker(t, "rooms/+/+")
+	s := &Server{}
+	s.updateEntities(client, Event{GroupEvent: write9(cemi.NewGroupAddr3(2, 3, 1))})
+	s.updateEntities(client, Event{GroupEvent: write9(cemi.NewGroupAddr3(2, 3, 12))})
+	want := map[string]string{
+		"rooms/kitchen/climate": `{"current_temperature":21.5}`,
+		"rooms/hall/climate":    `{"current_temperature":21.5,"temperature":21.5}`,
+	}
+	got := make(map[string]string)
+	for m := receive(ch); m != nil; m = receive(ch) {
+		got[m.Topic] = string(m.Payload)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("published %v, want %v", got, want)
+	}
+}
+
+// write9 is a write of 21.5 in a 2-byte float (DPT 9.xxx).
+func write9(addr cemi.GroupAddr) knx.GroupEvent {
+	return knx.GroupEvent{Command: knx.GroupWrite, Destination: addr, Data: []byte{0, 0x0c, 0x33}}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/cespedes/knx2mqtt/internal/mqttclient"
+	"github.com/vapourismo/knx-go/knx/cemi"
+	"github.com/vapourismo/knx-go/knx/dpt"
+)
+
+// Home Assistant MQTT discovery: for every group address in the config file,
+// a retained message is published in <prefix>/<component>/<node>/<name>/config.
+// See https://www.home-assistant.io/integrations/mqtt/#mqtt-discovery
+
+// haDeviceClasses are the device classes of the sensors of some DPTs.
+var haDeviceClasses = map[string]string{
+	"9.001":  "temperature",
+	"9.004":  "illuminance",
+	"9.005":  "wind_speed",
+	"9.006":  "pressure",
+	"9.007":  "humidity",
+	"13.010": "energy",
+	"13.013": "energy",
+	"14.019": "current",
+	"14.027": "voltage",
+	"14.056": "power",
+}
+
+// haID returns s with the characters not allowed in discovery topics and IDs replaced by '_'.
+func haID(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-' {
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+// haComponent returns the Home Assistant component inferred from a DPT and
+// whether the address is writable, or "" if it should not be published
+// without an explicit declaration.
+func haComponent(DPT string, writable bool) string {
+	switch {
+	case DPT == "1.001" && writable:
+		return "switch"
+	case strings.HasPrefix(DPT, "1."):
+		return "binary_sensor"
+	case DPT == "5.001" && writable:
+		return "number"
+	case strings.HasPrefix(DPT, "3."), DPT == "232.600", DPT == "251.600":
+		// step controls and colours are not useful as sensors
+		return ""
+	}
+	return "sensor"
+}
+
+// haValueTemplate returns the template to extract the value of dp from its state topic.
+// Booleans are converted to "ON" and "OFF".  Values with labels are text.
+func haValueTemplate(dp dpt.DatapointValue, t *Transform) string {
+	var v interface{} = GetDPTValue(dp)
+	if t != nil && t.Labels != nil {
+		v = ""
+	}
+	switch v.(type) {
+	case bool:
+		if config.Payload == "json" {
+			return "{{ 'ON' if value_json.value else 'OFF' }}"
+		}
+		on := copyDPT(dp)
+		SetDPTFromString(on, "true")
+		return fmt.Sprintf("{{ 'ON' if value.split(' ', 1)[1] == '%s' else 'OFF' }}", on)
+	case float64:
+		if config.Payload == "json" {
+			return "{{ value_json.value }}"
+		}
+		// the number, without the unit (which is not always separated by a space)
+		return "{{ value.split(' ')[1] | regex_findall_index('^-?[0-9.]+') }}"
+	default:
+		if config.Payload == "json" {
+			return "{{ value_json.value }}"
+		}
+		return "{{ value.split(' ', 1)[1] }}"
+	}
+}
+
+// haDiscovery returns the discovery topic and payload for a name, or an
+// empty topic if it must not be published.
+func haDiscovery(name string, nt addrNameType) (string, []byte) {
+	DPT := nt.DPT
+	dp, ok := ProduceDPT(DPT)
+	if !ok {
+		return "", nil
+	}
+	entity, explicit := config.HAEntities[name]
+	component := entity.Component
+	if !explicit {
+		component = haComponent(DPT, nt.Writable)
+		if nt.Transform != nil && nt.Transform.Labels != nil && component != "" {
+			component = "sensor"
+		}
+	}
+	if component == "" || component == "none" {
+		return "", nil
+	}
+
+	p := haPayload(name)
+	p["state_topic"] = fmt.Sprintf("%s/%s", config.MQTTPrefix2, name)
+	p["value_template"] = haValueTemplate(dp, nt.Transform)
+	if unit := nt.Transform.Unit(dp); unit != "" {
+		p["unit_of_measurement"] = unit
+	}
+	switch component {
+	case "sensor":
+		if nt.Transform != nil && nt.Transform.Labels != nil {
+			delete(p, "unit_of_measurement")
+			break
+		}
+		if _, ok := GetDPTValue(dp).(float64); ok {
+			p["state_class"] = "measurement"
+		}
+		if class, ok := haDeviceClasses[DPT]; ok {
+			p["device_class"] = class
+			if class == "energy" {
+				p["state_class"] = "total_increasing"
+			}
+		}
+	case "binary_sensor":
+	case "switch":
+		p["payload_on"] = "true"
+		p["payload_off"] = "false"
+		p["state_on"] = "ON"
+		p["state_off"] = "OFF"
+	case "number":
+		if DPT == "5.001" {
+			min, max := 0.0, 100.0
+			if t := nt.Transform; t != nil {
+				min, max = t.round(min*t.Scale+t.Offset), t.round(max*t.Scale+t.Offset)
+				if min > max {
+					min, max = max, min
+				}
+			}
+			p["min"] = min
+			p["max"] = max
+		}
+	}
+	if component != "sensor" && component != "binary_sensor" {
+		p["command_topic"] = fmt.Sprintf("%s/%s/set", config.MQTTPrefix2, name)
+	}
+	return haTopic(component, name), haMarshal(p, entity.Options)
+}
+
+// haEntityDiscovery returns the discovery topic and payload for an entity, or
+// an empty topic if it must not be published.  Its state is a JSON object.
+func haEntityDiscovery(e *Entity) (string, []byte) {
+	explicit := config.HAEntities[e.Name]
+	component := e.Type
+	if explicit.Component != "" {
+		component = explicit.Component
+	}
+	if component == "none" {
+		return "", nil
+	}
+
+	stateTopic := fmt.Sprintf("%s/%s", config.MQTTPrefix2, e.Name)
+	commandTopic := fmt.Sprintf("%s/%s/set", config.MQTTPrefix2, e.Name)
+	has := func(key string) bool {
+		for _, m := range e.Members {
+			if entityRoles[e.Type][m.Role].Key == key {
+				return true
+			}
+		}
+		return false
+	}
+	p := haPayload(e.Name)
+	switch e.Type {
+	case "light":
+		p["schema"] = "json"
+		p["state_topic"] = stateTopic
+		p["command_topic"] = commandTopic
+		p["supported_color_modes"] = []string{"onoff"}
+		if has("brightness") {
+			p["brightness"] = true
+			p["brightness_scale"] = 100
+			p["supported_color_modes"] = []string{"brightness"}
+		}
+	case "switch":
+		p["state_topic"] = stateTopic
+		p["value_template"] = "{{ value_json.state }}"
+		p["command_topic"] = commandTopic
+		p["payload_on"] = "ON"
+		p["payload_off"] = "OFF"
+	case "cover":
+		p["command_topic"] = commandTopic
+		if e.Member("stop") == nil {
+			p["payload_stop"] = nil
+		}
+		if has("position") {
+			// positions are in KNX: 0% is open, 100% closed
+			p["position_topic"] = stateTopic
+			p["position_template"] = "{{ value_json.position }}"
+			p["set_position_topic"] = commandTopic
+			p["set_position_template"] = `{"position": {{ position }}}`
+			p["position_open"] = 0
+			p["position_closed"] = 100
+		}
+	case "climate":
+		if has("current_temperature") {
+			p["current_temperature_topic"] = stateTopic
+			p["current_temperature_template"] = "{{ value_json.current_temperature }}"
+		}
+		if has("temperature") {
+			p["temperature_state_topic"] = stateTopic
+			p["temperature_state_template"] = "{{ value_json.temperature }}"
+			p["temperature_command_topic"] = commandTopic
+			p["temperature_command_template"] = `{"temperature": {{ value }}}`
+		}
+		p["modes"] = []string{"heat"}
+		if has("mode") {
+			p["modes"] = []string{"heat", "cool"}
+			p["mode_state_topic"] = stateTopic
+			p["mode_state_template"] = "{{ value_json.mode }}"
+			p["mode_command_topic"] = commandTopic
+			p["mode_command_template"] = `{"mode": "{{ value }}"}`
+		}
+	}
+	return haTopic(component, e.Name), haMarshal(p, explicit.Options)
+}
+
+// haPayload returns the fields of the discovery payload common to all the entities.
+func haPayload(name string) map[string]interface{} {
+	node := haID(config.MQTTPrefix2)
+	return map[string]interface{}{
+		"name":      name,
+		"unique_id": node + "_" + haID(name),
+		"availability": []map[string]string{
+			{"topic": fmt.Sprintf("%s/status", config.MQTTPrefix1)},
+			{"topic": fmt.Sprintf("%s/status", config.MQTTPrefix2)},
+		},
+		"availability_mode": "all",
+		"device": map[string]interface{}{
+			"identifiers": []string{node},
+			"name":        "KNX " + config.MQTTPrefix2,
+			"model":       "knx2mqtt-pretty",
+		},
+	}
+}
+
+func haTopic(component string, name string) string {
+	return fmt.Sprintf("%s/%s/%s/%s/config", config.HomeAssistant, component, haID(config.MQTTPrefix2), haID(name))
+}
+
+// haMarshal adds the options of an explicit declaration to p and encodes it.
+func haMarshal(p map[string]interface{}, options map[string]string) []byte {
+	for k, v := range options {
+		var value interface{} = v
+		if json.Valid([]byte(v)) {
+			json.Unmarshal([]byte(v), &value)
+		}
+		p[k] = value
+	}
+	b, _ := json.Marshal(p)
+	return b
+}
+
+// publishDiscovery publishes the Home Assistant discovery messages for all
+// the group addresses in the config file (for their first name and for the
+// aliases with an explicit declaration) and for all the entities.
+func publishDiscovery(client *mqttclient.Client) {
+	var addrs []cemi.GroupAddr
+	for addr := range config.Addresses {
+		addrs = append(addrs, addr)
+	}
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i] < addrs[j] })
+
+	n := 0
+	for _, addr := range addrs {
+		nt := config.Addresses[addr]
+		for i, name := range nt.Names {
+			if _, explicit := config.HAEntities[name]; i > 0 && !explicit {
+				continue
+			}
+			topic, payload := haDiscovery(name, nt)
+			if topic == "" {
+				continue
+			}
+			if err := client.PublishRetain(topic, string(payload)); err != nil {
+				logMQTT.Error("could not publish", "topic", topic, "error", err)
+				continue
+			}
+			n++
+		}
+	}
+	var names []string
+	for name := range config.Entities {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		topic, payload := haEntityDiscovery(config.Entities[name])
+		if topic == "" {
+			continue
+		}
+		if err := client.PublishRetain(topic, string(payload)); err != nil {
+			logMQTT.Error("could not publish", "topic", topic, "error", err)
+			continue
+		}
+		n++
+	}
+	logMQTT.Info("published Home Assistant discovery", "entities", n)
+}
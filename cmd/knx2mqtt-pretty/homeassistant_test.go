@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+const haTestConfig = `
+mqtt-prefix1 knx
+mqtt-prefix2 rooms
+homeassistant
+address 1/1/1 1.001 kitchen/light writable=true
+address 1/1/2 1.001 kitchen/light-status
+address 1/1/3 9.001 kitchen/temperature
+address 1/1/4 5.001 kitchen/dimmer writable=true
+address 1/1/5 5.001 kitchen/valve
+address 1/1/6 3.007 kitchen/dim
+entity light kitchen/lamp
+	switch 2/1/1
+	brightness 2/1/3
+end
+entity cover kitchen/blind
+	up-down 2/2/1
+	position 2/2/3
+end
+entity climate kitchen/climate
+	temperature 2/3/1
+	setpoint 2/3/2
+end
+homeassistant-entity kitchen/valve sensor icon=mdi:valve
+`
+
+// haCommon are the fields of all the discovery payloads in haTestConfig.
+const haCommon = `"availability":[{"topic":"knx/status"},{"topic":"rooms/status"}],"availability_mode":"all",
+	"device":{"identifiers":["rooms"],"model":"knx2mqtt-pretty","name":"KNX rooms"}`
+
+// checkDiscovery compares a discovery message with the expected one.
+func checkDiscovery(t *testing.T, name, topic string, payload []byte, wantTopic, wantPayload string) {
+	t.Helper()
+	if topic != wantTopic {
+		t.Errorf("%s: topic %s, want %s", name, topic, wantTopic)
+	}
+	var got, want interface{}
+	if err := json.Unmarshal([]byte(wantPayload), &want); err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	if err := json.Unmarshal(payload, &got); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("%s: payload\n%s\nwant\n%s", name, payload, wantPayload)
+	}
+}
+
+func TestHADiscovery(t *testing.T) {
+	c := useConfig(t, haTestConfig)
+	tests := []struct {
+		name    string
+		topic   string
+		payload string
+	}{
+		{
+			"kitchen/light", "homeassistant/switch/rooms/kitchen_light/config",
+			`{` + haCommon + `,"command_topic":"rooms/kitchen/light/set","name":"kitchen/light",
+				"payload_off":"false","payload_on":"true","state_off":"OFF","state_on":"ON",
+				"state_topic":"rooms/kitchen/light","unique_id":"rooms_kitchen_light",
+				"value_template":"{{ 'ON' if value.split(' ', 1)[1] == 'On' else 'OFF' }}"}`,
+		},
+		{
+			// not writable: only a sensor
+			"kitchen/light-status", "homeassistant/binary_sensor/rooms/kitchen_light-status/config",
+			`{` + haCommon + `,"name":"kitchen/light-status","state_topic":"rooms/kitchen/light-status",
+				"unique_id":"rooms_kitchen_light-status",
+				"value_template":"{{ 'ON' if value.split(' ', 1)[1] == 'On' else 'OFF' }}"}`,
+		},
+		{
+			"kitchen/temperature", "homeassistant/sensor/rooms/kitchen_temperature/config",
+			`{` + haCommon + `,"device_class":"temperature","name":"kitchen/temperature",
+				"state_class":"measurement","state_topic":"rooms/kitchen/temperature",
+				"unique_id":"rooms_kitchen_temperature","unit_of_measurement":"°C",
+				"value_template":"{{ value.split(' ')[1] | regex_findall_index('^-?[0-9.]+') }}"}`,
+		},
+		{
+			"kitchen/dimmer", "homeassistant/number/rooms/kitchen_dimmer/config",
+			`{` + haCommon + `,"command_topic":"rooms/kitchen/dimmer/set","max":100,"min":0,
+				"name":"kitchen/dimmer","state_topic":"rooms/kitchen/dimmer","unique_id":"rooms_kitchen_dimmer",
+				"unit_of_measurement":"%",
+				"value_template":"{{ value.split(' ')[1] | regex_findall_index('^-?[0-9.]+') }}"}`,
+		},
+		{
+			// explicit declaration, with options
+			"kitchen/valve", "homeassistant/sensor/rooms/kitchen_valve/config",
+			`{` + haCommon + `,"icon":"mdi:valve","name":"kitchen/valve","state_class":"measurement",
+				"state_topic":"rooms/kitchen/valve","unique_id":"rooms_kitchen_valve","unit_of_measurement":"%",
+				"value_template":"{{ value.split(' ')[1] | regex_findall_index('^-?[0-9.]+') }}"}`,
+		},
+		{"kitchen/dim", "", ""},
+	}
+	for _, test := range tests {
+		topic, payload := haDiscovery(test.name, c.Addresses[c.Names[test.name]])
+		if test.topic == "" {
+			if topic != "" {
+				t.Errorf("%s: published in %s", test.name, topic)
+			}
+			continue
+		}
+		checkDiscovery(t, test.name, topic, payload, test.topic, test.payload)
+	}
+}
+
+func TestHAEntityDiscovery(t *testing.T) {
+	c := useConfig(t, haTestConfig)
+	tests := []struct {
+		name    string
+		topic   string
+		payload string
+	}{
+		{
+			"kitchen/lamp", "homeassistant/light/rooms/kitchen_lamp/config",
+			`{` + haCommon + `,"brightness":true,"brightness_scale":100,"command_topic":"rooms/kitchen/lamp/set",
+				"name":"kitchen/lamp","schema":"json","state_topic":"rooms/kitchen/lamp",
+				"supported_color_modes":["brightness"],"unique_id":"rooms_kitchen_lamp"}`,
+		},
+		{
+			"kitchen/blind", "homeassistant/cover/rooms/kitchen_blind/config",
+			`{` + haCommon + `,"command_topic":"rooms/kitchen/blind/set","name":"kitchen/blind",
+				"payload_stop":null,"position_closed":100,"position_open":0,
+				"position_template":"{{ value_json.position }}","position_topic":"rooms/kitchen/blind",
+				"set_position_template":"{\"position\": {{ position }}}","set_position_topic":"rooms/kitchen/blind/set",
+				"unique_id":"rooms_kitchen_blind"}`,
+		},
+		{
+			"kitchen/climate", "homeassistant/climate/rooms/kitchen_climate/config",
+			`{` + haCommon + `,"current_temperature_template":"{{ value_json.current_temperature }}",
+				"current_temperature_topic":"rooms/kitchen/climate","modes":["heat"],"name":"kitchen/climate",
+				"temperature_command_template":"{\"temperature\": {{ value }}}",
+				"temperature_command_topic":"rooms/kitchen/climate/set",
+				"temperature_state_template":"{{ value_json.temperature }}",
+				"temperature_state_topic":"rooms/kitchen/climate","unique_id":"rooms_kitchen_climate"}`,
+		},
+	}
+	for _, test := range tests {
+		topic, payload := haEntityDiscovery(c.Entities[test.name])
+		checkDiscovery(t, test.name, topic, payload, test.topic, test.payload)
+	}
+}
+
+// The template of a boolean does not change the value of its DPT.
+func TestHAValueTemplate(t *testing.T) {
+	useConfig(t, haTestConfig)
+	dp, _ := ProduceDPT("1.009")
+	tmpl := haValueTemplate(dp, nil)
+	if want := "{{ 'ON' if value.split(' ', 1)[1] == 'Close' else 'OFF' }}"; tmpl != want {
+		t.Errorf("template %s, want %s", tmpl, want)
+	}
+	if v := GetDPTValue(dp); v != false {
+		t.Errorf("value changed to %v", v)
+	}
+}
@@ -4,27 +4,42 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
-	"log"
 	"os"
 	"strings"
 	"time"
 
+	"github.com/cespedes/knx2mqtt/internal/logging"
+	"github.com/cespedes/knx2mqtt/internal/mqttclient"
 	"github.com/vapourismo/knx-go/knx"
 	"github.com/vapourismo/knx-go/knx/cemi"
-	"github.com/vapourismo/knx-go/knx/dpt"
 )
 
 const (
 	MQTTPort = 1883
+
+	// CommandExpiry is the MQTT v5 message expiry of the commands sent to knx2mqtt,
+	// so that they are not sent to KNX much later if knx2mqtt is not running.
+	CommandExpiry = 10 * time.Second
 )
 
 var config *Config
 
-type Server struct {
-	Debug bool
+var (
+	logMQTT    = logging.Get("mqtt")
+	logConfig  = logging.Get("config")
+	logDPT     = logging.Get("dpt")
+	logPackets = logging.Get("packets")
+)
 
+type Server struct {
 	logFile     *os.File
 	logFileName string
+
+	readoutState readoutState
+	entityState  map[string]map[string]interface{} // state of each entity
+	published    map[cemi.GroupAddr]*publishState  // last values published, for addresses with a PublishFilter
+	flush        chan cemi.GroupAddr               // addresses with a value to publish after their MinInterval
+	refresh      chan cemi.GroupAddr               // addresses with nothing published in their MaxInterval
 }
 
 type Event struct {
@@ -86,6 +101,26 @@ func (e Event) MarshalJSON() ([]byte, error) {
 	return json.Marshal(tmp)
 }
 
+// jsonValue returns the JSON payload published for a value.
+func jsonValue(e Event, DPT string, value interface{}, unit string) string {
+	var tmp struct {
+		Value  interface{} `json:"value"`
+		Unit   string      `json:"unit,omitempty"`
+		DPT    string      `json:"dpt"`
+		Time   time.Time   `json:"time"`
+		Source string      `json:"source"`
+		GA     string      `json:"ga"`
+	}
+	tmp.Value = value
+	tmp.Unit = unit
+	tmp.DPT = DPT
+	tmp.Time = e.Time
+	tmp.Source = e.Source.String()
+	tmp.GA = e.Destination.String()
+	b, _ := json.Marshal(tmp)
+	return string(b)
+}
+
 func (e Event) String() string {
 	str := fmt.Sprintf("%s <%s> %s: %s %s=%v",
 		e.Time.Format("2006-01-02 15:04:05"),
@@ -99,13 +134,13 @@ func (e Event) String() string {
 		str += " " + devStr
 	}
 	if nt, ok := config.Addresses[e.Destination]; ok {
-		dp, ok := dpt.Produce(nt.DPT)
+		dp, ok := ProduceDPT(nt.DPT)
 		if !ok {
-			fmt.Printf("Warning: unknown type %v in config file\n", nt.DPT)
+			logDPT.Warn("unknown type in config file", "dpt", nt.DPT, "ga", e.Destination.String())
 			dp = new(UnknownDPT)
 		}
 		if err := dp.Unpack(e.Data); err != nil {
-			fmt.Printf("Network: Error parsing %v for %v (%s): %s\n", e.Data, e.Destination, nt.DPT, err.Error())
+			logDPT.Warn("error parsing data", "data", fmt.Sprint(e.Data), "ga", e.Destination.String(), "dpt", nt.DPT, "error", err)
 		} else {
 			str += " " + nt.Names[0] + "=" + fmt.Sprint(dp)
 		}
@@ -117,34 +152,93 @@ func (e Event) String() string {
 
 func main() {
 	var s Server
-	flag.BoolVar(&s.Debug, "debug", false, "debugging info")
+	logOpts := logging.AddFlags(flag.CommandLine)
 	configFile := flag.String("config", "knx.cfg", "config file")
+	check := flag.Bool("check", false, "check the config file and exit")
 	flag.Parse()
 
+	if err := logging.Setup(logOpts, "knx2mqtt-pretty"); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
 	var err error
 	config, err = ReadConfig(*configFile)
+	if *check {
+		os.Exit(checkConfig(os.Stdout, os.Stderr, config, err))
+	}
 	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+		logging.Fatal(logConfig, "could not read config", "error", err)
 	}
 	if config.MQTTServer == "" {
-		log.Fatal("No MQTT server specified")
+		logging.Fatal(logConfig, "no MQTT server specified")
 	}
-	if s.Debug {
-		fmt.Printf("devices: %v\n", config.Devices)
-		fmt.Printf("addresses: %v\n", config.Addresses)
-		fmt.Printf("names: %v\n", config.Names)
+	for _, p := range config.Problems {
+		logConfig.Warn("problem in config file", "file", p.File, "line", p.Line, "problem", p.Msg)
 	}
+	logConfig.Debug("configuration read", "devices", len(config.Devices), "addresses", len(config.Addresses), "names", len(config.Names))
 
-	client, err := NewMQTTClient(config.MQTTServer, MQTTPort)
+	statusTopic := fmt.Sprintf("%s/status", config.MQTTPrefix2)
+	client, err := mqttclient.New(config.MQTTServer, MQTTPort, mqttclient.Options{
+		Version: config.MQTTVersion,
+		Will: &mqttclient.Message{
+			Topic:   statusTopic,
+			Retain:  true,
+			Payload: []byte("offline"),
+		},
+	})
 	if err != nil {
-		log.Fatal(err)
+		logging.Fatal(logMQTT, "could not connect", "server", config.MQTTServer, "error", err)
 	}
+	online := func() {
+		if err := client.PublishRetain(statusTopic, "online"); err != nil {
+			logMQTT.Error("could not publish", "topic", statusTopic, "error", err)
+		}
+	}
+	online()
+	client.OnReconnect(online)
 
-	mqttChan1, err := client.Subscribe(fmt.Sprintf("%s/+/+/+", config.MQTTPrefix1))
-	mqttChan2, err := client.Subscribe(fmt.Sprintf("%s/cmd", config.MQTTPrefix2))
+	subscribe := func(topics ...string) chan *mqttclient.Message {
+		ch, err := client.Subscribe(topics...)
+		if err != nil {
+			logging.Fatal(logMQTT, "could not subscribe", "topics", topics, "error", err)
+		}
+		return ch
+	}
+	mqttChan1 := subscribe(fmt.Sprintf("%s/+/+/+", config.MQTTPrefix1))
+	mqttChan2 := subscribe(fmt.Sprintf("%s/cmd", config.MQTTPrefix2))
+	statusChan := subscribe(fmt.Sprintf("%s/status", config.MQTTPrefix1))
+	var names []string
+	for name := range config.Names {
+		names = append(names, name)
+	}
+	for name := range config.Entities {
+		names = append(names, name)
+	}
+	cmdChan := subscribe(commandTopics(config.MQTTPrefix2, names)...)
+	var haChan chan *mqttclient.Message
+	if config.HomeAssistant != "" {
+		haChan = subscribe(fmt.Sprintf("%s/status", config.HomeAssistant))
+		publishDiscovery(client)
+	}
+	s.flush = make(chan cemi.GroupAddr)
+	s.refresh = make(chan cemi.GroupAddr)
 	for {
 		select {
+		case addr := <-s.flush:
+			s.flushValue(client, addr)
+		case addr := <-s.refresh:
+			s.refreshValue(client, addr)
+		case msg := <-haChan:
+			// Home Assistant has (re)started: publish the discovery messages again
+			if string(msg.Payload) == "online" {
+				publishDiscovery(client)
+			}
+		case msg := <-statusChan:
+			// knx2mqtt is (again) online: read all the addresses if configured to do so
+			if string(msg.Payload) == "online" && config.ReadoutRate > 0 {
+				go s.readout(client)
+			}
 		case msg := <-mqttChan1:
 			var e Event
 			_ = json.Unmarshal(msg.Payload, &e)
@@ -156,28 +250,12 @@ func main() {
 			if e.Command != knx.GroupWrite && e.Command != knx.GroupResponse {
 				break
 			}
-			if nt, ok := config.Addresses[e.Destination]; ok {
-				dp, ok := dpt.Produce(nt.DPT)
-				if !ok {
-					fmt.Printf("Warning: unknown type %v in config file\n", nt.DPT)
-					continue
-				}
-				if err := dp.Unpack(e.Data); err != nil {
-					fmt.Printf("Network: Error parsing %v for %v (%s): %s\n", e.Data, e.Destination, nt.DPT, err.Error())
-					continue
-				}
-				value := e.Time.Format("20060102-150405") + " " + fmt.Sprint(dp)
-				for _, name := range nt.Names {
-					topic := fmt.Sprintf("%s/%s", config.MQTTPrefix2, name)
-					err = client.PublishRetain(topic, value)
-					if err != nil {
-						fmt.Printf("MQTT: Error publishing to %s: %v\n", topic, err.Error())
-						continue
-					}
-				}
-			}
+			s.readoutState.Answered(e.Destination)
+			s.updateEntities(client, e)
+			s.publishValue(client, e, false)
 		case msg := <-mqttChan2:
-			cmd := strings.Split(string(msg.Payload), " ")
+			// the value can contain spaces (eg, in DPT 16.000 strings)
+			cmd := strings.SplitN(string(msg.Payload), " ", 3)
 			var command knx.GroupCommand
 			switch {
 			case len(cmd) < 2,
@@ -185,7 +263,7 @@ func main() {
 				cmd[0] == "write" && len(cmd) != 3,
 				cmd[0] == "read" && len(cmd) != 2,
 				cmd[0] == "response" && len(cmd) != 3:
-				fmt.Printf("received wrong MQTT command: %q\n", string(msg.Payload))
+				logMQTT.Warn("wrong command", "payload", string(msg.Payload))
 				continue
 			case cmd[0] == "read":
 				command = knx.GroupRead
@@ -194,41 +272,11 @@ func main() {
 			case cmd[0] == "write":
 				command = knx.GroupWrite
 			}
-			groupName := cmd[1]
-			var groupAddr cemi.GroupAddr
-			var DPT string
-
-			groupAddr, ok := config.Names[groupName]
-			if !ok {
-				fmt.Printf("received command to wrong group: %q\n", string(msg.Payload))
-				continue
-			}
-			val := config.Addresses[groupAddr]
-			DPT = val.DPT
-
-			dp, ok := dpt.Produce(DPT)
-			if !ok {
-				fmt.Printf("Error: unknown type %v in config file\n", DPT)
-				continue
-			}
-			if command == knx.GroupResponse || command == knx.GroupWrite {
-				value := cmd[2]
-				err := SetDPTFromString(dp, value)
-				if err != nil {
-					fmt.Printf("received wrong value in MQTT command: %q\n", string(msg.Payload))
-					continue
-				}
-			}
-			data := dp.Pack()
-			if command == knx.GroupRead {
-				data = []byte{0}
+			if err := sendCommand(client, command, cmd[1], strings.Join(cmd[2:], " ")); err != nil {
+				logMQTT.Warn("wrong command", "payload", string(msg.Payload), "error", err)
 			}
-			fmt.Printf("MQTT: received cmd %q: will send packet to %s\n", msg.Payload, groupAddr.String())
-			topic := fmt.Sprintf("%s/cmd", config.MQTTPrefix1)
-			groupEvent := knx.GroupEvent{Command: command, Destination: groupAddr, Data: data}
-			event := Event{Time: time.Now(), GroupEvent: groupEvent}
-			b, _ := event.MarshalJSON()
-			client.Publish(topic, string(b))
+		case msg := <-cmdChan:
+			handleNameCommand(client, msg.Topic, msg.Payload)
 		}
 	}
 }
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cespedes/knx2mqtt/internal/mqttclient"
+	"github.com/vapourismo/knx-go/knx/cemi"
+)
+
+// PublishFilter decides which values of a group address are published, so
+// that sensors sending their values cyclically do not flood MQTT.  It is set
+// with options in the address line of the config file:
+//
+//	address 2/5/7 9.001 myroom/temperature deadband=0.2 min-interval=1m max-interval=15m
+//	address 3/1/1 14.056 power deadband=5% min-interval=10s
+type PublishFilter struct {
+	OnChange    bool          // only publish values different from the last one
+	Deadband    float64       // only publish numbers which differ more than this from the last one
+	Relative    bool          // Deadband is a fraction of the last value
+	MinInterval time.Duration // minimum time between publications; the last value is published at its end
+	MaxInterval time.Duration // publish the last value again after this time without publishing (implies OnChange)
+}
+
+// publishFilterOptions are the options of an address line used by PublishFilter.
+var publishFilterOptions = map[string]bool{
+	"on-change":    true,
+	"deadband":     true,
+	"min-interval": true,
+	"max-interval": true,
+}
+
+// ParsePublishFilter parses the options of an address line ("key=value") which
+// are used by PublishFilter, and returns the other ones.
+// It returns a nil filter if there are no such options.
+func ParsePublishFilter(options []string) (*PublishFilter, []string, error) {
+	var f *PublishFilter
+	var rest []string
+	for _, opt := range options {
+		i := strings.IndexByte(opt, '=')
+		key, value := opt[:i], opt[i+1:]
+		if !publishFilterOptions[key] {
+			rest = append(rest, opt)
+			continue
+		}
+		if f == nil {
+			f = &PublishFilter{}
+		}
+		var err error
+		switch key {
+		case "on-change":
+			f.OnChange, err = strconv.ParseBool(value)
+		case "deadband":
+			if strings.HasSuffix(value, "%") {
+				f.Relative = true
+				value = strings.TrimSuffix(value, "%")
+			}
+			f.Deadband, err = strconv.ParseFloat(value, 64)
+			if err == nil && f.Deadband < 0 {
+				err = fmt.Errorf("deadband cannot be negative")
+			}
+			if f.Relative {
+				f.Deadband /= 100
+			}
+		case "min-interval":
+			f.MinInterval, err = time.ParseDuration(value)
+		case "max-interval":
+			f.MaxInterval, err = time.ParseDuration(value)
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid option %s: %w", opt, err)
+		}
+	}
+	return f, rest, nil
+}
+
+// publishState is the last value published for a group address with a PublishFilter.
+type publishState struct {
+	Value   interface{}
+	Time    time.Time
+	Pending *Event      // value received before MinInterval, to be published at its end
+	Last    *Event      // last value published, to be published again after MaxInterval
+	Refresh *time.Timer // fires after MaxInterval without publishing
+}
+
+// changed returns whether v is different enough from the last value published.
+func (f *PublishFilter) changed(last, v interface{}) bool {
+	a, ok1 := last.(float64)
+	b, ok2 := v.(float64)
+	if !ok1 || !ok2 {
+		return last != v
+	}
+	if f.Deadband == 0 {
+		return a != b
+	}
+	threshold := f.Deadband
+	if f.Relative {
+		threshold *= math.Abs(a)
+	}
+	return math.Abs(b-a) > threshold
+}
+
+// filter returns whether the value v of the event e must be published now.
+// If it has to wait for MinInterval, it is kept and published later by flushValue
+// (with flushing set, so it does not have to wait again).
+// With MaxInterval, the value published is published again by refreshValue
+// if no other one is published in that time.
+func (s *Server) filter(e Event, f *PublishFilter, v interface{}, flushing bool) bool {
+	if f == nil {
+		return true
+	}
+	if s.published == nil {
+		s.published = make(map[cemi.GroupAddr]*publishState)
+	}
+	st := s.published[e.Destination]
+	now := time.Now()
+	if st == nil {
+		st = &publishState{Value: v, Time: now}
+		s.published[e.Destination] = st
+		s.scheduleRefresh(st, e, f)
+		return true
+	}
+	if (f.OnChange || f.Deadband > 0 || f.MaxInterval > 0) && !f.changed(st.Value, v) {
+		if f.MaxInterval <= 0 || now.Sub(st.Time) < f.MaxInterval {
+			logMQTT.Debug("value not published (not changed)", "ga", e.Destination.String())
+			// it is back to the last value published
+			st.Pending = nil
+			return false
+		}
+	}
+	if f.MinInterval > 0 && now.Sub(st.Time) < f.MinInterval && !flushing {
+		if st.Pending == nil {
+			addr := e.Destination
+			time.AfterFunc(f.MinInterval-now.Sub(st.Time), func() {
+				s.flush <- addr
+			})
+		}
+		st.Pending = &e
+		return false
+	}
+	st.Value, st.Time, st.Pending = v, now, nil
+	s.scheduleRefresh(st, e, f)
+	return true
+}
+
+// scheduleRefresh keeps the event e, which is being published, and starts
+// again the timer to publish it after MaxInterval.
+func (s *Server) scheduleRefresh(st *publishState, e Event, f *PublishFilter) {
+	if f.MaxInterval <= 0 {
+		return
+	}
+	st.Last = &e
+	if st.Refresh != nil {
+		st.Refresh.Stop()
+	}
+	addr := e.Destination
+	st.Refresh = time.AfterFunc(f.MaxInterval, func() {
+		s.refresh <- addr
+	})
+}
+
+// publishValue publishes the value of the event e in the topics of all the
+// names of its group address, if it passes its PublishFilter.
+func (s *Server) publishValue(client *mqttclient.Client, e Event, flushing bool) {
+	nt, ok := config.Addresses[e.Destination]
+	if !ok {
+		return
+	}
+	dp, ok := ProduceDPT(nt.DPT)
+	if !ok {
+		logDPT.Warn("unknown type in config file", "dpt", nt.DPT, "ga", e.Destination.String())
+		return
+	}
+	if err := dp.Unpack(e.Data); err != nil {
+		logDPT.Warn("error parsing data", "data", fmt.Sprint(e.Data), "ga", e.Destination.String(), "dpt", nt.DPT, "error", err)
+		return
+	}
+	v, text := nt.Transform.Value(dp)
+	if !s.filter(e, nt.Filter, v, flushing) {
+		return
+	}
+	unit := nt.Transform.Unit(dp)
+	msg := mqttclient.Message{
+		Payload:     []byte(e.Time.Format("20060102-150405") + " " + text),
+		Retain:      true,
+		ContentType: "text/plain",
+		UserProperties: []mqttclient.UserProperty{
+			{Key: "dpt", Value: nt.DPT},
+			{Key: "ga", Value: e.Destination.String()},
+			{Key: "source", Value: e.Source.String()},
+		},
+	}
+	if unit != "" {
+		msg.UserProperties = append(msg.UserProperties, mqttclient.UserProperty{Key: "unit", Value: unit})
+	}
+	if config.Payload == "json" {
+		msg.Payload, msg.ContentType = []byte(jsonValue(e, nt.DPT, v, unit)), "application/json"
+	}
+	for _, name := range nt.Names {
+		topic := fmt.Sprintf("%s/%s", config.MQTTPrefix2, name)
+		msg.Topic = topic
+		if err := client.PublishMessage(&msg); err != nil {
+			logMQTT.Error("could not publish", "topic", topic, "error", err)
+		}
+	}
+}
+
+// flushValue publishes the value of a group address kept until the end of its MinInterval.
+func (s *Server) flushValue(client *mqttclient.Client, addr cemi.GroupAddr) {
+	st := s.published[addr]
+	if st == nil || st.Pending == nil {
+		return
+	}
+	e := *st.Pending
+	st.Pending = nil
+	s.publishValue(client, e, true)
+}
+
+// refreshValue publishes again the last value of a group address
+// when nothing has been published in its MaxInterval.
+func (s *Server) refreshValue(client *mqttclient.Client, addr cemi.GroupAddr) {
+	st := s.published[addr]
+	if st == nil || st.Last == nil || st.Pending != nil {
+		// a pending value is going to be published by flushValue
+		return
+	}
+	s.publishValue(client, *st.Last, true)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/vapourismo/knx-go/knx"
+	"github.com/vapourismo/knx-go/knx/cemi"
+)
+
+func TestFilterMaxInterval(t *testing.T) {
+	s := &Server{refresh: make(chan cemi.GroupAddr, 1)}
+	f := &PublishFilter{OnChange: true, MaxInterval: 100 * time.Millisecond}
+	addr := cemi.NewGroupAddr3(2, 5, 7)
+	e := Event{GroupEvent: knx.GroupEvent{Command: knx.GroupWrite, Destination: addr, Data: []byte{0, 0x0c, 0x1a}}}
+
+	start := time.Now()
+	if !s.filter(e, f, 21.0, false) {
+		t.Fatal("first value not published")
+	}
+	if s.filter(e, f, 21.0, false) {
+		t.Error("value not changed published")
+	}
+	// without receiving anything, it has to be published again after MaxInterval
+	select {
+	case a := <-s.refresh:
+		if a != addr {
+			t.Errorf("refresh of %s", a)
+		}
+		if d := time.Since(start); d < f.MaxInterval {
+			t.Errorf("refresh after %v", d)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no refresh")
+	}
+	st := s.published[addr]
+	if st.Last == nil || st.Last.Destination != addr {
+		t.Fatalf("last event published: %+v", st.Last)
+	}
+	if !s.filter(*st.Last, f, 21.0, true) {
+		t.Error("value not published again after MaxInterval")
+	}
+
+	// publishing a new value starts the interval again
+	time.Sleep(f.MaxInterval / 2)
+	start = time.Now()
+	if !s.filter(e, f, 22.0, false) {
+		t.Error("changed value not published")
+	}
+	select {
+	case <-s.refresh:
+		if d := time.Since(start); d < f.MaxInterval {
+			t.Errorf("refresh after %v", d)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no refresh")
+	}
+	st.Refresh.Stop()
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cespedes/knx2mqtt/internal/mqttclient"
+	"github.com/vapourismo/knx-go/knx"
+	"github.com/vapourismo/knx-go/knx/cemi"
+)
+
+// ReadoutTimeout is the time to wait for the last answers after sending all the reads.
+const ReadoutTimeout = 5 * time.Second
+
+// readoutState keeps the addresses which have not answered yet to a read-out.
+type readoutState struct {
+	mu      sync.Mutex
+	running bool
+	pending map[cemi.GroupAddr]bool
+}
+
+// Answered marks an address as having answered.
+func (r *readoutState) Answered(addr cemi.GroupAddr) {
+	r.mu.Lock()
+	delete(r.pending, addr)
+	r.mu.Unlock()
+}
+
+// readout sends a read command for every address in the config file,
+// at config.ReadoutRate reads per second, and reports the ones without answer.
+func (s *Server) readout(client *mqttclient.Client) {
+	s.readoutState.mu.Lock()
+	if s.readoutState.running {
+		s.readoutState.mu.Unlock()
+		return
+	}
+	s.readoutState.running = true
+	s.readoutState.pending = make(map[cemi.GroupAddr]bool)
+	for addr := range config.Addresses {
+		s.readoutState.pending[addr] = true
+	}
+	// and the addresses which report the state of entities
+	for addr, refs := range config.EntityAddrs {
+		for _, ref := range refs {
+			if ref.Entity.Reports(ref.Member.Role) {
+				s.readoutState.pending[addr] = true
+			}
+		}
+	}
+	var addrs []cemi.GroupAddr
+	for addr := range s.readoutState.pending {
+		addrs = append(addrs, addr)
+	}
+	s.readoutState.mu.Unlock()
+
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i] < addrs[j] })
+
+	logMQTT.Info("starting read-out", "addresses", len(addrs))
+	tick := time.NewTicker(time.Duration(float64(time.Second) / config.ReadoutRate))
+	for _, addr := range addrs {
+		<-tick.C
+		if err := sendGroupEvent(client, knx.GroupRead, addr, []byte{0}); err != nil {
+			logMQTT.Error("could not publish", "topic", config.MQTTPrefix1+"/cmd", "error", err)
+		}
+	}
+	tick.Stop()
+	time.Sleep(ReadoutTimeout)
+
+	s.readoutState.mu.Lock()
+	var missing []string
+	for _, addr := range addrs {
+		if s.readoutState.pending[addr] {
+			missing = append(missing, addrName(addr))
+		}
+	}
+	s.readoutState.pending = nil
+	s.readoutState.running = false
+	s.readoutState.mu.Unlock()
+
+	logMQTT.Info("read-out finished", "addresses", len(addrs), "answered", len(addrs)-len(missing))
+	if len(missing) > 0 {
+		logMQTT.Warn("addresses not answering to read-out", "missing", strings.Join(missing, " "))
+	}
+}
+
+// addrName returns the name of a group address, or the name of the entity
+// and the role if it is part of an entity.
+func addrName(addr cemi.GroupAddr) string {
+	if nt, ok := config.Addresses[addr]; ok {
+		return nt.Names[0]
+	}
+	if refs := config.EntityAddrs[addr]; len(refs) > 0 {
+		return refs[0].Entity.Name + ":" + refs[0].Member.Role
+	}
+	return addr.String()
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/vapourismo/knx-go/knx/dpt"
+)
+
+// Transform is a conversion between the values of a group address and the
+// values published in MQTT and received in its commands.  It is set with
+// options in the address line of the config file:
+//
+//	address 1/2/3 1.001 myroom/window invert=true
+//	address 1/2/4 20.102 myroom/hvac labels=0:auto,1:comfort,2:standby,3:economy
+//	address 1/2/5 13.010 myroom/energy scale=0.001 round=2 unit=kWh
+type Transform struct {
+	Invert  bool               // invert booleans
+	Labels  map[float64]string // labels of numbers (booleans are 0 and 1)
+	Scale   float64            // published = value*Scale + Offset
+	Offset  float64
+	Round   int    // number of decimals (-1: no rounding)
+	UnitStr string // unit of the published values
+	HasUnit bool   // UnitStr replaces the unit of the DPT
+}
+
+// ParseTransform parses the options of an address line ("key=value").
+// It returns nil if there are no options.
+func ParseTransform(options []string) (*Transform, error) {
+	if len(options) == 0 {
+		return nil, nil
+	}
+	t := &Transform{Scale: 1, Round: -1}
+	for _, opt := range options {
+		i := strings.IndexByte(opt, '=')
+		key, value := opt[:i], opt[i+1:]
+		var err error
+		switch key {
+		case "invert":
+			t.Invert, err = strconv.ParseBool(value)
+		case "labels":
+			t.Labels = make(map[float64]string)
+			for _, l := range strings.Split(value, ",") {
+				j := strings.IndexByte(l, ':')
+				if j <= 0 || j == len(l)-1 {
+					return nil, fmt.Errorf("invalid label %q (must be number:label)", l)
+				}
+				n, err := strconv.ParseFloat(l[:j], 64)
+				if err != nil {
+					return nil, fmt.Errorf("invalid label %q: %w", l, err)
+				}
+				t.Labels[n] = l[j+1:]
+			}
+		case "scale":
+			t.Scale, err = strconv.ParseFloat(value, 64)
+			if err == nil && t.Scale == 0 {
+				err = fmt.Errorf("scale cannot be 0")
+			}
+		case "offset":
+			t.Offset, err = strconv.ParseFloat(value, 64)
+		case "round":
+			t.Round, err = strconv.Atoi(value)
+			if err == nil && t.Round < 0 {
+				err = fmt.Errorf("round must be the number of decimals")
+			}
+		case "unit":
+			t.UnitStr, t.HasUnit = value, true
+		default:
+			return nil, fmt.Errorf("unknown option %s", key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid option %s: %w", opt, err)
+		}
+	}
+	return t, nil
+}
+
+// Unit returns the unit of the values of dp published.  It works with a nil Transform.
+func (t *Transform) Unit(dp dpt.DatapointValue) string {
+	if t != nil && t.HasUnit {
+		return t.UnitStr
+	}
+	if m, ok := dp.(dpt.DatapointMeta); ok {
+		return m.Unit()
+	}
+	return ""
+}
+
+// round rounds f to the configured number of decimals.
+func (t *Transform) round(f float64) float64 {
+	if t.Round < 0 {
+		return f
+	}
+	p := math.Pow(10, float64(t.Round))
+	return math.Round(f*p) / p
+}
+
+// Value returns the value of dp to publish, as in GetDPTValue, and its
+// text representation, with its unit, as in fmt.Sprint(dp).
+// It works with a nil Transform.
+func (t *Transform) Value(dp dpt.DatapointValue) (interface{}, string) {
+	if t == nil {
+		return GetDPTValue(dp), fmt.Sprint(dp)
+	}
+	if b, ok := GetDPTValue(dp).(bool); ok && t.Invert {
+		dp = copyDPT(dp)
+		SetDPTFromString(dp, strconv.FormatBool(!b))
+	}
+	unit := t.Unit(dp)
+	withUnit := func(s string) string {
+		if unit == "" {
+			return s
+		}
+		return s + " " + unit
+	}
+
+	var f float64
+	switch v := GetDPTValue(dp).(type) {
+	case bool:
+		if t.Labels == nil {
+			return v, fmt.Sprint(dp)
+		}
+		if v {
+			f = 1
+		}
+	case float64:
+		f = t.round(v*t.Scale + t.Offset)
+	default:
+		return v, fmt.Sprint(dp)
+	}
+	if label, ok := t.Labels[f]; ok {
+		return label, label
+	}
+	if t.Round >= 0 {
+		return f, withUnit(strconv.FormatFloat(f, 'f', t.Round, 64))
+	}
+	return f, withUnit(strconv.FormatFloat(f, 'g', -1, 64))
+}
+
+// Set sets the value of dp from a value received in a command, which is
+// converted back to the value of the DPT.  It works with a nil Transform.
+func (t *Transform) Set(dp dpt.DatapointValue, value string) error {
+	if t == nil {
+		return SetDPTFromString(dp, value)
+	}
+	for n, label := range t.Labels {
+		if strings.EqualFold(value, label) {
+			value = strconv.FormatFloat(n, 'g', -1, 64)
+			break
+		}
+	}
+	if _, ok := GetDPTValue(dp).(float64); ok {
+		if f, err := strconv.ParseFloat(value, 64); err == nil {
+			f = (f - t.Offset) / t.Scale
+			if isIntegerDPT(dp) {
+				f = math.Round(f)
+			}
+			value = strconv.FormatFloat(f, 'g', -1, 64)
+		}
+	}
+	if err := SetDPTFromString(dp, value); err != nil {
+		return err
+	}
+	if b, ok := GetDPTValue(dp).(bool); ok && t.Invert {
+		return SetDPTFromString(dp, strconv.FormatBool(!b))
+	}
+	return nil
+}
+
+// isIntegerDPT returns whether the value of dp is an integer number.
+func isIntegerDPT(dp dpt.DatapointValue) bool {
+	Val := reflect.ValueOf(dp)
+	if Val.Kind() != reflect.Ptr {
+		return false
+	}
+	switch Val.Elem().Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTransform(t *testing.T) {
+	tests := []struct {
+		name    string
+		DPT     string
+		options string
+		command string      // value received in a command
+		stored  interface{} // value of the DPT sent
+		value   interface{} // value published
+		text    string
+	}{
+		{"no options", "9.001", "", "21.5", 21.5, 21.5, "21.50 °C"},
+		{"invert", "1.001", "invert=true", "true", false, true, "On"},
+		{"invert off", "1.009", "invert=true", "false", true, false, "Open"},
+		{"labels", "20.102", "labels=0:auto,1:comfort,2:standby,3:economy", "Standby", 2.0, "standby", "standby"},
+		{"label number", "20.102", "labels=0:auto,1:comfort", "1", 1.0, "comfort", "comfort"},
+		{"no label", "20.102", "labels=0:auto,1:comfort", "3", 3.0, 3.0, "3"},
+		{"labels of booleans", "1.001", "invert=true labels=0:closed,1:open", "open", false, "open", "open"},
+		{"scale", "13.010", "scale=0.001 unit=kWh", "12.345", 12345.0, 12.345, "12.345 kWh"},
+		{"integer scale", "7.001", "scale=0.5", "10.4", 21.0, 10.5, "10.5 pulses"},
+		// commands are not rounded, only the published values
+		{"offset and round", "9.001", "offset=-0.5 round=1", "21.04", 21.54, 21.0, "21.0 °C"},
+		{"round", "14.056", "round=2", "1.234", 1.234, 1.23, "1.23 W"},
+	}
+	for _, test := range tests {
+		var options []string
+		if test.options != "" {
+			options = strings.Fields(test.options)
+		}
+		tr, err := ParseTransform(options)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		dp, _ := ProduceDPT(test.DPT)
+		if err := tr.Set(dp, test.command); err != nil {
+			t.Errorf("%s: Set(%q): %v", test.name, test.command, err)
+			continue
+		}
+		if v := GetDPTValue(dp); v != test.stored {
+			t.Errorf("%s: Set(%q) = %v, want %v", test.name, test.command, v, test.stored)
+		}
+		// it is published from the value received
+		received, _ := ProduceDPT(test.DPT)
+		if err := received.Unpack(dp.Pack()); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		v, text := tr.Value(received)
+		if v != test.value || text != test.text {
+			t.Errorf("%s: Value = %v %q, want %v %q", test.name, v, text, test.value, test.text)
+		}
+		if v := GetDPTValue(received); v != test.stored {
+			t.Errorf("%s: Value changed the DPT to %v", test.name, v)
+		}
+	}
+}
+
+func TestParseTransform(t *testing.T) {
+	errors := []string{
+		"scale=0",
+		"scale=x",
+		"round=-1",
+		"invert=maybe",
+		"labels=1",
+		"labels=1:",
+		"labels=x:on",
+		"colour=red",
+	}
+	for _, opt := range errors {
+		if tr, err := ParseTransform([]string{opt}); err == nil {
+			t.Errorf("%s: %+v", opt, tr)
+		}
+	}
+}
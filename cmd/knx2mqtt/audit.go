@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// AuditRecord is the result of a command received from MQTT.
+type AuditRecord struct {
+	Time        time.Time
+	Topic       string // topic where the command was received
+	Source      string `json:",omitempty"` // individual address given in the command, if any
+	Gateway     string `json:",omitempty"` // gateway chosen to send it
+	Command     string
+	Destination string // group address or, in device management, individual address
+	Data        []byte
+	Status      string // sent, denied, stale, no gateway, dropped, coalesced, discarded or error
+	Error       string `json:",omitempty"`
+}
+
+// Auditor appends a record of every command received from MQTT to a file
+// and sends it to be published in an audit topic.
+// All its methods can be called on a nil *Auditor, doing nothing.
+type Auditor struct {
+	mu      sync.Mutex
+	file    *os.File
+	topic   string
+	records chan AuditRecord
+}
+
+// NewAuditor opens (or creates) the audit log file, if filename is not empty,
+// and prepares to publish the records in topic, if it is not empty.
+func NewAuditor(filename string, topic string) (*Auditor, error) {
+	a := &Auditor{topic: topic}
+	if filename != "" {
+		f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+		if err != nil {
+			return nil, err
+		}
+		a.file = f
+	}
+	if topic != "" {
+		a.records = make(chan AuditRecord, 100)
+	}
+	return a, nil
+}
+
+// Record writes the result of sending e through gateway.
+func (a *Auditor) Record(e Event, gateway string, status string, err error) {
+	if a == nil {
+		return
+	}
+	r := AuditRecord{
+		Time:        time.Now(),
+		Topic:       e.topic,
+		Gateway:     gateway,
+		Command:     e.Command.String(),
+		Destination: e.Destination.String(),
+		Data:        e.Data,
+		Status:      status,
+	}
+	if e.Source != 0 {
+		r.Source = e.Source.String()
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	a.write(r)
+}
+
+// RecordDevice writes the result of a device management request.
+func (a *Auditor) RecordDevice(req DeviceRequest, gateway string, status string, err error) {
+	if a == nil {
+		return
+	}
+	r := AuditRecord{
+		Time:        time.Now(),
+		Topic:       req.topic,
+		Gateway:     gateway,
+		Command:     string(req.Service),
+		Destination: req.Device.String(),
+		Data:        req.Data,
+		Status:      status,
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	a.write(r)
+}
+
+func (a *Auditor) write(r AuditRecord) {
+	if a.file != nil {
+		b, _ := json.Marshal(r)
+		a.mu.Lock()
+		_, werr := a.file.Write(append(b, '\n'))
+		if werr == nil {
+			werr = a.file.Sync()
+		}
+		a.mu.Unlock()
+		if werr != nil {
+			logBridge.Error("could not write audit log", "file", a.file.Name(), "error", werr)
+		}
+	}
+	if a.records != nil {
+		select {
+		case a.records <- r:
+		default:
+			logBridge.Warn("audit topic backlog full; not publishing record", "topic", a.topic, "destination", r.Destination, "status", r.Status)
+		}
+	}
+}
+
+// Records returns the channel with the records to be published,
+// which is nil if there is no audit topic.
+func (a *Auditor) Records() <-chan AuditRecord {
+	if a == nil {
+		return nil
+	}
+	return a.records
+}
+
+// Topic returns the topic where the records are published.
+func (a *Auditor) Topic() string {
+	if a == nil {
+		return ""
+	}
+	return a.topic
+}
+
+// Close closes the audit log file.
+func (a *Auditor) Close() error {
+	if a == nil || a.file == nil {
+		return nil
+	}
+	return a.file.Close()
+}
@@ -3,7 +3,11 @@ package main
 import (
 	"flag"
 	"fmt"
-	"log"
+	"os"
+	"time"
+
+	"github.com/cespedes/knx2mqtt/internal/logging"
+	"github.com/cespedes/knx2mqtt/internal/mqttclient"
 )
 
 type SliceOfStrings []string
@@ -24,31 +28,144 @@ func (s *SliceOfStrings) Set(value string) error {
 }
 
 type Config struct {
-	Debug       bool
+	Logging     *logging.Config
 	KNXGateways SliceOfStrings
+	KNXFilter   string
 	MQTTServer  string
 	MQTTPrefix  string
+	MQTTVersion mqttclient.Version
+	ReadTimeout time.Duration
+	CmdMaxAge   time.Duration
+	KNXRate     float64
+	KNXQueueLen int
+	DedupWindow time.Duration
+
+	ForwardRules []ForwardRule
+	Policy       Policy
+	Readouts     map[string][]GroupRange
+
+	MetricsAddr string
+	DeviceMgmt  bool
+
+	AuditFile  string
+	AuditTopic string
+
+	ShutdownTimeout time.Duration
+
+	KeyringFile     string
+	KeyringPassword string
+	Keyring         *Keyring
 }
 
 func ReadConfig() *Config {
 	var config Config
+	var forward SliceOfStrings
+	var readout SliceOfStrings
+	var policy SliceOfStrings
 	// var configFile string
 	// flag.StringVar(&configFile, "config", "knx2mqtt.ini", "Config file to read")
-	flag.BoolVar(&config.Debug, "debug", false, "Debugging")
-	flag.Var(&config.KNXGateways, "knx", "KNX Gateway (can be repeated)")
+	config.Logging = logging.AddFlags(flag.CommandLine)
+	flag.StringVar(&config.AuditFile, "audit-log", "", "File to append a record of every MQTT command sent to KNX")
+	flag.StringVar(&config.AuditTopic, "audit-topic", "", "MQTT topic to publish a record of every MQTT command sent to KNX")
+	flag.Var(&config.KNXGateways, "knx", "KNX Gateway, or \"auto\" to discover them (can be repeated)")
+	flag.StringVar(&config.KNXFilter, "knx-filter", "", "With -knx auto, only use gateways whose name or address match this pattern")
+	flag.StringVar(&config.KeyringFile, "knx-keyring", "", "ETS keyring file (.knxkeys) with the credentials of secure gateways")
+	flag.StringVar(&config.KeyringPassword, "knx-keyring-password", os.Getenv("KNX_KEYRING_PASSWORD"), "Password of the keyring file (default $KNX_KEYRING_PASSWORD)")
+	flag.Float64Var(&config.KNXRate, "knx-rate", 20, "Maximum telegrams per second sent to each KNX gateway")
+	flag.IntVar(&config.KNXQueueLen, "knx-queue", 100, "Maximum telegrams waiting to be sent to each KNX gateway")
+	flag.DurationVar(&config.DedupWindow, "dedup", 0, "Merge identical telegrams seen by several gateways within this window (0: disabled)")
+	flag.Var(&forward, "forward", "Forward telegrams between KNX gateways (can be repeated)")
+	flag.Var(&policy, "policy", "Allow or deny MQTT commands to some addresses (can be repeated)")
+	flag.BoolVar(&config.Policy.ReadOnly, "read-only", false, "Only send read requests from MQTT to KNX")
+	flag.BoolVar(&config.Policy.DefaultDeny, "policy-default-deny", false, "Deny the MQTT commands not allowed by any -policy rule")
+	flag.Var(&readout, "readout", "Gateway and group ranges to read after connecting (can be repeated)")
+	flag.BoolVar(&config.DeviceMgmt, "device-mgmt", false, "Accept device management requests in prefix/mgmt")
+	flag.StringVar(&config.MetricsAddr, "metrics", "", "Address to serve Prometheus metrics on /metrics (eg, \":9101\")")
 	flag.StringVar(&config.MQTTServer, "mqtt", "", "MQTT server")
 	flag.StringVar(&config.MQTTPrefix, "mqtt-prefix", "knx", "MQTT prefix to use")
+	flag.Var(&config.MQTTVersion, "mqtt-version", "MQTT protocol version (3.1.1 or 5)")
+	flag.DurationVar(&config.CmdMaxAge, "cmd-max-age", 0, "Discard MQTT commands older than this (0: never)")
+	flag.DurationVar(&config.ShutdownTimeout, "shutdown-timeout", 5*time.Second, "Maximum time to send pending telegrams and disconnect on exit")
+	flag.DurationVar(&config.ReadTimeout, "read-timeout", 5*time.Second, "Time to wait for a response to a read request")
 	flag.Parse()
 
-	if config.Debug {
-		log.Printf("config = %+v\n", config)
+	if err := logging.Setup(config.Logging, "knx2mqtt"); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
 
+	for _, f := range forward {
+		rules, err := ParseForwardRules(f)
+		if err != nil {
+			logging.Fatal(logConfig, "invalid -forward option", "error", err)
+		}
+		config.ForwardRules = append(config.ForwardRules, rules...)
+	}
+	for _, p := range policy {
+		rule, err := ParsePolicyRule(p)
+		if err != nil {
+			logging.Fatal(logConfig, "invalid -policy option", "error", err)
+		}
+		config.Policy.Rules = append(config.Policy.Rules, rule)
+	}
+	config.Readouts = make(map[string][]GroupRange)
+	for _, r := range readout {
+		gw, ranges, err := ParseReadout(r)
+		if err != nil {
+			logging.Fatal(logConfig, "invalid -readout option", "error", err)
+		}
+		config.Readouts[gw] = append(config.Readouts[gw], ranges...)
+	}
+
+	// the keyring has not been read yet, but its password must not be logged
+	logged := config
+	if logged.KeyringPassword != "" {
+		logged.KeyringPassword = "REDACTED"
+	}
+	logConfig.Debug("configuration read", "config", fmt.Sprintf("%+v", logged))
+
+	var gateways SliceOfStrings
+	for _, gw := range config.KNXGateways {
+		if gw != "auto" {
+			gateways = append(gateways, gw)
+			continue
+		}
+		found, err := autoGateways(config.KNXFilter)
+		if err != nil {
+			logging.Fatal(logConfig, "could not discover gateways", "error", err)
+		}
+		if len(found) == 0 {
+			logging.Fatal(logConfig, "no KNX gateways discovered", "filter", config.KNXFilter)
+		}
+		gateways = append(gateways, found...)
+	}
+	config.KNXGateways = gateways
 	if len(config.KNXGateways) == 0 {
-		log.Fatalf("No KNX gateways specified")
+		logging.Fatal(logConfig, "no KNX gateways specified")
 	}
 	if len(config.MQTTServer) == 0 {
-		log.Fatalf("No MQTT server specified")
+		logging.Fatal(logConfig, "no MQTT server specified")
+	}
+	if config.KeyringFile != "" {
+		var err error
+		config.Keyring, err = ReadKeyring(config.KeyringFile, config.KeyringPassword)
+		if err != nil {
+			logging.Fatal(logConfig, "could not read keyring", "error", err)
+		}
+	}
+	for _, gw := range config.KNXGateways {
+		host, tunnel, ok := secureGateway(gw)
+		if !ok {
+			continue
+		}
+		if config.Keyring == nil {
+			logging.Fatal(logConfig, "secure gateway needs a keyring (-knx-keyring)", "gateway", host)
+		}
+		t, err := config.Keyring.Tunnel(tunnel)
+		if err != nil {
+			logging.Fatal(logConfig, "no credentials for secure gateway", "gateway", host, "error", err)
+		}
+		logConfig.Debug("secure gateway", "gateway", host, "tunnel", t.IndividualAddress, "user", t.UserID)
 	}
 
 	return &config
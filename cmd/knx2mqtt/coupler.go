@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vapourismo/knx-go/knx"
+	"github.com/vapourismo/knx-go/knx/cemi"
+)
+
+// CouplerLoopWindow is the time during which a telegram forwarded to a gateway
+// is not forwarded again if it is received back from that gateway.
+const CouplerLoopWindow = 2 * time.Second
+
+// GroupRange is a range of group addresses, both ends included.
+type GroupRange struct {
+	First cemi.GroupAddr
+	Last  cemi.GroupAddr
+}
+
+func (r GroupRange) Contains(addr cemi.GroupAddr) bool {
+	return addr >= r.First && addr <= r.Last
+}
+
+// ParseGroupRange parses a range of group addresses.  It can be a single address ("1/2/3"),
+// a main group ("1/"), a middle group ("1/2/") or two addresses separated by a dash ("1/2/0-1/2/127").
+func ParseGroupRange(s string) (GroupRange, error) {
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		first, err := cemi.NewGroupAddrString(s[:i])
+		if err != nil {
+			return GroupRange{}, fmt.Errorf("invalid group range %q: %w", s, err)
+		}
+		last, err := cemi.NewGroupAddrString(s[i+1:])
+		if err != nil {
+			return GroupRange{}, fmt.Errorf("invalid group range %q: %w", s, err)
+		}
+		if last < first {
+			return GroupRange{}, fmt.Errorf("invalid group range %q", s)
+		}
+		return GroupRange{first, last}, nil
+	}
+	var a, b uint8
+	if n, _ := fmt.Sscanf(s, "%d/%d/", &a, &b); n == 2 && strings.Count(s, "/") == 2 && strings.HasSuffix(s, "/") {
+		if a > 31 || b > 7 {
+			return GroupRange{}, fmt.Errorf("invalid group range %q: group out of range", s)
+		}
+		first := cemi.NewGroupAddr3(a, b, 0)
+		return GroupRange{first, first | 0xff}, nil
+	}
+	if n, _ := fmt.Sscanf(s, "%d/", &a); n == 1 && strings.Count(s, "/") == 1 && strings.HasSuffix(s, "/") {
+		if a > 31 {
+			return GroupRange{}, fmt.Errorf("invalid group range %q: main group out of range", s)
+		}
+		first := cemi.NewGroupAddr3(a, 0, 0)
+		return GroupRange{first, first | 0x7ff}, nil
+	}
+	addr, err := cemi.NewGroupAddrString(s)
+	if err != nil {
+		return GroupRange{}, fmt.Errorf("invalid group range %q: %w", s, err)
+	}
+	return GroupRange{addr, addr}, nil
+}
+
+// A ForwardRule makes telegrams received from one gateway to be sent to another one.
+// If Filter is not empty, only telegrams to addresses in one of its ranges are forwarded.
+type ForwardRule struct {
+	From   string
+	To     string
+	Filter []GroupRange
+}
+
+// ParseForwardRules parses a forwarding specification: two gateways separated
+// by ">" (from the first one to the second), "<" (from the second one to the first)
+// or "<>" (both directions), optionally followed by a filter table of group ranges:
+//
+//	192.168.1.50<>192.168.2.50 1/ 2/5/0-2/5/127
+func ParseForwardRules(spec string) ([]ForwardRule, error) {
+	tokens := strings.Fields(spec)
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("empty forwarding rule")
+	}
+	var filter []GroupRange
+	for _, t := range tokens[1:] {
+		r, err := ParseGroupRange(t)
+		if err != nil {
+			return nil, err
+		}
+		filter = append(filter, r)
+	}
+	gws := tokens[0]
+	switch {
+	case strings.Contains(gws, "<>"):
+		i := strings.Index(gws, "<>")
+		a, b := gatewayAddr(gws[:i]), gatewayAddr(gws[i+2:])
+		return []ForwardRule{{a, b, filter}, {b, a, filter}}, nil
+	case strings.Contains(gws, ">"):
+		i := strings.Index(gws, ">")
+		return []ForwardRule{{gatewayAddr(gws[:i]), gatewayAddr(gws[i+1:]), filter}}, nil
+	case strings.Contains(gws, "<"):
+		i := strings.Index(gws, "<")
+		return []ForwardRule{{gatewayAddr(gws[i+1:]), gatewayAddr(gws[:i]), filter}}, nil
+	}
+	return nil, fmt.Errorf("invalid forwarding rule %q: no direction", spec)
+}
+
+func (r ForwardRule) matches(from string, addr cemi.GroupAddr) bool {
+	if r.From != from {
+		return false
+	}
+	if len(r.Filter) == 0 {
+		return true
+	}
+	for _, f := range r.Filter {
+		if f.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// couplerKey identifies a telegram forwarded to a gateway.  It does not
+// include the source address, because the gateway sends the telegram with
+// its own (tunnel) address and that is the source it has when it comes back.
+// That address is not known, so an identical telegram sent by a device in
+// the line of that gateway within CouplerLoopWindow cannot be told apart
+// from the copy coming back, and it is not forwarded either.
+type couplerKey struct {
+	Gateway     string
+	Destination cemi.GroupAddr
+	Command     knx.GroupCommand
+	Data        string
+}
+
+// Coupler forwards telegrams between gateways, like a line coupler.
+type Coupler struct {
+	rules []ForwardRule
+
+	mu     sync.Mutex
+	recent map[couplerKey]time.Time // telegrams recently forwarded to each gateway
+}
+
+func NewCoupler(rules []ForwardRule) *Coupler {
+	return &Coupler{
+		rules:  rules,
+		recent: make(map[couplerKey]time.Time),
+	}
+}
+
+// Targets returns the gateways where e has to be forwarded: the ones reached by the
+// rules from the gateway it comes from and, through them, by the rules from those
+// gateways (so with A<>B and B<>C, telegrams from A are forwarded to B and C).
+// Telegrams which have just been forwarded to the gateway they come from are not forwarded again.
+func (c *Coupler) Targets(e Event) []string {
+	now := time.Now()
+	key := couplerKey{e.Gateway, e.Destination, e.Command, string(e.Data)}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, t := range c.recent {
+		if now.Sub(t) > CouplerLoopWindow {
+			delete(c.recent, k)
+		}
+	}
+	if _, ok := c.recent[key]; ok {
+		delete(c.recent, key)
+		return nil
+	}
+
+	var targets []string
+	reached := map[string]bool{e.Gateway: true}
+	for from := []string{e.Gateway}; len(from) > 0; from = from[1:] {
+		for _, r := range c.rules {
+			if reached[r.To] || !r.matches(from[0], e.Destination) {
+				continue
+			}
+			reached[r.To] = true
+			from = append(from, r.To)
+			targets = append(targets, r.To)
+			key.Gateway = r.To
+			c.recent[key] = now
+		}
+	}
+	return targets
+}
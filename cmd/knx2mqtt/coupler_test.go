@@ -0,0 +1,89 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/vapourismo/knx-go/knx"
+	"github.com/vapourismo/knx-go/knx/cemi"
+)
+
+func TestCouplerChain(t *testing.T) {
+	// A <> B <> C, with only 1/ between B and C
+	var rules []ForwardRule
+	for _, spec := range []string{"10.0.0.1<>10.0.0.2", "10.0.0.2<>10.0.0.3 1/"} {
+		r, err := ParseForwardRules(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rules = append(rules, r...)
+	}
+	const a, b, c = "10.0.0.1:3671", "10.0.0.2:3671", "10.0.0.3:3671"
+	coupler := NewCoupler(rules)
+
+	event := func(gw string, source cemi.IndividualAddr, dest cemi.GroupAddr, data byte) Event {
+		return Event{Gateway: gw, GroupEvent: knx.GroupEvent{
+			Command:     knx.GroupWrite,
+			Source:      source,
+			Destination: dest,
+			Data:        []byte{data},
+		}}
+	}
+	tests := []struct {
+		name    string
+		e       Event
+		targets []string
+	}{
+		{"from A through B to C", event(a, 0x1105, cemi.NewGroupAddr3(1, 0, 1), 1), []string{b, c}},
+		// the gateways send the forwarded telegrams with their own source address
+		{"back from B", event(b, 0x11ff, cemi.NewGroupAddr3(1, 0, 1), 1), nil},
+		{"back from C", event(c, 0x12ff, cemi.NewGroupAddr3(1, 0, 1), 1), nil},
+		{"filtered between B and C", event(a, 0x1105, cemi.NewGroupAddr3(2, 0, 1), 1), []string{b}},
+		{"back from B, filtered", event(b, 0x11ff, cemi.NewGroupAddr3(2, 0, 1), 1), nil},
+		{"from C through B to A", event(c, 0x1306, cemi.NewGroupAddr3(1, 0, 2), 0), []string{b, a}},
+		{"other data from B", event(b, 0x1206, cemi.NewGroupAddr3(1, 0, 2), 1), []string{a, c}},
+		// the source of the copy coming back is not known, so the same telegram
+		// from a device in the target line is taken as that copy, but only once
+		{"from A to B and C", event(a, 0x1105, cemi.NewGroupAddr3(1, 0, 3), 1), []string{b, c}},
+		{"same telegram from a device in B", event(b, 0x1201, cemi.NewGroupAddr3(1, 0, 3), 1), nil},
+		{"again from a device in B", event(b, 0x1201, cemi.NewGroupAddr3(1, 0, 3), 1), []string{a, c}},
+	}
+	for _, test := range tests {
+		targets := coupler.Targets(test.e)
+		if !reflect.DeepEqual(targets, test.targets) {
+			t.Errorf("%s: targets %v, want %v", test.name, targets, test.targets)
+		}
+	}
+}
+
+func TestParseGroupRange(t *testing.T) {
+	tests := []struct {
+		s     string
+		first cemi.GroupAddr
+		last  cemi.GroupAddr
+		ok    bool
+	}{
+		{"1/2/3", cemi.NewGroupAddr3(1, 2, 3), cemi.NewGroupAddr3(1, 2, 3), true},
+		{"1/", cemi.NewGroupAddr3(1, 0, 0), cemi.NewGroupAddr3(1, 7, 255), true},
+		{"31/", cemi.NewGroupAddr3(31, 0, 0), cemi.NewGroupAddr3(31, 7, 255), true},
+		{"1/2/", cemi.NewGroupAddr3(1, 2, 0), cemi.NewGroupAddr3(1, 2, 255), true},
+		{"31/7/", cemi.NewGroupAddr3(31, 7, 0), cemi.NewGroupAddr3(31, 7, 255), true},
+		{"1/2/0-1/2/127", cemi.NewGroupAddr3(1, 2, 0), cemi.NewGroupAddr3(1, 2, 127), true},
+		{"40/", 0, 0, false},
+		{"32/", 0, 0, false},
+		{"1/9/", 0, 0, false},
+		{"32/0/", 0, 0, false},
+		{"1/2/127-1/2/0", 0, 0, false},
+		{"lights", 0, 0, false},
+	}
+	for _, test := range tests {
+		r, err := ParseGroupRange(test.s)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: error %v", test.s, err)
+			continue
+		}
+		if test.ok && (r.First != test.first || r.Last != test.last) {
+			t.Errorf("%s: %s-%s, want %s-%s", test.s, r.First, r.Last, test.first, test.last)
+		}
+	}
+}
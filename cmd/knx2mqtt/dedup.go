@@ -0,0 +1,108 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/vapourismo/knx-go/knx"
+	"github.com/vapourismo/knx-go/knx/cemi"
+)
+
+type dedupKey struct {
+	Source      cemi.IndividualAddr
+	Destination cemi.GroupAddr
+	Command     knx.GroupCommand
+	Data        string
+}
+
+// Deduplicator merges the copies of the same telegram received by several gateways
+// (for example, when they are on coupled lines) into one Event.
+// Every event is delayed by the length of the window, and they are sent
+// in the order they arrived.
+type Deduplicator struct {
+	mu      sync.Mutex
+	window  time.Duration
+	pending map[dedupKey][]*Event
+	fifo    []dedupEntry
+	ready   chan struct{}
+	out     chan<- Event
+}
+
+type dedupEntry struct {
+	key      dedupKey
+	event    *Event
+	deadline time.Time
+}
+
+func NewDeduplicator(window time.Duration, out chan<- Event) *Deduplicator {
+	d := &Deduplicator{
+		window:  window,
+		pending: make(map[dedupKey][]*Event),
+		ready:   make(chan struct{}, 1),
+		out:     out,
+	}
+	go d.run()
+	return d
+}
+
+// Add receives an event from a gateway.  If another gateway has seen the same
+// telegram in the last window, the gateway is added to that event; otherwise,
+// a new event is sent to the output channel after the window expires.
+func (d *Deduplicator) Add(e Event) {
+	key := dedupKey{e.Source, e.Destination, e.Command, string(e.Data)}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+pendingLoop:
+	for _, p := range d.pending[key] {
+		for _, gw := range p.Gateways {
+			if gw == e.Gateway {
+				// a repeated telegram seen by the same gateway is not a duplicate
+				continue pendingLoop
+			}
+		}
+		p.Gateways = append(p.Gateways, e.Gateway)
+		return
+	}
+
+	p := &e
+	p.Gateways = []string{e.Gateway}
+	d.pending[key] = append(d.pending[key], p)
+	d.fifo = append(d.fifo, dedupEntry{key, p, time.Now().Add(d.window)})
+	select {
+	case d.ready <- struct{}{}:
+	default:
+	}
+}
+
+// run sends the events to the output channel when their window expires.
+func (d *Deduplicator) run() {
+	for {
+		d.mu.Lock()
+		if len(d.fifo) == 0 {
+			d.mu.Unlock()
+			<-d.ready
+			continue
+		}
+		next := d.fifo[0]
+		if wait := time.Until(next.deadline); wait > 0 {
+			d.mu.Unlock()
+			time.Sleep(wait)
+			continue
+		}
+		d.fifo = d.fifo[1:]
+		list := d.pending[next.key]
+		for i := range list {
+			if list[i] == next.event {
+				d.pending[next.key] = append(list[:i], list[i+1:]...)
+				break
+			}
+		}
+		if len(d.pending[next.key]) == 0 {
+			delete(d.pending, next.key)
+		}
+		e := *next.event
+		d.mu.Unlock()
+		d.out <- e
+	}
+}
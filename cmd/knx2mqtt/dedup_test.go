@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/vapourismo/knx-go/knx"
+	"github.com/vapourismo/knx-go/knx/cemi"
+)
+
+func TestDeduplicator(t *testing.T) {
+	const window = 50 * time.Millisecond
+	out := make(chan Event, 100)
+	d := NewDeduplicator(window, out)
+	event := func(gw string, value byte) Event {
+		return Event{Gateway: gw, GroupEvent: knx.GroupEvent{Command: knx.GroupWrite, Source: 0x1105,
+			Destination: cemi.NewGroupAddr3(1, 2, 3), Data: []byte{value}}}
+	}
+	receive := func() Event {
+		t.Helper()
+		select {
+		case e := <-out:
+			return e
+		case <-time.After(time.Second):
+			t.Fatal("no event received")
+			return Event{}
+		}
+	}
+
+	// the same telegram from two gateways is merged
+	start := time.Now()
+	d.Add(event("gw1", 1))
+	d.Add(event("gw2", 1))
+	// but not a repetition from the same gateway
+	d.Add(event("gw1", 1))
+	e := receive()
+	if d := time.Since(start); d < window {
+		t.Errorf("event sent after %v", d)
+	}
+	if len(e.Gateways) != 2 || e.Gateways[0] != "gw1" || e.Gateways[1] != "gw2" {
+		t.Errorf("gateways %v", e.Gateways)
+	}
+	if e = receive(); len(e.Gateways) != 1 || e.Gateways[0] != "gw1" {
+		t.Errorf("repeated telegram: gateways %v", e.Gateways)
+	}
+
+	// after the window, it is a new telegram
+	d.Add(event("gw1", 2))
+	time.Sleep(2 * window)
+	d.Add(event("gw2", 2))
+	for i := 0; i < 2; i++ {
+		if e := receive(); len(e.Gateways) != 1 {
+			t.Errorf("telegram after the window: gateways %v", e.Gateways)
+		}
+	}
+
+	// different telegrams are sent in the order they arrived
+	for i := 0; i < 50; i++ {
+		d.Add(event("gw1", byte(i)))
+	}
+	for i := 0; i < 50; i++ {
+		if e := receive(); e.Data[0] != byte(i) {
+			t.Fatalf("event %d has value %d", i, e.Data[0])
+		}
+	}
+}
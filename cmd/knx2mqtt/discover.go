@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/cespedes/knx2mqtt/internal/logging"
+	"github.com/vapourismo/knx-go/knx"
+	"github.com/vapourismo/knx-go/knx/knxnet"
+)
+
+const (
+	KNXMulticastAddr = "224.0.23.12:3671"
+	DiscoverTimeout  = 3 * time.Second
+)
+
+// DiscoveredGateway is a KNXnet/IP interface which answered to a search request.
+type DiscoveredGateway struct {
+	Address           string // IP address and port of its control endpoint
+	Name              string
+	IndividualAddress string
+	MAC               string
+	Services          []string
+	Tunnelling        bool
+	FreeTunnels       int // -1 if unknown
+}
+
+var serviceFamilyNames = map[knxnet.ServiceFamilyType]string{
+	knxnet.ServiceFamilyTypeIPCore:                            "core",
+	knxnet.ServiceFamilyTypeIPDeviceManagement:                "devmgmt",
+	knxnet.ServiceFamilyTypeIPTunnelling:                      "tunnelling",
+	knxnet.ServiceFamilyTypeIPRouting:                         "routing",
+	knxnet.ServiceFamilyTypeIPRemoteLogging:                   "remotelog",
+	knxnet.ServiceFamilyTypeIPRemoteConfigurationAndDiagnosis: "remoteconf",
+	knxnet.ServiceFamilyTypeIPObjectServer:                    "objectserver",
+}
+
+// DiscoverGateways sends a search request on the interface ifi (or the
+// default one if nil) and returns the interfaces answering before timeout.
+func DiscoverGateways(ifi *net.Interface, timeout time.Duration) ([]DiscoveredGateway, error) {
+	results, err := knx.DiscoverOnInterface(ifi, KNXMulticastAddr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	var gws []DiscoveredGateway
+	seen := make(map[string]bool)
+	for _, r := range results {
+		g := DiscoveredGateway{
+			Address:           fmt.Sprintf("%s:%d", r.Control.Address, r.Control.Port),
+			Name:              strings.TrimRight(r.DeviceHardware.FriendlyName, "\x00"),
+			IndividualAddress: r.DeviceHardware.Source.String(),
+			MAC:               r.DeviceHardware.HardwareAddr.String(),
+			FreeTunnels:       -1,
+		}
+		if seen[g.Address] {
+			continue
+		}
+		seen[g.Address] = true
+		for _, f := range r.SupportedServices.Families {
+			name := serviceFamilyNames[f.Type]
+			if name == "" {
+				name = fmt.Sprintf("0x%02x", uint8(f.Type))
+			}
+			g.Services = append(g.Services, fmt.Sprintf("%s/%d", name, f.Version))
+			if f.Type == knxnet.ServiceFamilyTypeIPTunnelling {
+				g.Tunnelling = true
+			}
+		}
+		if g.Tunnelling {
+			if n, err := freeTunnels(g.Address, timeout); err == nil {
+				g.FreeTunnels = n
+			} else {
+				logKNX.Debug("could not get tunnelling slots", "gateway", g.Address, "error", err)
+			}
+		}
+		gws = append(gws, g)
+	}
+	return gws, nil
+}
+
+// freeTunnels sends a description request to a gateway and counts the
+// free tunnelling slots in its answer.  Only KNXnet/IP v2 devices report them.
+func freeTunnels(addr string, timeout time.Duration) (int, error) {
+	conn, err := net.DialTimeout("udp4", addr, timeout)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	// header (DESCRIPTION_REQUEST) and a HPAI with address 0.0.0.0:0
+	// (route back answers to the address the request came from)
+	req := []byte{0x06, 0x10, 0x02, 0x03, 0x00, 0x0e, 0x08, 0x01, 0, 0, 0, 0, 0, 0}
+	if _, err := conn.Write(req); err != nil {
+		return 0, err
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return 0, err
+	}
+	buf = buf[:n]
+	if len(buf) < 6 || buf[2] != 0x02 || buf[3] != 0x04 {
+		return 0, errors.New("invalid description response")
+	}
+	// DIBs: length, type and data
+	for dibs := buf[6:]; len(dibs) >= 2; dibs = dibs[dibs[0]:] {
+		l := int(dibs[0])
+		if l < 2 || l > len(dibs) {
+			break
+		}
+		// tunnelling info: max APDU length and, for each slot,
+		// its individual address and status (free, authorised, usable)
+		if dibs[1] == 0x07 && l >= 4 {
+			free := 0
+			for slot := dibs[4:l]; len(slot) >= 4; slot = slot[4:] {
+				if status := binary.BigEndian.Uint16(slot[2:]); status&0x05 == 0x05 {
+					free++
+				}
+			}
+			return free, nil
+		}
+	}
+	return 0, errors.New("no tunnelling info in description response")
+}
+
+// Match reports whether the gateway supports tunnelling and its name,
+// address or individual address match the shell pattern filter.
+func (g DiscoveredGateway) Match(filter string) bool {
+	if !g.Tunnelling {
+		return false
+	}
+	if filter == "" {
+		return true
+	}
+	host, _, _ := net.SplitHostPort(g.Address)
+	for _, s := range []string{g.Name, g.Address, host, g.IndividualAddress} {
+		if ok, _ := path.Match(filter, s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// autoGateways returns the addresses of the discovered gateways matching filter.
+func autoGateways(filter string) ([]string, error) {
+	gws, err := DiscoverGateways(nil, DiscoverTimeout)
+	if err != nil {
+		return nil, err
+	}
+	var addrs []string
+	for _, g := range gws {
+		if !g.Match(filter) {
+			logConfig.Debug("ignoring discovered gateway", "gateway", g.Address, "name", g.Name)
+			continue
+		}
+		logConfig.Info("gateway discovered", "gateway", g.Address, "name", g.Name, "address", g.IndividualAddress)
+		addrs = append(addrs, g.Address)
+	}
+	return addrs, nil
+}
+
+// discoverMain implements "knx2mqtt discover": it lists the KNXnet/IP
+// interfaces in the local network.
+func discoverMain(args []string) {
+	fs := flag.NewFlagSet("knx2mqtt discover", flag.ExitOnError)
+	logOpts := logging.AddFlags(fs)
+	timeout := fs.Duration("timeout", DiscoverTimeout, "Time to wait for answers")
+	filter := fs.String("filter", "", "Only show tunnelling interfaces whose name or address match this pattern")
+	ifName := fs.String("interface", "", "Network interface to send the search request (default: system-assigned)")
+	fs.Parse(args)
+
+	if err := logging.Setup(logOpts, "knx2mqtt"); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	var ifi *net.Interface
+	if *ifName != "" {
+		var err error
+		ifi, err = net.InterfaceByName(*ifName)
+		if err != nil {
+			logging.Fatal(logConfig, "invalid interface", "error", err)
+		}
+	}
+	gws, err := DiscoverGateways(ifi, *timeout)
+	if err != nil {
+		logging.Fatal(logKNX, "could not discover gateways", "error", err)
+	}
+	for _, g := range gws {
+		if *filter != "" && !g.Match(*filter) {
+			continue
+		}
+		free := "?"
+		if g.FreeTunnels >= 0 {
+			free = fmt.Sprint(g.FreeTunnels)
+		}
+		fmt.Printf("%-21s %-9s %s %-30q free-tunnels=%s %s\n", g.Address, g.IndividualAddress, g.MAC, g.Name, free, strings.Join(g.Services, " "))
+	}
+}
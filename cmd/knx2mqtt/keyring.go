@@ -0,0 +1,175 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Keyring holds the credentials exported by ETS in a .knxkeys file.
+// The signature of the file is not verified.
+type Keyring struct {
+	Project    string
+	Created    string
+	Interfaces []KeyringInterface
+	Devices    []KeyringDevice
+}
+
+// KeyringInterface holds the credentials of a secure tunnelling interface.
+type KeyringInterface struct {
+	Type              string
+	Host              string // individual address of the KNX IP device
+	IndividualAddress string // individual address of the tunnel
+	UserID            int
+	Password          string
+	Authentication    string
+}
+
+// KeyringDevice holds the credentials of a KNX IP Secure device.
+type KeyringDevice struct {
+	IndividualAddress  string
+	ManagementPassword string
+	Authentication     string
+}
+
+type xmlKeyring struct {
+	Project    string `xml:",attr"`
+	Created    string `xml:",attr"`
+	Interfaces []struct {
+		Type              string `xml:",attr"`
+		Host              string `xml:",attr"`
+		IndividualAddress string `xml:",attr"`
+		UserID            int    `xml:",attr"`
+		Password          string `xml:",attr"`
+		Authentication    string `xml:",attr"`
+	} `xml:"Interface"`
+	Devices []struct {
+		IndividualAddress  string `xml:",attr"`
+		ManagementPassword string `xml:",attr"`
+		Authentication     string `xml:",attr"`
+	} `xml:"Devices>Device"`
+}
+
+// pbkdf2 derives a key from a password as in RFC 8018, using HMAC-SHA256.
+func pbkdf2(password, salt []byte, iter, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	var key []byte
+	for block := uint32(1); len(key) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.Write(prf, binary.BigEndian, block)
+		u := prf.Sum(nil)
+		t := make([]byte, len(u))
+		copy(t, u)
+		for i := 1; i < iter; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
+
+// ReadKeyring reads an ETS keyring file and decrypts its passwords.
+func ReadKeyring(filename string, password string) (*Keyring, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var x xmlKeyring
+	if err := xml.NewDecoder(f).Decode(&x); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	if x.Created == "" {
+		return nil, fmt.Errorf("%s: not a KNX keyring", filename)
+	}
+
+	key := pbkdf2([]byte(password), []byte("1.keyring.ets.knx.org"), 65536, 16)
+	ivHash := sha256.Sum256([]byte(x.Created))
+	iv := ivHash[:16]
+	decrypt := func(s string) (string, error) {
+		if s == "" {
+			return "", nil
+		}
+		data, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return "", err
+		}
+		if len(data) == 0 || len(data)%aes.BlockSize != 0 {
+			return "", errors.New("invalid encrypted data")
+		}
+		block, _ := aes.NewCipher(key)
+		plain := make([]byte, len(data))
+		cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, data)
+		// 8 random bytes, the password and PKCS#7 padding (pad bytes with the value pad)
+		pad := int(plain[len(plain)-1])
+		if pad == 0 || pad > aes.BlockSize || 8+pad > len(plain) {
+			return "", errors.New("wrong keyring password")
+		}
+		for _, b := range plain[len(plain)-pad:] {
+			if int(b) != pad {
+				return "", errors.New("wrong keyring password")
+			}
+		}
+		return string(plain[8 : len(plain)-pad]), nil
+	}
+
+	k := &Keyring{Project: x.Project, Created: x.Created}
+	for _, i := range x.Interfaces {
+		ki := KeyringInterface{
+			Type:              i.Type,
+			Host:              i.Host,
+			IndividualAddress: i.IndividualAddress,
+			UserID:            i.UserID,
+		}
+		if ki.Password, err = decrypt(i.Password); err != nil {
+			return nil, fmt.Errorf("%s: interface %s: %w", filename, i.IndividualAddress, err)
+		}
+		if ki.Authentication, err = decrypt(i.Authentication); err != nil {
+			return nil, fmt.Errorf("%s: interface %s: %w", filename, i.IndividualAddress, err)
+		}
+		k.Interfaces = append(k.Interfaces, ki)
+	}
+	for _, d := range x.Devices {
+		kd := KeyringDevice{IndividualAddress: d.IndividualAddress}
+		if kd.ManagementPassword, err = decrypt(d.ManagementPassword); err != nil {
+			return nil, fmt.Errorf("%s: device %s: %w", filename, d.IndividualAddress, err)
+		}
+		if kd.Authentication, err = decrypt(d.Authentication); err != nil {
+			return nil, fmt.Errorf("%s: device %s: %w", filename, d.IndividualAddress, err)
+		}
+		k.Devices = append(k.Devices, kd)
+	}
+	return k, nil
+}
+
+// Tunnel returns the credentials of a tunnelling interface, by its individual address.
+// If addr is empty, the first tunnelling interface is returned.
+func (k *Keyring) Tunnel(addr string) (*KeyringInterface, error) {
+	for i := range k.Interfaces {
+		t := &k.Interfaces[i]
+		if t.Type != "Tunneling" {
+			continue
+		}
+		if addr == "" || t.IndividualAddress == addr {
+			return t, nil
+		}
+	}
+	if addr == "" {
+		return nil, errors.New("no tunnelling interfaces in keyring")
+	}
+	return nil, fmt.Errorf("no tunnelling interface %s in keyring", addr)
+}
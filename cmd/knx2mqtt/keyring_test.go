@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Test vectors of PBKDF2-HMAC-SHA256: the ones of RFC 6070 (for SHA-1)
+// computed with SHA-256, and the ones of RFC 7914, section 11.
+func TestPBKDF2(t *testing.T) {
+	tests := []struct {
+		password, salt string
+		iter           int
+		key            string
+	}{
+		{"password", "salt", 1, "120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b"},
+		{"password", "salt", 2, "ae4d0c95af6b46d32d0adff928f06dd02a303f8ef3c251dfd6e2d85a95474c43"},
+		{"password", "salt", 4096, "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a"},
+		{"passwordPASSWORDpassword", "saltSALTsaltSALTsaltSALTsaltSALTsalt", 4096,
+			"348c89dbcbd32b2f32d814b8116e84cf2b17347ebc1800181c4e2a1fb8dd53e1c635518c7dac47e9"},
+		{"pass\x00word", "sa\x00lt", 4096, "89b69d0516f829893c696226650a8687"},
+		{"passwd", "salt", 1, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc" +
+			"49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"},
+		{"Password", "NaCl", 80000, "4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56" +
+			"a1d425a1225833549adb841b51c9b3176a272bdebba1d078478f62b397f33c8d"},
+	}
+	for _, test := range tests {
+		key := pbkdf2([]byte(test.password), []byte(test.salt), test.iter, len(test.key)/2)
+		if got := hex.EncodeToString(key); got != test.key {
+			t.Errorf("%q, %q, %d: %s, want %s", test.password, test.salt, test.iter, got, test.key)
+		}
+	}
+}
+
+// testKeyring has been encrypted with the password "secret", outside of knx2mqtt:
+// the key is PBKDF2-HMAC-SHA256("secret", "1.keyring.ets.knx.org", 65536) = 3540736ba45a49e0fda3fc49c4767d61
+// and the IV the first 16 bytes of SHA-256("2024-03-01T10:20:30") = 076ba1f2cac2aa8de840cb8bd19d2746.
+const testKeyring = `<?xml version="1.0" encoding="utf-8"?>
+<Keyring Project="Test" CreatedBy="ETS 6" Created="2024-03-01T10:20:30" Signature="" xmlns="http://knx.org/xml/keyring/1">
+  <Interface Type="Tunneling" Host="1.1.1" IndividualAddress="1.1.250" UserID="2" Password="bBEkLliyTKmN94gq5jTUtdZ+Cp7z9ooE/QAa1f4MFCI=" Authentication="s2euKaXn8so0ql+AI1VGEA==" />
+  <Interface Type="Tunneling" Host="1.1.1" IndividualAddress="1.1.251" UserID="3" Password="5P60sM9YcsbMi+An01Gw9d1FidVI4VxavTag8sUCG5k=" />
+  <Devices>
+    <Device IndividualAddress="1.1.1" ManagementPassword="QpLHbklxWM4QsbqdsDOaN3gT8tFt58LdFDeHVoWPDOw=" Authentication="s2euKaXn8so0ql+AI1VGEA==" />
+  </Devices>
+</Keyring>
+`
+
+func TestReadKeyring(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "test.knxkeys")
+	if err := os.WriteFile(filename, []byte(testKeyring), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	k, err := ReadKeyring(filename, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.Project != "Test" || len(k.Interfaces) != 2 || len(k.Devices) != 1 {
+		t.Fatalf("keyring %+v", k)
+	}
+	tunnel, err := k.Tunnel("1.1.250")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := KeyringInterface{Type: "Tunneling", Host: "1.1.1", IndividualAddress: "1.1.250", UserID: 2, Password: "tunnel2pass", Authentication: "devauth"}
+	if *tunnel != want {
+		t.Errorf("tunnel %+v, want %+v", *tunnel, want)
+	}
+	// a password filling whole blocks has a whole block of padding
+	if tunnel, err = k.Tunnel("1.1.251"); err != nil || tunnel.Password != "a 16 byte passwd" || tunnel.Authentication != "" {
+		t.Errorf("tunnel %+v: %v", tunnel, err)
+	}
+	if d := k.Devices[0]; d.IndividualAddress != "1.1.1" || d.ManagementPassword != "mgmtpass" || d.Authentication != "devauth" {
+		t.Errorf("device %+v", d)
+	}
+
+	if _, err := ReadKeyring(filename, "wrong"); err == nil {
+		t.Error("keyring read with a wrong password")
+	}
+}
@@ -1,12 +1,15 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/cespedes/knx2mqtt/internal/logging"
 	"github.com/vapourismo/knx-go/knx"
 	"github.com/vapourismo/knx-go/knx/cemi"
 )
@@ -14,6 +17,8 @@ import (
 const (
 	KNXDefaultPort = 3671
 	KNXTimeout     = 3 * time.Minute // no messages in some time: probable error in connection
+
+	KNXReconnectDelay = 5 * time.Second // after losing the connection to a gateway
 )
 
 func toEvent(gw string, knxEvent knx.GroupEvent) Event {
@@ -27,20 +32,74 @@ func toEvent(gw string, knxEvent knx.GroupEvent) Event {
 	return event
 }
 
-func (s *Server) KNX(gateways []string) (fromKNX chan Event, toKNX chan Event) {
-	type clientAddresses struct {
-		Client    knx.GroupTunnel
-		Addresses []cemi.GroupAddr
+// gatewayAddr adds the default port to a gateway address if it has none.
+func gatewayAddr(gw string) string {
+	if !strings.Contains(gw, ":") {
+		return fmt.Sprintf("%s:%d", gw, KNXDefaultPort)
 	}
-	gws := make(map[string]*clientAddresses)
-	var mu sync.Mutex
+	return gw
+}
 
-	//conns := make(map[string]knx.GroupTunnel)
+// GroupConn is a connection to a KNX network for group communication,
+// through a KNXnet/IP tunnel or a knxd server.
+type GroupConn interface {
+	knx.GroupClient
+	Close()
+}
 
-	for i, gw := range gateways {
-		if !strings.Contains(gw, ":") {
-			gateways[i] = fmt.Sprintf("%s:%d", gw, KNXDefaultPort)
+// dialGateway connects to a KNX gateway: "knxd://..." for a knxd server,
+// "secure://..." for a KNX IP Secure gateway (with the credentials from the keyring)
+// or the address of a KNXnet/IP gateway.
+func (s *Server) dialGateway(gw string) (GroupConn, error) {
+	if addr, ok := knxdGateway(gw); ok {
+		return DialKNXD(addr)
+	}
+	if addr, tunnel, ok := secureGateway(gw); ok {
+		if s.Keyring == nil {
+			return nil, errors.New("secure gateway needs a keyring")
+		}
+		creds, err := s.Keyring.Tunnel(tunnel)
+		if err != nil {
+			return nil, err
 		}
+		return DialSecureTunnel(addr, creds)
+	}
+	return DialTunnel(gw)
+}
+
+// gateway keeps the connection to a KNX gateway, the group addresses seen
+// through it and its transmit queue.
+type gateway struct {
+	Client      GroupConn // nil if not connected
+	Addresses   []cemi.GroupAddr
+	Queue       *TxQueue
+	Readout     map[cemi.GroupAddr]bool // addresses which have not answered yet to a read-out
+	stopReadout context.CancelFunc      // stops the read-out in progress, if any
+	Lines       map[uint16]bool         // lines (area and line of the source address) seen through it
+
+	mgmtMu sync.Mutex // held during device management sessions
+}
+
+// secureGateway parses the address of a secure gateway: "secure://host[:port][/tunnel]",
+// where tunnel is the individual address of the tunnel to use from the keyring.
+func secureGateway(gw string) (host string, tunnel string, ok bool) {
+	if !strings.HasPrefix(gw, "secure://") {
+		return "", "", false
+	}
+	host = strings.TrimPrefix(gw, "secure://")
+	if i := strings.IndexByte(host, '/'); i >= 0 {
+		host, tunnel = host[:i], host[i+1:]
+	}
+	return gatewayAddr(host), tunnel, true
+}
+
+func (s *Server) KNX(ctx context.Context, gateways []string) (fromKNX chan Event, toKNX chan Event) {
+	s.gws = make(map[string]*gateway)
+	gws := s.gws
+	mu := &s.mu
+
+	for i, gw := range gateways {
+		gateways[i] = gatewayAddr(gw)
 	}
 
 	inChan := make(chan Event, 5)
@@ -48,26 +107,73 @@ func (s *Server) KNX(gateways []string) (fromKNX chan Event, toKNX chan Event) {
 
 	// Populate map before creating goroutines
 	for _, gw := range gateways {
-		gws[gw] = new(clientAddresses)
+		gws[gw] = new(gateway)
+		gws[gw].Queue = NewTxQueue(s.KNXRate, s.KNXQueueLen)
+	}
+
+	s.metrics.Collect(func() {
+		for _, gw := range gateways {
+			stats := gws[gw].Queue.Stats()
+			s.metrics.Set("knx2mqtt_queue_length", float64(stats.Length), "gateway", gw)
+			s.metrics.Set("knx2mqtt_queue_telegrams_total", float64(stats.Queued), "gateway", gw, "result", "queued")
+			s.metrics.Set("knx2mqtt_queue_telegrams_total", float64(stats.Sent), "gateway", gw, "result", "sent")
+			s.metrics.Set("knx2mqtt_queue_telegrams_total", float64(stats.Discarded), "gateway", gw, "result", "discarded")
+			s.metrics.Set("knx2mqtt_queue_telegrams_total", float64(stats.Coalesced), "gateway", gw, "result", "coalesced")
+			s.metrics.Set("knx2mqtt_queue_telegrams_total", float64(stats.Dropped), "gateway", gw, "result", "dropped")
+		}
+		s.metrics.Set("knx2mqtt_channel_backlog", float64(len(inChan)), "channel", "toKNX")
+		s.metrics.Set("knx2mqtt_channel_backlog", float64(len(outChan)), "channel", "fromKNX")
+	})
+
+	for gw := range s.Readouts {
+		if gws[gw] == nil {
+			logging.Fatal(logConfig, "invalid read-out: unknown gateway", "gateway", gw)
+		}
+	}
+
+	var coupler *Coupler
+	if len(s.ForwardRules) > 0 {
+		for _, r := range s.ForwardRules {
+			if gws[r.From] == nil || gws[r.To] == nil || r.From == r.To {
+				logging.Fatal(logConfig, "invalid forwarding rule: unknown gateway", "from", r.From, "to", r.To)
+			}
+		}
+		coupler = NewCoupler(s.ForwardRules)
+	}
+
+	var dedup *Deduplicator
+	if s.DedupWindow > 0 {
+		dedup = NewDeduplicator(s.DedupWindow, outChan)
 	}
 
 	for _, gw := range gateways {
 		go func(gwName string) {
-			for {
-				if s.Debug {
-					log.Printf("Stablishing connection to KNX gateway %s...\n", gwName)
-				}
-				client, err := knx.NewGroupTunnel(gwName, knx.DefaultTunnelConfig)
+			for ctx.Err() == nil {
+				logKNX.Debug("connecting to gateway", "gateway", gwName)
+				client, err := s.dialGateway(gwName)
 				if err != nil {
-					log.Printf("KNX: Could not connect to %q: %v", gw, err)
-					if s.Debug {
-						log.Printf("Sleeping %s...", KNXTimeout/4)
-					}
+					s.metrics.Add("knx2mqtt_knx_connect_errors_total", 1, "gateway", gwName)
+					logKNX.Error("could not connect", "gateway", gwName, "error", err, "retry", KNXTimeout/4)
 					time.Sleep(KNXTimeout / 4)
 					continue
 				}
-				defer client.Close()
+				mu.Lock()
 				gws[gwName].Client = client
+				mu.Unlock()
+				s.metrics.Add("knx2mqtt_knx_connects_total", 1, "gateway", gwName)
+				s.metrics.Set("knx2mqtt_knx_connected", 1, "gateway", gwName)
+				logKNX.Info("connected", "gateway", gwName)
+				if ranges := s.Readouts[gwName]; len(ranges) > 0 {
+					// only one read-out at a time: a new connection starts it again
+					readoutCtx, cancel := context.WithCancel(ctx)
+					mu.Lock()
+					if gws[gwName].stopReadout != nil {
+						gws[gwName].stopReadout()
+					}
+					gws[gwName].stopReadout = cancel
+					mu.Unlock()
+					go s.readout(readoutCtx, gwName, ranges)
+				}
 
 				knxChan := client.Inbound()
 
@@ -75,13 +181,46 @@ func (s *Server) KNX(gateways []string) (fromKNX chan Event, toKNX chan Event) {
 				for {
 					knxEvent, ok := <-knxChan
 					if !ok {
-						log.Fatalf("error reading from KNX gateway %q", gwName)
-					}
-					if s.Debug {
-						log.Printf("KNX: Received from %q: %v", gwName, knxEvent)
+						s.metrics.Set("knx2mqtt_knx_connected", 0, "gateway", gwName)
+						if ctx.Err() != nil {
+							// closed by CloseKNX
+							return
+						}
+						logKNX.Error("connection lost; reconnecting", "gateway", gwName, "retry", KNXReconnectDelay)
+						mu.Lock()
+						gws[gwName].Client = nil
+						mu.Unlock()
+						client.Close()
+						time.Sleep(KNXReconnectDelay)
+						break knxReadLoop
 					}
+					s.metrics.Add("knx2mqtt_knx_telegrams_total", 1, "gateway", gwName, "command", knxEvent.Command.String(), "direction", "in")
+					logKNX.Debug("received", "gateway", gwName, "direction", "in", "command", knxEvent.Command.String(),
+						"source", knxEvent.Source.String(), "ga", knxEvent.Destination.String(), "data", fmt.Sprint(knxEvent.Data))
 					event := toEvent(gwName, knxEvent)
-					outChan <- event
+					mu.Lock()
+					if knxEvent.Command == knx.GroupResponse {
+						delete(gws[gwName].Readout, knxEvent.Destination)
+					}
+					if gws[gwName].Lines == nil {
+						gws[gwName].Lines = make(map[uint16]bool)
+					}
+					gws[gwName].Lines[uint16(knxEvent.Source)>>8] = true
+					mu.Unlock()
+					if coupler != nil {
+						for _, target := range coupler.Targets(event) {
+							logKNX.Debug("forwarding", "gateway", gwName, "to", target, "command", knxEvent.Command.String(), "ga", knxEvent.Destination.String())
+							if !gws[target].Queue.Push(knxEvent, PriorityNormal, OriginForward, nil) {
+								logKNX.Warn("transmit queue full; dropping forwarded telegram", "gateway", target,
+									"command", knxEvent.Command.String(), "ga", knxEvent.Destination.String())
+							}
+						}
+					}
+					if dedup != nil {
+						dedup.Add(event)
+					} else {
+						outChan <- event
+					}
 					for _, addr := range gws[gwName].Addresses {
 						if addr == knxEvent.Destination {
 							continue knxReadLoop
@@ -90,20 +229,64 @@ func (s *Server) KNX(gateways []string) (fromKNX chan Event, toKNX chan Event) {
 					// we only lock on writing because the other threads do not modify the slice
 					mu.Lock()
 					gws[gwName].Addresses = append(gws[gwName].Addresses, knxEvent.Destination)
-					if s.Debug {
-						log.Printf("gws[%q].Addresses has %d entries", gwName, len(gws[gwName].Addresses))
-					}
+					logKNX.Debug("new group address seen", "gateway", gwName, "ga", knxEvent.Destination.String(), "addresses", len(gws[gwName].Addresses))
 					mu.Unlock()
 				}
 			}
 		}(gw)
 	}
+	if logKNX.Enabled(context.Background(), slog.LevelDebug) {
+		go func() {
+			for range time.Tick(time.Minute) {
+				for _, gw := range gateways {
+					stats := gws[gw].Queue.Stats()
+					logKNX.Debug("transmit queue", "gateway", gw, "queued", stats.Queued, "sent", stats.Sent,
+						"discarded", stats.Discarded, "coalesced", stats.Coalesced, "dropped", stats.Dropped, "length", stats.Length)
+				}
+			}
+		}()
+	}
+
+	// Transmitters: one per gateway, sending telegrams from its queue
+	for _, gw := range gateways {
+		go func(gwName string) {
+			queue := gws[gwName].Queue
+			for {
+				qe := queue.Pop()
+				groupEvent := qe.GroupEvent
+				mu.Lock()
+				client := gws[gwName].Client
+				mu.Unlock()
+				if client == nil {
+					logKNX.Warn("not connected; discarding telegram", "gateway", gwName, "command", groupEvent.Command.String(), "ga", groupEvent.Destination.String())
+					qe.done("discarded", errors.New("gateway not connected"))
+					queue.Done(false)
+					continue
+				}
+				logKNX.Debug("sending", "gateway", gwName, "direction", "out", "command", groupEvent.Command.String(),
+					"ga", groupEvent.Destination.String(), "data", fmt.Sprint(groupEvent.Data))
+				err := client.Send(groupEvent)
+				queue.Done(err == nil)
+				if err != nil {
+					s.metrics.Add("knx2mqtt_knx_send_errors_total", 1, "gateway", gwName)
+					qe.done("error", err)
+					// closing the connection makes the reader reconnect
+					logKNX.Error("error writing to gateway; reconnecting", "gateway", gwName, "error", err)
+					client.Close()
+					continue
+				}
+				qe.done("sent", nil)
+				s.metrics.Add("knx2mqtt_knx_telegrams_total", 1, "gateway", gwName, "command", groupEvent.Command.String(), "direction", "out")
+				s.metrics.Observe("knx2mqtt_knx_delivery_seconds", time.Since(qe.Queued).Seconds(), "gateway", gwName, "origin", qe.Origin)
+			}
+		}(gw)
+	}
 	go func() {
 		for {
 			event := <-inChan
 			addr := event.Destination
 			var mask cemi.GroupAddr
-			var client *knx.GroupTunnel
+			var gateway string
 			mu.Lock()
 		knxCheckLoop:
 			for i := 0; i < 16; i++ {
@@ -113,29 +296,63 @@ func (s *Server) KNX(gateways []string) (fromKNX chan Event, toKNX chan Event) {
 				for _, gw := range gateways {
 					for _, gaddr := range gws[gw].Addresses {
 						if check == (gaddr & mask) {
-							if s.Debug {
-								log.Printf("(i=%d) wanna write to %s; %q sent packet to %s :)", i, addr, gw, gaddr)
-							}
-							client = &gws[gw].Client
+							logKNX.Debug("gateway chosen", "gateway", gw, "ga", addr.String(), "seen", gaddr.String(), "bits", i)
+							gateway = gw
 							break knxCheckLoop
 						}
 					}
 				}
 			}
 			mu.Unlock()
-			if client != nil {
-				groupEvent := event.GroupEvent
-				if s.Debug {
-					log.Printf("sending %v", groupEvent)
-				}
-				err := client.Send(groupEvent)
-				if err != nil {
-					log.Fatalf("error writing to KNX gateway: %v", err)
-				}
-
+			if gateway == "" {
+				logKNX.Warn("no gateway for group address; discarding telegram", "command", event.Command.String(), "ga", addr.String())
+				s.audit.Record(event, "", "no gateway", nil)
+				continue
+			}
+			queue := gws[gateway].Queue
+			done := func(status string, err error) {
+				s.audit.Record(event, gateway, status, err)
+			}
+			if !queue.Push(event.GroupEvent, event.Priority, OriginMQTT, done) {
+				logKNX.Warn("transmit queue full; dropping telegram", "gateway", gateway, "command", event.Command.String(),
+					"ga", event.Destination.String(), "dropped", queue.Stats().Dropped)
 			}
 		}
 	}()
 
+	s.toKNX = inChan
+
 	return outChan, inChan
 }
+
+// CloseKNX waits until all the pending telegrams have been sent
+// (or ctx expires) and then disconnects from all the gateways.
+func (s *Server) CloseKNX(ctx context.Context) {
+drainLoop:
+	for {
+		drained := len(s.toKNX) == 0
+		for _, gw := range s.gws {
+			if !gw.Queue.Drained() {
+				drained = false
+			}
+		}
+		if drained {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			logKNX.Warn("shutdown timeout; discarding pending telegrams")
+			break drainLoop
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name, gw := range s.gws {
+		if gw.Client != nil {
+			logKNX.Info("disconnecting", "gateway", name)
+			gw.Client.Close()
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vapourismo/knx-go/knx"
+	"github.com/vapourismo/knx-go/knx/cemi"
+)
+
+const (
+	KNXDDefaultPort = 6720
+	KNXDTimeout     = 10 * time.Second // to connect and open the group socket
+)
+
+// Message types of the eibd/knxd client protocol
+const (
+	eibOpenGroupCon = 0x0026
+	eibGroupPacket  = 0x0027
+)
+
+// KNXDConn is a connection to a knxd (or eibd) server, speaking its client
+// protocol in group socket mode: it receives all the group telegrams and
+// can send to any group address.
+type KNXDConn struct {
+	conn    net.Conn
+	mu      sync.Mutex // serializes writes
+	inbound chan knx.GroupEvent
+}
+
+// knxdGateway returns the address of a knxd server if gw has the form
+// "knxd://host[:port]" or "knxd:///path/to/socket".
+func knxdGateway(gw string) (addr string, ok bool) {
+	if !strings.HasPrefix(gw, "knxd://") {
+		return "", false
+	}
+	return strings.TrimPrefix(gw, "knxd://"), true
+}
+
+// DialKNXD connects to a knxd server, in a TCP address ("host[:port]")
+// or a unix socket (any address starting with "/"), and opens a group socket.
+func DialKNXD(addr string) (*KNXDConn, error) {
+	network := "tcp"
+	if strings.HasPrefix(addr, "/") {
+		network = "unix"
+	} else if !strings.Contains(addr, ":") {
+		addr = fmt.Sprintf("%s:%d", addr, KNXDDefaultPort)
+	}
+	conn, err := net.DialTimeout(network, addr, KNXDTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &KNXDConn{conn: conn, inbound: make(chan knx.GroupEvent)}
+
+	// reserved, write-only flag and reserved
+	if err := c.writePacket(eibOpenGroupCon, []byte{0, 0, 0}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Now().Add(KNXDTimeout))
+	typ, _, err := c.readPacket()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if typ != eibOpenGroupCon {
+		conn.Close()
+		return nil, fmt.Errorf("knxd refused to open group socket (reply 0x%04x)", typ)
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	go c.serve()
+	return c, nil
+}
+
+// writePacket sends a message: its length, type and payload.
+func (c *KNXDConn) writePacket(typ uint16, payload []byte) error {
+	buf := make([]byte, 4+len(payload))
+	binary.BigEndian.PutUint16(buf[0:], uint16(2+len(payload)))
+	binary.BigEndian.PutUint16(buf[2:], typ)
+	copy(buf[4:], payload)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := c.conn.Write(buf)
+	return err
+}
+
+// readPacket receives a message and returns its type and payload.
+func (c *KNXDConn) readPacket() (uint16, []byte, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(c.conn, head[:]); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint16(head[:])
+	if n < 2 {
+		return 0, nil, errors.New("invalid knxd message")
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(c.conn, buf); err != nil {
+		return 0, nil, err
+	}
+	return binary.BigEndian.Uint16(buf), buf[2:], nil
+}
+
+// serve reads group packets until the connection is closed.
+func (c *KNXDConn) serve() {
+	defer close(c.inbound)
+	for {
+		typ, payload, err := c.readPacket()
+		if err != nil {
+			logKNX.Debug("knxd connection closed", "error", err)
+			return
+		}
+		// source (2 bytes), destination (2 bytes) and APDU (at least 2 bytes)
+		if typ != eibGroupPacket || len(payload) < 6 {
+			continue
+		}
+		apdu := payload[4:]
+		cmd := knx.GroupCommand((apdu[0]&3)<<2 | apdu[1]>>6)
+		if !cemi.APCI(cmd).IsGroupCommand() {
+			continue
+		}
+		// as in knx-go, the first data byte holds the 6 bits after the APCI
+		data := make([]byte, len(apdu)-1)
+		copy(data, apdu[1:])
+		data[0] &= 63
+		c.inbound <- knx.GroupEvent{
+			Command:     cmd,
+			Source:      cemi.IndividualAddr(binary.BigEndian.Uint16(payload[0:])),
+			Destination: cemi.GroupAddr(binary.BigEndian.Uint16(payload[2:])),
+			Data:        data,
+		}
+	}
+}
+
+// Send a group telegram.  Its source address is set by knxd.
+func (c *KNXDConn) Send(event knx.GroupEvent) error {
+	payload := make([]byte, 4, 4+len(event.Data)+1)
+	binary.BigEndian.PutUint16(payload[0:], uint16(event.Destination))
+	payload[2] = byte(event.Command>>2) & 3
+	payload[3] = byte(event.Command&3) << 6
+	if len(event.Data) > 0 {
+		payload[3] |= event.Data[0] & 63
+		payload = append(payload, event.Data[1:]...)
+	}
+	return c.writePacket(eibGroupPacket, payload)
+}
+
+// Inbound returns the channel on which group telegrams are received.
+// It is closed when the connection is lost.
+func (c *KNXDConn) Inbound() <-chan knx.GroupEvent {
+	return c.inbound
+}
+
+// Close closes the connection to knxd.
+func (c *KNXDConn) Close() {
+	c.conn.Close()
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/vapourismo/knx-go/knx"
+	"github.com/vapourismo/knx-go/knx/cemi"
+)
+
+// startKNXD starts a stand-in for a knxd server, and returns its address
+// and a channel with the connections which have opened a group socket.
+// Both ends of a connection speak the same protocol, so the server side
+// uses a KNXDConn too, without serving it.
+func startKNXD(t *testing.T) (string, chan *KNXDConn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conns := make(chan *KNXDConn, 4)
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c := &KNXDConn{conn: conn}
+			t.Cleanup(c.Close)
+			typ, _, err := c.readPacket()
+			if err != nil || typ != eibOpenGroupCon {
+				t.Errorf("expected open group socket: 0x%04x %v", typ, err)
+				conn.Close()
+				continue
+			}
+			c.writePacket(eibOpenGroupCon, nil)
+			conns <- c
+		}
+	}()
+	return ln.Addr().String(), conns
+}
+
+func acceptKNXD(t *testing.T, conns chan *KNXDConn, timeout time.Duration) *KNXDConn {
+	t.Helper()
+	select {
+	case c := <-conns:
+		return c
+	case <-time.After(timeout):
+		t.Fatal("no connection to knxd")
+		return nil
+	}
+}
+
+// expectPacket reads a group packet sent to the stand-in server.
+func expectPacket(t *testing.T, c *KNXDConn, payload []byte) {
+	t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	typ, p, err := c.readPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if typ != eibGroupPacket || !bytes.Equal(p, payload) {
+		t.Errorf("received 0x%04x % x, want % x", typ, p, payload)
+	}
+}
+
+func TestKNXD(t *testing.T) {
+	addr, conns := startKNXD(t)
+	conn, err := DialKNXD(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	server := acceptKNXD(t, conns, time.Second)
+
+	// GroupValueWrite 1 from 1.1.5 to 5/0/27
+	server.writePacket(eibGroupPacket, []byte{0x11, 0x05, 0x28, 0x1b, 0x00, 0x81})
+	select {
+	case e := <-conn.Inbound():
+		want := knx.GroupEvent{Command: knx.GroupWrite, Source: 0x1105, Destination: cemi.NewGroupAddr3(5, 0, 27), Data: []byte{1}}
+		if e.Command != want.Command || e.Source != want.Source || e.Destination != want.Destination || !bytes.Equal(e.Data, want.Data) {
+			t.Errorf("received %+v", e)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no group event received")
+	}
+
+	err = conn.Send(knx.GroupEvent{Command: knx.GroupWrite, Destination: cemi.NewGroupAddr3(1, 2, 3), Data: []byte{0, 0x0c, 0x1a}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectPacket(t, server, []byte{0x0a, 0x03, 0x00, 0x80, 0x0c, 0x1a})
+
+	// the inbound channel is closed when knxd closes the connection
+	server.Close()
+	select {
+	case _, ok := <-conn.Inbound():
+		if ok {
+			t.Error("group event received after closing")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("inbound channel not closed")
+	}
+}
+
+func TestKNXDReconnect(t *testing.T) {
+	addr, conns := startKNXD(t)
+	gw := "knxd://" + addr
+	readout, err := ParseGroupRange("1/2/3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{Readouts: map[string][]GroupRange{gw: {readout}}, ReadTimeout: time.Second}
+	ctx, cancel := context.WithCancel(context.Background())
+	fromKNX, _ := s.KNX(ctx, []string{gw})
+	defer func() {
+		cancel()
+		s.CloseKNX(ctx)
+	}()
+
+	// GroupValueRead to 1/2/3
+	read := []byte{0x0a, 0x03, 0x00, 0x00}
+	server := acceptKNXD(t, conns, time.Second)
+	expectPacket(t, server, read)
+
+	// after losing the connection, it reconnects and repeats the read-out
+	server.Close()
+	server = acceptKNXD(t, conns, KNXReconnectDelay+2*time.Second)
+	expectPacket(t, server, read)
+
+	server.writePacket(eibGroupPacket, []byte{0x11, 0x05, 0x0a, 0x03, 0x00, 0x41})
+	select {
+	case e := <-fromKNX:
+		if e.Gateway != gw || e.Command != knx.GroupResponse || e.Destination != cemi.NewGroupAddr3(1, 2, 3) {
+			t.Errorf("received %+v", e)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no event received after reconnecting")
+	}
+}
@@ -1,11 +1,18 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/cespedes/knx2mqtt/internal/logging"
+	"github.com/cespedes/knx2mqtt/internal/mqttclient"
 	"github.com/vapourismo/knx-go/knx"
 	"github.com/vapourismo/knx-go/knx/cemi"
 )
@@ -14,16 +21,34 @@ const (
 	MQTTPort = 1883
 )
 
+var (
+	logKNX    = logging.Get("knx")
+	logMQTT   = logging.Get("mqtt")
+	logConfig = logging.Get("config")
+	logBridge = logging.Get("bridge")
+)
+
 type Event struct {
-	Time    time.Time
-	Gateway string
+	Time     time.Time
+	Gateway  string
+	Gateways []string // all the gateways which have seen this telegram, if deduplicating
 	knx.GroupEvent
+
+	// Only used in read requests received from MQTT:
+	ReplyTo       string        // topic where the response will be published
+	CorrelationID string        // opaque identifier copied to the reply
+	Timeout       time.Duration // how long to wait for a response
+
+	// Only used in commands received from MQTT:
+	Priority Priority // priority in the transmit queue
+	topic    string   // topic where it was received
 }
 
 func (e Event) MarshalJSON() ([]byte, error) {
 	var tmp struct {
 		Time        time.Time
 		Gateway     string
+		Gateways    []string `json:",omitempty"`
 		Command     string
 		Source      string
 		Destination string
@@ -31,6 +56,7 @@ func (e Event) MarshalJSON() ([]byte, error) {
 	}
 	tmp.Time = e.Time.Truncate(time.Second)
 	tmp.Gateway = e.Gateway
+	tmp.Gateways = e.Gateways
 	tmp.Command = e.Command.String()
 	tmp.Source = e.Source.String()
 	tmp.Destination = e.Destination.String()
@@ -46,6 +72,11 @@ func (e *Event) UnmarshalJSON(b []byte) error {
 		Source      string
 		Destination string
 		Data        []byte
+
+		ReplyTo       string
+		CorrelationID string
+		Timeout       string
+		Priority      string
 	}
 	err := json.Unmarshal(b, &tmp)
 	if err != nil {
@@ -53,6 +84,18 @@ func (e *Event) UnmarshalJSON(b []byte) error {
 	}
 	e.Time = tmp.Time
 	e.Gateway = tmp.Gateway
+	e.ReplyTo = tmp.ReplyTo
+	e.CorrelationID = tmp.CorrelationID
+	if tmp.Timeout != "" {
+		e.Timeout, err = time.ParseDuration(tmp.Timeout)
+		if err != nil {
+			return err
+		}
+	}
+	e.Priority, err = ParsePriority(tmp.Priority)
+	if err != nil {
+		return err
+	}
 	switch tmp.Command {
 	case "read", "Read":
 		e.Command = knx.GroupRead
@@ -60,10 +103,15 @@ func (e *Event) UnmarshalJSON(b []byte) error {
 		e.Command = knx.GroupWrite
 	case "response", "Response":
 		e.Command = knx.GroupResponse
+	default:
+		return fmt.Errorf("unknown command %q", tmp.Command)
 	}
-	e.Source, err = cemi.NewIndividualAddrString(tmp.Source)
-	if err != nil {
-		return err
+	// the source is set by the gateway, so it can be omitted
+	if tmp.Source != "" {
+		e.Source, err = cemi.NewIndividualAddrString(tmp.Source)
+		if err != nil {
+			return err
+		}
 	}
 	e.Destination, err = cemi.NewGroupAddrString(tmp.Destination)
 	if err != nil {
@@ -73,87 +121,298 @@ func (e *Event) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
-func (s *Server) MQTT(server string, prefix string) (fromMQTT chan Event, toMQTT chan Event) {
+// MQTT connects to the MQTT server and returns the channels to receive
+// commands and device management requests and to publish events and replies.
+// When ctx is done, it publishes the offline status, disconnects and closes s.mqttDone.
+func (s *Server) MQTT(ctx context.Context, server string, prefix string) (fromMQTT chan Event, toMQTT chan Event, replyMQTT chan Reply, mgmtMQTT chan DeviceRequest) {
 	in := make(chan Event, 5)
 	out := make(chan Event, 5)
+	replies := make(chan Reply, 5)
+	mgmt := make(chan DeviceRequest, 5)
+	s.mqttDone = make(chan struct{})
 
 	go func() {
-		if s.Debug {
-			log.Printf("MQTT: Connecting to server %q...", server)
-		}
-		client, err := NewMQTTClient(server, MQTTPort)
+		defer close(s.mqttDone)
+		statusTopic := fmt.Sprintf("%s/status", prefix)
+
+		logMQTT.Debug("connecting", "server", server)
+		client, err := mqttclient.New(server, MQTTPort, mqttclient.Options{
+			Version: s.MQTTVersion,
+			Will: &mqttclient.Message{
+				Topic:   statusTopic,
+				Retain:  true,
+				Payload: []byte("offline"),
+			},
+		})
 		if err != nil {
-			log.Fatalf("MQTT: Could not connect to %q: %v", server, err)
+			logging.Fatal(logMQTT, "could not connect", "server", server, "error", err)
 		}
-		if s.Debug {
-			log.Printf("MQTT: Connected.")
+		logMQTT.Info("connected", "server", server, "version", s.MQTTVersion)
+		err = client.PublishRetain(statusTopic, "online")
+		if err != nil {
+			logMQTT.Error("could not publish", "topic", statusTopic, "error", err)
 		}
 
+		// Commands can be published in prefix/cmd or in prefix/cmd/<anything>,
+		// so that the policy can tell different clients apart.
 		subTopic := fmt.Sprintf("%s/cmd", prefix)
-		mqttChan, err := client.Subscribe(subTopic)
-		if err != nil {
-			log.Fatalf("MQTT: subscribing to %s: %v", subTopic, err)
+		mqttChan := make(chan *mqttclient.Message)
+		for _, topic := range []string{subTopic, subTopic + "/+"} {
+			ch, err := client.Subscribe(topic)
+			if err != nil {
+				logging.Fatal(logMQTT, "could not subscribe", "topic", topic, "error", err)
+			}
+			go func(ch chan *mqttclient.Message) {
+				for m := range ch {
+					mqttChan <- m
+				}
+			}(ch)
+		}
+		mgmtTopic := fmt.Sprintf("%s/mgmt", prefix)
+		mgmtChan := make(chan *mqttclient.Message)
+		if s.DeviceMgmt {
+			mgmtChan, err = client.Subscribe(mgmtTopic)
+			if err != nil {
+				logging.Fatal(logMQTT, "could not subscribe", "topic", mgmtTopic, "error", err)
+			}
 		}
 
 		for {
 			select {
-			case m := <-mqttChan:
-				if s.Debug {
-					log.Printf("MQTT: got MQTT packet: %v", m)
+			case <-ctx.Done():
+				err = client.PublishRetain(statusTopic, "offline")
+				if err != nil {
+					logMQTT.Error("could not publish", "topic", statusTopic, "error", err)
 				}
+				logMQTT.Info("disconnecting", "server", server)
+				client.Close()
+				return
+			case m := <-mqttChan:
+				logMQTT.Debug("received", "topic", m.Topic, "payload", string(m.Payload))
+				s.metrics.Add("knx2mqtt_mqtt_messages_total", 1, "direction", "in")
 				var e Event
-				_ = json.Unmarshal(m.Payload, &e)
-				out <- e
+				err := json.Unmarshal(m.Payload, &e)
+				e.topic = m.Topic
+				replyFromProperties(&e.ReplyTo, &e.CorrelationID, m)
+				if err != nil {
+					// e is not valid: it must not be sent to KNX
+					logMQTT.Warn("invalid command", "topic", m.Topic, "error", err, "payload", string(m.Payload))
+					if e.ReplyTo != "" {
+						go func(r Reply) { replies <- r }(Reply{topic: e.ReplyTo, CorrelationID: e.CorrelationID, Error: err.Error()})
+					}
+					continue
+				}
+				if s.CmdMaxAge > 0 && !e.Time.IsZero() && time.Since(e.Time) > s.CmdMaxAge {
+					logMQTT.Warn("discarding stale command", "age", time.Since(e.Time).Truncate(time.Second), "payload", string(m.Payload))
+					s.audit.Record(e, "", "stale", nil)
+					continue
+				}
+				select {
+				case out <- e:
+				case <-ctx.Done():
+				}
+			case m := <-mgmtChan:
+				logMQTT.Debug("received", "topic", m.Topic, "payload", string(m.Payload))
+				s.metrics.Add("knx2mqtt_mqtt_messages_total", 1, "direction", "in")
+				var req DeviceRequest
+				err := json.Unmarshal(m.Payload, &req)
+				req.topic = m.Topic
+				replyFromProperties(&req.ReplyTo, &req.CorrelationID, m)
+				if req.ReplyTo == "" {
+					req.ReplyTo = mgmtTopic + "/reply"
+				}
+				if err != nil {
+					logMQTT.Warn("invalid device management request", "error", err, "payload", string(m.Payload))
+					go func(r Reply) { replies <- r }(Reply{topic: req.ReplyTo, CorrelationID: req.CorrelationID, Error: err.Error()})
+					continue
+				}
+				select {
+				case mgmt <- req:
+				case <-ctx.Done():
+				}
 			case event := <-in:
 				topic := fmt.Sprintf("%s/%v", prefix, event.Destination)
 				b, _ := json.Marshal(event)
-				err = client.Publish(topic, string(b))
+				err = client.PublishMessage(&mqttclient.Message{
+					Topic:       topic,
+					Payload:     b,
+					ContentType: "application/json",
+					UserProperties: []mqttclient.UserProperty{
+						{Key: "gateway", Value: event.Gateway},
+						{Key: "command", Value: event.Command.String()},
+						{Key: "source", Value: event.Source.String()},
+						{Key: "ga", Value: event.Destination.String()},
+					},
+				})
+				if err != nil {
+					s.metrics.Add("knx2mqtt_mqtt_publish_errors_total", 1)
+					logMQTT.Error("could not publish", "topic", topic, "error", err)
+					break
+				}
+				s.metrics.Add("knx2mqtt_mqtt_messages_total", 1, "direction", "out")
+			case reply := <-replies:
+				b, _ := json.Marshal(reply)
+				msg := &mqttclient.Message{Topic: reply.topic, Payload: b, ContentType: "application/json"}
+				if reply.CorrelationID != "" {
+					msg.CorrelationData = []byte(reply.CorrelationID)
+				}
+				err = client.PublishMessage(msg)
+				if err != nil {
+					s.metrics.Add("knx2mqtt_mqtt_publish_errors_total", 1)
+					logMQTT.Error("could not publish", "topic", reply.topic, "error", err)
+					break
+				}
+				s.metrics.Add("knx2mqtt_mqtt_messages_total", 1, "direction", "out")
+			case record := <-s.audit.Records():
+				b, _ := json.Marshal(record)
+				err = client.PublishMessage(&mqttclient.Message{Topic: s.audit.Topic(), Payload: b, ContentType: "application/json"})
 				if err != nil {
-					log.Printf("MQTT: publishing to %s: %s", topic, err.Error())
+					s.metrics.Add("knx2mqtt_mqtt_publish_errors_total", 1)
+					logMQTT.Error("could not publish", "topic", s.audit.Topic(), "error", err)
+					break
 				}
+				s.metrics.Add("knx2mqtt_mqtt_messages_total", 1, "direction", "out")
 			}
 		}
 	}()
-	return out, in
+	s.metrics.Collect(func() {
+		s.metrics.Set("knx2mqtt_channel_backlog", float64(len(in)), "channel", "toMQTT")
+		s.metrics.Set("knx2mqtt_channel_backlog", float64(len(out)), "channel", "fromMQTT")
+		s.metrics.Set("knx2mqtt_channel_backlog", float64(len(replies)), "channel", "replies")
+		s.metrics.Set("knx2mqtt_channel_backlog", float64(len(mgmt)), "channel", "mgmt")
+	})
+	return out, in, replies, mgmt
+}
+
+// replyFromProperties takes the reply topic and correlation ID of a request
+// from the MQTT v5 properties of the message if they are not in the payload.
+func replyFromProperties(replyTo, correlationID *string, m *mqttclient.Message) {
+	if *replyTo == "" {
+		*replyTo = m.ResponseTopic
+	}
+	if *correlationID == "" {
+		*correlationID = string(m.CorrelationData)
+	}
 }
 
 type Server struct {
-	Debug bool
+	MQTTVersion mqttclient.Version
+	CmdMaxAge   time.Duration
+	KNXRate     float64
+	KNXQueueLen int
+	DedupWindow time.Duration
+	Keyring     *Keyring // credentials of the secure gateways
+
+	ForwardRules []ForwardRule
+	Policy       Policy
+	Readouts     map[string][]GroupRange
+	ReadTimeout  time.Duration
+	DeviceMgmt   bool
+
+	reads   *ReadTracker
+	metrics *Metrics
+	audit   *Auditor
+
+	mu       sync.Mutex
+	gws      map[string]*gateway
+	toKNX    chan Event
+	mqttDone chan struct{}
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "discover":
+			discoverMain(os.Args[2:])
+			return
+		case "scan":
+			scanMain(os.Args[2:])
+			return
+		}
+	}
 	config := ReadConfig()
 
 	s := &Server{}
-	s.Debug = config.Debug
+	s.MQTTVersion = config.MQTTVersion
+	s.CmdMaxAge = config.CmdMaxAge
+	s.KNXRate = config.KNXRate
+	s.KNXQueueLen = config.KNXQueueLen
+	s.DedupWindow = config.DedupWindow
+	s.Keyring = config.Keyring
+	s.ForwardRules = config.ForwardRules
+	s.Policy = config.Policy
+	s.Readouts = config.Readouts
+	s.ReadTimeout = config.ReadTimeout
+	s.DeviceMgmt = config.DeviceMgmt
 
-	// get channels to read and write to KNX network
-	if s.Debug {
-		log.Printf("connecting to KNX gateways %v\n", config.KNXGateways)
+	if config.AuditFile != "" || config.AuditTopic != "" {
+		var err error
+		s.audit, err = NewAuditor(config.AuditFile, config.AuditTopic)
+		if err != nil {
+			logging.Fatal(logConfig, "could not open audit log", "error", err)
+		}
+		defer s.audit.Close()
 	}
-	fromKNX, toKNX := s.KNX(config.KNXGateways)
 
-	// get channels to read and write MQTT messages
-	if s.Debug {
-		log.Printf("connecting to MQTT server %s\n", config.MQTTServer)
+	if config.MetricsAddr != "" {
+		s.metrics = NewMetrics()
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", s.metrics)
+		go func() {
+			err := http.ListenAndServe(config.MetricsAddr, mux)
+			logging.Fatal(logBridge, "metrics server", "error", err)
+		}()
 	}
-	fromMQTT, toMQTT := s.MQTT(config.MQTTServer, config.MQTTPrefix)
 
-	if s.Debug {
-		log.Println("waiting for packets...")
-	}
+	// get channels to read and write to KNX network
+	logBridge.Debug("connecting to KNX gateways", "gateways", config.KNXGateways)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	fromKNX, toKNX := s.KNX(ctx, config.KNXGateways)
+
+	// get channels to read and write MQTT messages
+	logBridge.Debug("connecting to MQTT server", "server", config.MQTTServer)
+	mqttCtx, stopMQTT := context.WithCancel(context.Background())
+	fromMQTT, toMQTT, replyMQTT, mgmtMQTT := s.MQTT(mqttCtx, config.MQTTServer, config.MQTTPrefix)
+	s.reads = NewReadTracker(replyMQTT, config.ReadTimeout)
+
+	logBridge.Debug("waiting for packets")
 	for {
 		select {
-		case m := <-fromKNX:
-			if s.Debug {
-				log.Printf("KNX -> MQTT: %v", m)
+		case <-ctx.Done():
+			logBridge.Info("shutting down", "timeout", config.ShutdownTimeout)
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+			defer cancel()
+			s.CloseKNX(shutdownCtx)
+			stopMQTT()
+			select {
+			case <-s.mqttDone:
+			case <-shutdownCtx.Done():
+				logMQTT.Warn("shutdown timeout; not disconnected")
 			}
+			return
+		case m := <-fromKNX:
+			logBridge.Debug("KNX -> MQTT", "gateway", m.Gateway, "command", m.Command.String(), "source", m.Source.String(), "ga", m.Destination.String())
 			toMQTT <- m
+			s.reads.Answer(m)
 		case m := <-fromMQTT:
-			if s.Debug {
-				log.Printf("MQTT -> KNX: %v", m)
+			logBridge.Debug("MQTT -> KNX", "gateway", m.Gateway, "command", m.Command.String(), "ga", m.Destination.String())
+			if err := s.Policy.Check(m); err != nil {
+				s.metrics.Add("knx2mqtt_mqtt_denied_total", 1, "command", m.Command.String())
+				logBridge.Warn("command denied", "topic", m.topic, "command", m.Command.String(), "ga", m.Destination.String(), "error", err)
+				if m.ReplyTo != "" {
+					// not blocking the main loop, which may be needed to publish it
+					go func(r Reply) { replyMQTT <- r }(Reply{topic: m.ReplyTo, CorrelationID: m.CorrelationID, Error: err.Error()})
+				}
+				s.audit.Record(m, "", "denied", err)
+				continue
+			}
+			if m.Command == knx.GroupRead && m.ReplyTo != "" {
+				s.reads.Add(m)
 			}
 			toKNX <- m
+		case req := <-mgmtMQTT:
+			s.handleDeviceRequest(req, replyMQTT)
 		}
 	}
 }
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/vapourismo/knx-go/knx"
+	"github.com/vapourismo/knx-go/knx/cemi"
+)
+
+func TestEventUnmarshal(t *testing.T) {
+	var e Event
+	err := json.Unmarshal([]byte(`{"Command":"Read","Destination":"5/0/27","ReplyTo":"myapp/reply","CorrelationID":"42","Timeout":"2s","Priority":"high"}`), &e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Command != knx.GroupRead || e.Destination != cemi.NewGroupAddr3(5, 0, 27) || e.Source != 0 {
+		t.Errorf("wrong event: %+v", e)
+	}
+	if e.ReplyTo != "myapp/reply" || e.CorrelationID != "42" || e.Timeout != 2*time.Second || e.Priority != PriorityHigh {
+		t.Errorf("wrong read request: %+v", e)
+	}
+}
+
+func TestEventUnmarshalInvalid(t *testing.T) {
+	tests := []string{
+		`{"Command":"Write","Destination":"5/0/27","Data":"AQ==","Timeout":"5","ReplyTo":"myapp/reply"}`,
+		`{"Command":"Write","Destination":"5/0/27","Data":"AQ==","Priority":"urgent","ReplyTo":"myapp/reply"}`,
+		`{"Command":"Switch","Destination":"5/0/27","Data":"AQ==","ReplyTo":"myapp/reply"}`,
+		`{"Command":"Write","Destination":"here","Data":"AQ==","ReplyTo":"myapp/reply"}`,
+		`{"Command":"Write","Source":"me","Destination":"5/0/27","Data":"AQ==","ReplyTo":"myapp/reply"}`,
+	}
+	for _, payload := range tests {
+		var e Event
+		if err := json.Unmarshal([]byte(payload), &e); err == nil {
+			t.Errorf("%s: no error", payload)
+		}
+		// needed to publish the error
+		if e.ReplyTo != "myapp/reply" {
+			t.Errorf("%s: ReplyTo not set", payload)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Buckets (in seconds) used in all the histograms.
+var metricsBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type metricKey struct {
+	name   string
+	labels string
+}
+
+type histogram struct {
+	counts []uint64 // one for each bucket
+	count  uint64
+	sum    float64
+}
+
+// Metrics keeps counters, gauges and histograms and exports them in the
+// Prometheus text format.  All its methods can be called on a nil *Metrics,
+// doing nothing.
+type Metrics struct {
+	mu         sync.Mutex
+	types      map[string]string
+	help       map[string]string
+	values     map[metricKey]float64
+	histograms map[metricKey]*histogram
+	collectors []func()
+}
+
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		types:      make(map[string]string),
+		help:       make(map[string]string),
+		values:     make(map[metricKey]float64),
+		histograms: make(map[metricKey]*histogram),
+	}
+	m.describe("knx2mqtt_knx_telegrams_total", "counter", "KNX telegrams received (in) or sent (out), per gateway and command.")
+	m.describe("knx2mqtt_knx_connects_total", "counter", "Successful connections to each KNX gateway.")
+	m.describe("knx2mqtt_knx_connect_errors_total", "counter", "Failed connection attempts to each KNX gateway.")
+	m.describe("knx2mqtt_knx_connected", "gauge", "Whether each KNX gateway is connected.")
+	m.describe("knx2mqtt_knx_send_errors_total", "counter", "Errors sending telegrams to each KNX gateway.")
+	m.describe("knx2mqtt_knx_delivery_seconds", "histogram", "Time from a telegram being queued to it being sent to KNX, per gateway and origin (mqtt, forward or readout).")
+	m.describe("knx2mqtt_queue_length", "gauge", "Telegrams waiting in the transmit queue of each gateway.")
+	m.describe("knx2mqtt_queue_telegrams_total", "counter", "Telegrams in the transmit queue of each gateway, by result.")
+	m.describe("knx2mqtt_mqtt_messages_total", "counter", "MQTT messages received (in) or published (out).")
+	m.describe("knx2mqtt_mqtt_denied_total", "counter", "MQTT commands denied by the policy.")
+	m.describe("knx2mqtt_mqtt_publish_errors_total", "counter", "Errors publishing MQTT messages.")
+	m.describe("knx2mqtt_channel_backlog", "gauge", "Events waiting in each internal channel.")
+	return m
+}
+
+func (m *Metrics) describe(name, typ, help string) {
+	m.types[name] = typ
+	m.help[name] = help
+}
+
+// labelString builds the label set from a list of name, value pairs.
+func labelString(labels []string) string {
+	var b strings.Builder
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		v := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labels[i+1])
+		fmt.Fprintf(&b, "%s=\"%s\"", labels[i], v)
+	}
+	return b.String()
+}
+
+// Add increments a counter.  labels is a list of name, value pairs.
+func (m *Metrics) Add(name string, v float64, labels ...string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.values[metricKey{name, labelString(labels)}] += v
+	m.mu.Unlock()
+}
+
+// Set sets the value of a gauge.  labels is a list of name, value pairs.
+func (m *Metrics) Set(name string, v float64, labels ...string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.values[metricKey{name, labelString(labels)}] = v
+	m.mu.Unlock()
+}
+
+// Observe adds a value to a histogram.  labels is a list of name, value pairs.
+func (m *Metrics) Observe(name string, v float64, labels ...string) {
+	if m == nil {
+		return
+	}
+	key := metricKey{name, labelString(labels)}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h := m.histograms[key]
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(metricsBuckets))}
+		m.histograms[key] = h
+	}
+	for i, le := range metricsBuckets {
+		if v <= le {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// Collect registers a function to be called before exporting the metrics,
+// to update the gauges which are not updated by themselves.
+func (m *Metrics) Collect(f func()) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.collectors = append(m.collectors, f)
+	m.mu.Unlock()
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	collectors := m.collectors
+	m.mu.Unlock()
+	for _, f := range collectors {
+		f()
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	series := make(map[string][]string)
+	for k := range m.values {
+		series[k.name] = append(series[k.name], k.labels)
+	}
+	for k := range m.histograms {
+		series[k.name] = append(series[k.name], k.labels)
+	}
+	var names []string
+	for name := range series {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, name := range names {
+		if m.help[name] != "" {
+			fmt.Fprintf(w, "# HELP %s %s\n", name, m.help[name])
+			fmt.Fprintf(w, "# TYPE %s %s\n", name, m.types[name])
+		}
+		labels := series[name]
+		sort.Strings(labels)
+		for _, l := range labels {
+			key := metricKey{name, l}
+			braces, sep := "", ""
+			if l != "" {
+				braces, sep = "{"+l+"}", ","
+			}
+			if h, ok := m.histograms[key]; ok {
+				for i, le := range metricsBuckets {
+					fmt.Fprintf(w, "%s_bucket{%s%sle=\"%g\"} %d\n", name, l, sep, le, h.counts[i])
+				}
+				fmt.Fprintf(w, "%s_bucket{%s%sle=\"+Inf\"} %d\n", name, l, sep, h.count)
+				fmt.Fprintf(w, "%s_sum%s %g\n", name, braces, h.sum)
+				fmt.Fprintf(w, "%s_count%s %d\n", name, braces, h.count)
+				continue
+			}
+			fmt.Fprintf(w, "%s%s %g\n", name, braces, m.values[key])
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMetricsFormat(t *testing.T) {
+	m := NewMetrics()
+	m.Add("knx2mqtt_knx_telegrams_total", 2, "gateway", "10.0.0.1:3671", "command", "Write", "direction", "in")
+	m.Add("knx2mqtt_knx_telegrams_total", 1, "gateway", "10.0.0.1:3671", "command", "Write", "direction", "in")
+	m.Add("knx2mqtt_mqtt_denied_total", 1, "command", "a \"quoted\\\" name\nwith lines")
+	m.Set("knx2mqtt_knx_connected", 1, "gateway", "knxd://localhost")
+	m.Set("knx2mqtt_undescribed", 0.5)
+	m.Observe("knx2mqtt_knx_delivery_seconds", 0.02, "gateway", "gw", "origin", OriginMQTT)
+	m.Observe("knx2mqtt_knx_delivery_seconds", 3, "gateway", "gw", "origin", OriginMQTT)
+	m.Observe("knx2mqtt_knx_delivery_seconds", 20, "gateway", "gw", "origin", OriginMQTT)
+	m.Observe("knx2mqtt_knx_delivery_seconds", 0.001, "gateway", "gw", "origin", OriginReadout)
+	collected := false
+	m.Collect(func() {
+		collected = true
+		m.Set("knx2mqtt_queue_length", 7, "gateway", "gw")
+	})
+
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if !collected {
+		t.Error("collector not called")
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "text/plain; version=0.0.4" {
+		t.Errorf("content type %q", ct)
+	}
+	want := `# HELP knx2mqtt_knx_connected Whether each KNX gateway is connected.
+# TYPE knx2mqtt_knx_connected gauge
+knx2mqtt_knx_connected{gateway="knxd://localhost"} 1
+# HELP knx2mqtt_knx_delivery_seconds Time from a telegram being queued to it being sent to KNX, per gateway and origin (mqtt, forward or readout).
+# TYPE knx2mqtt_knx_delivery_seconds histogram
+knx2mqtt_knx_delivery_seconds_bucket{gateway="gw",origin="mqtt",le="0.005"} 0
+knx2mqtt_knx_delivery_seconds_bucket{gateway="gw",origin="mqtt",le="0.01"} 0
+knx2mqtt_knx_delivery_seconds_bucket{gateway="gw",origin="mqtt",le="0.025"} 1
+knx2mqtt_knx_delivery_seconds_bucket{gateway="gw",origin="mqtt",le="0.05"} 1
+knx2mqtt_knx_delivery_seconds_bucket{gateway="gw",origin="mqtt",le="0.1"} 1
+knx2mqtt_knx_delivery_seconds_bucket{gateway="gw",origin="mqtt",le="0.25"} 1
+knx2mqtt_knx_delivery_seconds_bucket{gateway="gw",origin="mqtt",le="0.5"} 1
+knx2mqtt_knx_delivery_seconds_bucket{gateway="gw",origin="mqtt",le="1"} 1
+knx2mqtt_knx_delivery_seconds_bucket{gateway="gw",origin="mqtt",le="2.5"} 1
+knx2mqtt_knx_delivery_seconds_bucket{gateway="gw",origin="mqtt",le="5"} 2
+knx2mqtt_knx_delivery_seconds_bucket{gateway="gw",origin="mqtt",le="10"} 2
+knx2mqtt_knx_delivery_seconds_bucket{gateway="gw",origin="mqtt",le="+Inf"} 3
+knx2mqtt_knx_delivery_seconds_sum{gateway="gw",origin="mqtt"} 23.02
+knx2mqtt_knx_delivery_seconds_count{gateway="gw",origin="mqtt"} 3
+knx2mqtt_knx_delivery_seconds_bucket{gateway="gw",origin="readout",le="0.005"} 1
+knx2mqtt_knx_delivery_seconds_bucket{gateway="gw",origin="readout",le="0.01"} 1
+knx2mqtt_knx_delivery_seconds_bucket{gateway="gw",origin="readout",le="0.025"} 1
+knx2mqtt_knx_delivery_seconds_bucket{gateway="gw",origin="readout",le="0.05"} 1
+knx2mqtt_knx_delivery_seconds_bucket{gateway="gw",origin="readout",le="0.1"} 1
+knx2mqtt_knx_delivery_seconds_bucket{gateway="gw",origin="readout",le="0.25"} 1
+knx2mqtt_knx_delivery_seconds_bucket{gateway="gw",origin="readout",le="0.5"} 1
+knx2mqtt_knx_delivery_seconds_bucket{gateway="gw",origin="readout",le="1"} 1
+knx2mqtt_knx_delivery_seconds_bucket{gateway="gw",origin="readout",le="2.5"} 1
+knx2mqtt_knx_delivery_seconds_bucket{gateway="gw",origin="readout",le="5"} 1
+knx2mqtt_knx_delivery_seconds_bucket{gateway="gw",origin="readout",le="10"} 1
+knx2mqtt_knx_delivery_seconds_bucket{gateway="gw",origin="readout",le="+Inf"} 1
+knx2mqtt_knx_delivery_seconds_sum{gateway="gw",origin="readout"} 0.001
+knx2mqtt_knx_delivery_seconds_count{gateway="gw",origin="readout"} 1
+# HELP knx2mqtt_knx_telegrams_total KNX telegrams received (in) or sent (out), per gateway and command.
+# TYPE knx2mqtt_knx_telegrams_total counter
+knx2mqtt_knx_telegrams_total{gateway="10.0.0.1:3671",command="Write",direction="in"} 3
+# HELP knx2mqtt_mqtt_denied_total MQTT commands denied by the policy.
+# TYPE knx2mqtt_mqtt_denied_total counter
+knx2mqtt_mqtt_denied_total{command="a \"quoted\\\" name\nwith lines"} 1
+# HELP knx2mqtt_queue_length Telegrams waiting in the transmit queue of each gateway.
+# TYPE knx2mqtt_queue_length gauge
+knx2mqtt_queue_length{gateway="gw"} 7
+knx2mqtt_undescribed 0.5
+`
+	if got := w.Body.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
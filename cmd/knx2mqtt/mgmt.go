@@ -0,0 +1,392 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/vapourismo/knx-go/knx/cemi"
+)
+
+// ManagementConn is a connection to a KNX gateway which can send and
+// receive telegrams to and from individual addresses.
+type ManagementConn interface {
+	SendTo(dst cemi.IndividualAddr, tpdu cemi.TransportUnit) error
+	PointToPoint() <-chan cemi.LData
+}
+
+// DeviceService is a device management service.
+type DeviceService string
+
+const (
+	DescriptorRead DeviceService = "DescriptorRead"
+	PropertyRead   DeviceService = "PropertyRead"
+	PropertyWrite  DeviceService = "PropertyWrite"
+	MemoryRead     DeviceService = "MemoryRead"
+	Restart        DeviceService = "Restart"
+)
+
+// ReadOnly reports whether the service does not modify the device.
+func (s DeviceService) ReadOnly() bool {
+	return s == DescriptorRead || s == PropertyRead || s == MemoryRead
+}
+
+// DeviceRequest is a device management request received from MQTT.
+type DeviceRequest struct {
+	Service  DeviceService
+	Device   cemi.IndividualAddr
+	Gateway  string // if empty, a gateway which has seen telegrams from the line of the device
+	Object   uint8  // PropertyRead, PropertyWrite: object index
+	Property uint8  // PropertyRead, PropertyWrite: property ID
+	Start    uint16 // PropertyRead, PropertyWrite: first element (default 1)
+	Count    uint8  // PropertyRead, PropertyWrite: number of elements (default 1)
+	Address  uint16 // MemoryRead
+	Length   uint8  // MemoryRead (default 1)
+	Data     []byte // PropertyWrite
+
+	ReplyTo       string
+	CorrelationID string
+	Timeout       time.Duration
+
+	topic string // topic where it was received
+}
+
+func (r *DeviceRequest) UnmarshalJSON(b []byte) error {
+	var tmp struct {
+		Service  string
+		Device   string
+		Gateway  string
+		Object   uint8
+		Property uint8
+		Start    uint16
+		Count    uint8
+		Address  uint16
+		Length   uint8
+		Data     []byte
+
+		ReplyTo       string
+		CorrelationID string
+		Timeout       string
+	}
+	err := json.Unmarshal(b, &tmp)
+	if err != nil {
+		return err
+	}
+	r.ReplyTo = tmp.ReplyTo
+	r.CorrelationID = tmp.CorrelationID
+	if tmp.Timeout != "" {
+		r.Timeout, err = time.ParseDuration(tmp.Timeout)
+		if err != nil {
+			return err
+		}
+	}
+	switch strings.ToLower(tmp.Service) {
+	case "descriptorread":
+		r.Service = DescriptorRead
+	case "propertyread":
+		r.Service = PropertyRead
+	case "propertywrite":
+		r.Service = PropertyWrite
+	case "memoryread":
+		r.Service = MemoryRead
+	case "restart":
+		r.Service = Restart
+	default:
+		return fmt.Errorf("unknown device service %q", tmp.Service)
+	}
+	r.Device, err = cemi.NewIndividualAddrString(tmp.Device)
+	if err != nil {
+		return err
+	}
+	r.Gateway = tmp.Gateway
+	r.Object = tmp.Object
+	r.Property = tmp.Property
+	r.Start = tmp.Start
+	r.Count = tmp.Count
+	r.Address = tmp.Address
+	r.Length = tmp.Length
+	r.Data = tmp.Data
+	if r.Start == 0 {
+		r.Start = 1
+	}
+	if r.Count == 0 {
+		r.Count = 1
+	}
+	if r.Length == 0 {
+		r.Length = 1
+	}
+	if r.Start > 0xfff || r.Count > 15 {
+		return errors.New("invalid property start or count")
+	}
+	if r.Length > 12 {
+		return errors.New("memory length must be at most 12")
+	}
+	if r.Service == PropertyWrite && len(r.Data) == 0 {
+		return errors.New("no data to write")
+	}
+	return nil
+}
+
+// DeviceResult is published in the reply to a successful DeviceRequest.
+type DeviceResult struct {
+	Service    DeviceService
+	Device     string
+	Gateway    string
+	Descriptor string `json:",omitempty"` // DescriptorRead: mask version, in hex
+	Data       []byte `json:",omitempty"` // PropertyRead, PropertyWrite, MemoryRead
+}
+
+// Transport layer control commands
+const (
+	tConnect    = 0
+	tDisconnect = 1
+	tAck        = 2
+	tNak        = 3
+)
+
+// Extended application layer services, sent with cemi.Escape
+const (
+	apciPropertyValueRead     = 0x15
+	apciPropertyValueResponse = 0x16
+	apciPropertyValueWrite    = 0x17
+)
+
+// deviceSession is a connection-oriented transport layer connection to a device.
+type deviceSession struct {
+	conn     ManagementConn
+	dst      cemi.IndividualAddr
+	seq      uint8
+	deadline <-chan time.Time
+}
+
+func (d *deviceSession) connect() error {
+	// discard stale telegrams
+drain:
+	for {
+		select {
+		case <-d.conn.PointToPoint():
+		default:
+			break drain
+		}
+	}
+	return d.conn.SendTo(d.dst, &cemi.ControlData{Command: tConnect})
+}
+
+func (d *deviceSession) disconnect() {
+	d.conn.SendTo(d.dst, &cemi.ControlData{Command: tDisconnect})
+}
+
+// request sends an application layer service and waits for its acknowledgement
+// and, if match is not nil, for the first response for which match returns true.
+func (d *deviceSession) request(cmd cemi.APCI, data []byte, match func(*cemi.AppData) bool) (*cemi.AppData, error) {
+	err := d.conn.SendTo(d.dst, &cemi.AppData{Numbered: true, SeqNumber: d.seq, Command: cmd, Data: data})
+	if err != nil {
+		return nil, err
+	}
+	acked := false
+	var resp *cemi.AppData
+	for !acked || (match != nil && resp == nil) {
+		var ldata cemi.LData
+		select {
+		case ldata = <-d.conn.PointToPoint():
+		case <-d.deadline:
+			if !acked {
+				return nil, errors.New("timeout waiting for acknowledgement")
+			}
+			return nil, errors.New("timeout waiting for response")
+		}
+		if ldata.Source != d.dst {
+			continue
+		}
+		switch tpdu := ldata.Data.(type) {
+		case *cemi.ControlData:
+			switch {
+			case tpdu.Command == tDisconnect:
+				return nil, errors.New("device closed the connection")
+			case tpdu.Command == tNak && tpdu.SeqNumber == d.seq:
+				return nil, errors.New("negative acknowledgement")
+			case tpdu.Command == tAck && tpdu.SeqNumber == d.seq:
+				acked = true
+			}
+		case *cemi.AppData:
+			if !tpdu.Numbered {
+				continue
+			}
+			d.conn.SendTo(d.dst, &cemi.ControlData{Numbered: true, SeqNumber: tpdu.SeqNumber, Command: tAck})
+			if match != nil && resp == nil && match(tpdu) {
+				resp = tpdu
+			}
+		}
+	}
+	d.seq = (d.seq + 1) & 15
+	return resp, nil
+}
+
+// readDescriptor reads the device descriptor (type 0, mask version).
+func (d *deviceSession) readDescriptor() ([]byte, error) {
+	resp, err := d.request(cemi.MaskVersionRead, []byte{0}, func(app *cemi.AppData) bool {
+		return app.Command == cemi.MaskVersionResponse && len(app.Data) >= 3
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Data[1:3], nil
+}
+
+// property reads some elements of a property or, if data is not nil, writes them.
+// It returns the value of the elements.
+func (d *deviceSession) property(object, property uint8, start uint16, count uint8, data []byte) ([]byte, error) {
+	apci := byte(apciPropertyValueRead)
+	if data != nil {
+		apci = apciPropertyValueWrite
+	}
+	req := append([]byte{apci, object, property, count<<4 | byte(start>>8), byte(start)}, data...)
+	resp, err := d.request(cemi.Escape, req, func(app *cemi.AppData) bool {
+		return app.Command == cemi.Escape && len(app.Data) >= 5 && app.Data[0]&63 == apciPropertyValueResponse &&
+			app.Data[1] == object && app.Data[2] == property
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Data[3]>>4 == 0 {
+		return nil, errors.New("property not available or access denied")
+	}
+	return resp.Data[5:], nil
+}
+
+// readMemory reads length bytes of memory, starting at address.
+func (d *deviceSession) readMemory(address uint16, length uint8) ([]byte, error) {
+	resp, err := d.request(cemi.MemoryRead, []byte{length, byte(address >> 8), byte(address)}, func(app *cemi.AppData) bool {
+		return app.Command == cemi.MemoryResponse && len(app.Data) >= 3 &&
+			uint16(app.Data[1])<<8|uint16(app.Data[2]) == address
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Data[0]&63 == 0 {
+		return nil, errors.New("memory not available or access denied")
+	}
+	return resp.Data[3:], nil
+}
+
+// restart sends a basic restart, which does not have a response.
+func (d *deviceSession) restart() error {
+	_, err := d.request(cemi.Restart, []byte{0}, nil)
+	return err
+}
+
+// deviceGateway chooses the gateway to send a device management request.
+func (s *Server) deviceGateway(req DeviceRequest) (string, error) {
+	if req.Gateway != "" {
+		gw := gatewayAddr(req.Gateway)
+		if s.gws[gw] == nil {
+			return "", fmt.Errorf("unknown gateway %s", req.Gateway)
+		}
+		return gw, nil
+	}
+	var names []string
+	for name := range s.gws {
+		names = append(names, name)
+	}
+	if len(names) == 1 {
+		return names[0], nil
+	}
+	sort.Strings(names)
+	line := uint16(req.Device) >> 8
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, name := range names {
+		if s.gws[name].Lines[line] {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("no gateway has seen telegrams from line %d.%d; Gateway must be specified", line>>4, line&15)
+}
+
+// handleDeviceRequest checks a device management request received from MQTT
+// against the policy and, if allowed, sends it.  The reply is sent to replies
+// without blocking the caller, which may be needed to publish it.
+func (s *Server) handleDeviceRequest(req DeviceRequest, replies chan<- Reply) {
+	logBridge.Info("device management request", "topic", req.topic, "device", req.Device.String(), "service", string(req.Service))
+	if err := s.Policy.CheckDevice(req); err != nil {
+		s.metrics.Add("knx2mqtt_mqtt_denied_total", 1, "command", string(req.Service))
+		logBridge.Warn("device management request denied", "topic", req.topic, "device", req.Device.String(), "error", err)
+		go func(r Reply) { replies <- r }(Reply{topic: req.ReplyTo, CorrelationID: req.CorrelationID, Error: err.Error()})
+		s.audit.RecordDevice(req, "", "denied", err)
+		return
+	}
+	go func() {
+		replies <- s.manage(req)
+	}()
+}
+
+// manage sends a device management request and returns the reply to publish.
+func (s *Server) manage(req DeviceRequest) Reply {
+	reply := Reply{topic: req.ReplyTo, CorrelationID: req.CorrelationID}
+	gwName, err := s.deviceGateway(req)
+	if err == nil {
+		reply.Device, err = s.deviceRequest(gwName, req)
+	}
+	if err != nil {
+		logBridge.Warn("device management request failed", "gateway", gwName, "device", req.Device.String(), "service", string(req.Service), "error", err)
+		reply.Error = err.Error()
+		s.audit.RecordDevice(req, gwName, "error", err)
+		return reply
+	}
+	s.audit.RecordDevice(req, gwName, "sent", nil)
+	return reply
+}
+
+func (s *Server) deviceRequest(gwName string, req DeviceRequest) (*DeviceResult, error) {
+	gw := s.gws[gwName]
+	s.mu.Lock()
+	client := gw.Client
+	s.mu.Unlock()
+	if client == nil {
+		return nil, errors.New("gateway not connected")
+	}
+	conn, ok := client.(ManagementConn)
+	if !ok {
+		return nil, errors.New("gateway does not support device management")
+	}
+
+	// only one connection at a time through each gateway
+	gw.mgmtMu.Lock()
+	defer gw.mgmtMu.Unlock()
+
+	timeout := req.Timeout
+	if timeout <= 0 {
+		timeout = s.ReadTimeout
+	}
+	logKNX.Debug("device management request", "gateway", gwName, "device", req.Device.String(), "service", string(req.Service))
+	d := &deviceSession{conn: conn, dst: req.Device, deadline: time.After(timeout)}
+	if err := d.connect(); err != nil {
+		return nil, err
+	}
+	defer d.disconnect()
+
+	result := &DeviceResult{Service: req.Service, Device: req.Device.String(), Gateway: gwName}
+	var err error
+	switch req.Service {
+	case DescriptorRead:
+		result.Data, err = d.readDescriptor()
+		if err == nil {
+			result.Descriptor = fmt.Sprintf("%04X", result.Data)
+		}
+	case PropertyRead:
+		result.Data, err = d.property(req.Object, req.Property, req.Start, req.Count, nil)
+	case PropertyWrite:
+		result.Data, err = d.property(req.Object, req.Property, req.Start, req.Count, req.Data)
+	case MemoryRead:
+		result.Data, err = d.readMemory(req.Address, req.Length)
+	case Restart:
+		err = d.restart()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vapourismo/knx-go/knx"
+	"github.com/vapourismo/knx-go/knx/cemi"
+)
+
+// fakeDevice is a ManagementConn (and a GroupConn) whose telegrams are answered
+// by respond, called with every AppData sent.
+type fakeDevice struct {
+	p2p     chan cemi.LData
+	respond func(req *cemi.AppData) []cemi.LData
+
+	mu   sync.Mutex
+	sent []cemi.TransportUnit
+}
+
+func newFakeDevice(respond func(req *cemi.AppData) []cemi.LData) *fakeDevice {
+	return &fakeDevice{p2p: make(chan cemi.LData, 10), respond: respond}
+}
+
+func (f *fakeDevice) SendTo(dst cemi.IndividualAddr, tpdu cemi.TransportUnit) error {
+	f.mu.Lock()
+	f.sent = append(f.sent, tpdu)
+	f.mu.Unlock()
+	if app, ok := tpdu.(*cemi.AppData); ok && f.respond != nil {
+		for _, ldata := range f.respond(app) {
+			f.p2p <- ldata
+		}
+	}
+	return nil
+}
+
+func (f *fakeDevice) PointToPoint() <-chan cemi.LData { return f.p2p }
+func (f *fakeDevice) Send(event knx.GroupEvent) error { return nil }
+func (f *fakeDevice) Inbound() <-chan knx.GroupEvent  { return nil }
+func (f *fakeDevice) Close()                          {}
+func (f *fakeDevice) telegrams() []cemi.TransportUnit {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]cemi.TransportUnit(nil), f.sent...)
+}
+
+var testDevice = cemi.NewIndividualAddr3(1, 1, 5)
+
+// fromDevice is a telegram sent by testDevice.
+func fromDevice(tpdu cemi.TransportUnit) cemi.LData {
+	return cemi.LData{Source: testDevice, Data: tpdu}
+}
+
+func ack(req *cemi.AppData) cemi.LData {
+	return fromDevice(&cemi.ControlData{Numbered: true, SeqNumber: req.SeqNumber, Command: tAck})
+}
+
+func response(cmd cemi.APCI, data ...byte) cemi.LData {
+	return fromDevice(&cemi.AppData{Numbered: true, Command: cmd, Data: data})
+}
+
+func TestDeviceSession(t *testing.T) {
+	tests := []struct {
+		name    string
+		service func(d *deviceSession) ([]byte, error)
+		respond func(req *cemi.AppData) []cemi.LData
+		want    []byte
+		err     string
+	}{
+		{
+			"descriptor", (*deviceSession).readDescriptor,
+			func(req *cemi.AppData) []cemi.LData {
+				return []cemi.LData{ack(req), response(cemi.MaskVersionResponse, 0, 0x07, 0xb0)}
+			},
+			[]byte{0x07, 0xb0}, "",
+		},
+		{
+			"response before the acknowledgement", (*deviceSession).readDescriptor,
+			func(req *cemi.AppData) []cemi.LData {
+				return []cemi.LData{response(cemi.MaskVersionResponse, 0, 0x07, 0xb0), ack(req)}
+			},
+			[]byte{0x07, 0xb0}, "",
+		},
+		{
+			"telegrams from other devices", (*deviceSession).readDescriptor,
+			func(req *cemi.AppData) []cemi.LData {
+				other := cemi.LData{Source: cemi.NewIndividualAddr3(1, 1, 6), Data: &cemi.AppData{Numbered: true, Command: cemi.MaskVersionResponse, Data: []byte{0, 0x57, 0x01}}}
+				return []cemi.LData{other, ack(req), response(cemi.MaskVersionResponse, 0, 0x07, 0xb0)}
+			},
+			[]byte{0x07, 0xb0}, "",
+		},
+		{
+			"property read",
+			func(d *deviceSession) ([]byte, error) { return d.property(0, 11, 1, 1, nil) },
+			func(req *cemi.AppData) []cemi.LData {
+				if !bytes.Equal(req.Data, []byte{apciPropertyValueRead, 0, 11, 0x10, 1}) {
+					return nil
+				}
+				return []cemi.LData{
+					ack(req),
+					response(cemi.Escape, apciPropertyValueResponse, 0, 12, 0x10, 1, 0x00, 0x83), // other property
+					response(cemi.Escape, apciPropertyValueResponse, 0, 11, 0x10, 1, 0x00, 0xfa, 1, 2, 3, 4),
+				}
+			},
+			[]byte{0x00, 0xfa, 1, 2, 3, 4}, "",
+		},
+		{
+			"property write",
+			func(d *deviceSession) ([]byte, error) { return d.property(0, 54, 1, 1, []byte{1}) },
+			func(req *cemi.AppData) []cemi.LData {
+				if !bytes.Equal(req.Data, []byte{apciPropertyValueWrite, 0, 54, 0x10, 1, 1}) {
+					return nil
+				}
+				return []cemi.LData{ack(req), response(cemi.Escape, apciPropertyValueResponse, 0, 54, 0x10, 1, 1)}
+			},
+			[]byte{1}, "",
+		},
+		{
+			"property not available",
+			func(d *deviceSession) ([]byte, error) { return d.property(0, 11, 1, 1, nil) },
+			func(req *cemi.AppData) []cemi.LData {
+				return []cemi.LData{ack(req), response(cemi.Escape, apciPropertyValueResponse, 0, 11, 0x00, 1)}
+			},
+			nil, "property not available",
+		},
+		{
+			"memory read",
+			func(d *deviceSession) ([]byte, error) { return d.readMemory(0x0060, 2) },
+			func(req *cemi.AppData) []cemi.LData {
+				return []cemi.LData{
+					ack(req),
+					response(cemi.MemoryResponse, 2, 0x01, 0x00, 0x11, 0x22), // other address
+					response(cemi.MemoryResponse, 2, 0x00, 0x60, 0xab, 0xcd),
+				}
+			},
+			[]byte{0xab, 0xcd}, "",
+		},
+		{
+			"restart",
+			func(d *deviceSession) ([]byte, error) { return nil, d.restart() },
+			func(req *cemi.AppData) []cemi.LData { return []cemi.LData{ack(req)} },
+			nil, "",
+		},
+		{
+			"negative acknowledgement", (*deviceSession).readDescriptor,
+			func(req *cemi.AppData) []cemi.LData {
+				return []cemi.LData{fromDevice(&cemi.ControlData{Numbered: true, SeqNumber: req.SeqNumber, Command: tNak})}
+			},
+			nil, "negative acknowledgement",
+		},
+		{
+			"acknowledgement of another telegram", (*deviceSession).readDescriptor,
+			func(req *cemi.AppData) []cemi.LData {
+				return []cemi.LData{fromDevice(&cemi.ControlData{Numbered: true, SeqNumber: req.SeqNumber + 1, Command: tAck})}
+			},
+			nil, "timeout waiting for acknowledgement",
+		},
+		{
+			"no response", (*deviceSession).readDescriptor,
+			func(req *cemi.AppData) []cemi.LData { return []cemi.LData{ack(req)} },
+			nil, "timeout waiting for response",
+		},
+		{
+			"disconnected", (*deviceSession).readDescriptor,
+			func(req *cemi.AppData) []cemi.LData {
+				return []cemi.LData{ack(req), fromDevice(&cemi.ControlData{Command: tDisconnect})}
+			},
+			nil, "device closed the connection",
+		},
+	}
+	for _, test := range tests {
+		conn := newFakeDevice(test.respond)
+		d := &deviceSession{conn: conn, dst: testDevice, deadline: time.After(100 * time.Millisecond)}
+		got, err := test.service(d)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: error %v, want %q", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !bytes.Equal(got, test.want) {
+			t.Errorf("%s: % x, want % x", test.name, got, test.want)
+		}
+	}
+}
+
+// The telegrams of a session are numbered, and the ones from the device acknowledged.
+func TestDeviceSessionSequence(t *testing.T) {
+	var deviceSeq uint8
+	conn := newFakeDevice(func(req *cemi.AppData) []cemi.LData {
+		resp := &cemi.AppData{Numbered: true, SeqNumber: deviceSeq, Command: cemi.MemoryResponse, Data: append(req.Data, 0x42)}
+		deviceSeq++
+		return []cemi.LData{ack(req), fromDevice(resp)}
+	})
+	conn.p2p <- response(cemi.MemoryResponse, 1, 0, 0, 0x42) // stale telegram, discarded when connecting
+	d := &deviceSession{conn: conn, dst: testDevice, deadline: time.After(time.Second)}
+	if err := d.connect(); err != nil {
+		t.Fatal(err)
+	}
+	for _, address := range []uint16{0x0100, 0x0200} {
+		if _, err := d.readMemory(address, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d.disconnect()
+
+	want := []cemi.TransportUnit{
+		&cemi.ControlData{Command: tConnect},
+		&cemi.AppData{Numbered: true, SeqNumber: 0, Command: cemi.MemoryRead, Data: []byte{1, 0x01, 0x00}},
+		&cemi.ControlData{Numbered: true, SeqNumber: 0, Command: tAck},
+		&cemi.AppData{Numbered: true, SeqNumber: 1, Command: cemi.MemoryRead, Data: []byte{1, 0x02, 0x00}},
+		&cemi.ControlData{Numbered: true, SeqNumber: 1, Command: tAck},
+		&cemi.ControlData{Command: tDisconnect},
+	}
+	sent := conn.telegrams()
+	if len(sent) != len(want) {
+		t.Fatalf("sent %d telegrams, want %d", len(sent), len(want))
+	}
+	for i := range want {
+		if !reflect.DeepEqual(sent[i], want[i]) {
+			t.Errorf("telegram %d: %+v, want %+v", i, sent[i], want[i])
+		}
+	}
+}
+
+// Device management requests denied by the policy are answered with an error
+// and not sent to the device.
+func TestHandleDeviceRequest(t *testing.T) {
+	conn := newFakeDevice(func(req *cemi.AppData) []cemi.LData {
+		return []cemi.LData{ack(req), response(cemi.MaskVersionResponse, 0, 0x07, 0xb0)}
+	})
+	rule, err := ParsePolicyRule("allow topic=knx/mgmt/installer all 1.1.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		Policy:      Policy{DefaultDeny: true, Rules: []PolicyRule{rule}},
+		ReadTimeout: time.Second,
+		gws:         map[string]*gateway{"gw": {Client: conn}},
+	}
+	replies := make(chan Reply)
+	receive := func() Reply {
+		t.Helper()
+		select {
+		case r := <-replies:
+			return r
+		case <-time.After(2 * time.Second):
+			t.Fatal("no reply")
+			return Reply{}
+		}
+	}
+
+	req := DeviceRequest{Service: DescriptorRead, Device: testDevice, ReplyTo: "knx/reply", CorrelationID: "1", topic: "knx/mgmt"}
+	s.handleDeviceRequest(req, replies)
+	if r := receive(); r.CorrelationID != "1" || r.Error == "" || r.Device != nil {
+		t.Errorf("denied request: reply %+v", r)
+	}
+	if sent := conn.telegrams(); len(sent) != 0 {
+		t.Errorf("denied request sent: %+v", sent)
+	}
+
+	req.CorrelationID, req.topic = "2", "knx/mgmt/installer"
+	s.handleDeviceRequest(req, replies)
+	if r := receive(); r.CorrelationID != "2" || r.Error != "" || r.Device == nil || r.Device.Descriptor != "07B0" {
+		t.Errorf("allowed request: reply %+v", r)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/vapourismo/knx-go/knx"
+)
+
+// A PolicyRule allows or denies the commands received from MQTT
+// to a set of group addresses, and the device management requests
+// to a set of individual addresses, optionally only from one topic.
+type PolicyRule struct {
+	Allow    bool
+	Topic    string                    // empty: any topic
+	Commands map[knx.GroupCommand]bool // nil (and Services nil): any command
+	Services map[DeviceService]bool    // nil (and Commands nil): any device service
+	Ranges   []GroupRange              // empty (and Devices empty): any address
+	Devices  []IndividualRange         // empty (and Ranges empty): any device
+}
+
+// policyServices are the names of the device services in policy rules.
+var policyServices = map[string]DeviceService{
+	"descriptorread": DescriptorRead,
+	"propertyread":   PropertyRead,
+	"propertywrite":  PropertyWrite,
+	"memoryread":     MemoryRead,
+	"restart":        Restart,
+}
+
+// ParsePolicyRule parses a policy rule:
+//
+//	allow|deny [topic=<topic>] <commands> [<group range>|<individual range>...]
+//
+// where commands is "all" or a comma-separated list of "read", "write" and "response"
+// (group commands) and "descriptorread", "propertyread", "propertywrite", "memoryread"
+// and "restart" (device services).  Individual ranges are as in ParseIndividualRange.
+// Group commands with only individual ranges, or device services with only group
+// ranges, are rejected.
+func ParsePolicyRule(spec string) (PolicyRule, error) {
+	var r PolicyRule
+	tokens := strings.Fields(spec)
+	if len(tokens) < 2 {
+		return r, fmt.Errorf("invalid policy rule %q", spec)
+	}
+	switch tokens[0] {
+	case "allow":
+		r.Allow = true
+	case "deny":
+		r.Allow = false
+	default:
+		return r, fmt.Errorf("invalid policy rule %q: must start with allow or deny", spec)
+	}
+	tokens = tokens[1:]
+	if strings.HasPrefix(tokens[0], "topic=") {
+		r.Topic = strings.TrimPrefix(tokens[0], "topic=")
+		tokens = tokens[1:]
+		if len(tokens) == 0 {
+			return r, fmt.Errorf("invalid policy rule %q: no commands", spec)
+		}
+	}
+	if tokens[0] != "all" {
+		r.Commands = make(map[knx.GroupCommand]bool)
+		r.Services = make(map[DeviceService]bool)
+		for _, c := range strings.Split(tokens[0], ",") {
+			switch c {
+			case "read":
+				r.Commands[knx.GroupRead] = true
+			case "write":
+				r.Commands[knx.GroupWrite] = true
+			case "response":
+				r.Commands[knx.GroupResponse] = true
+			default:
+				service, ok := policyServices[c]
+				if !ok {
+					return r, fmt.Errorf("invalid policy rule %q: unknown command %q", spec, c)
+				}
+				r.Services[service] = true
+			}
+		}
+	}
+	for _, t := range tokens[1:] {
+		if strings.Contains(t, ".") {
+			ir, err := ParseIndividualRange(t)
+			if err != nil {
+				return r, err
+			}
+			r.Devices = append(r.Devices, ir)
+			continue
+		}
+		gr, err := ParseGroupRange(t)
+		if err != nil {
+			return r, err
+		}
+		r.Ranges = append(r.Ranges, gr)
+	}
+	// a rule which could never match would make a deny rule useless
+	if len(r.Commands) > 0 && len(r.Devices) > 0 && len(r.Ranges) == 0 {
+		return r, fmt.Errorf("invalid policy rule %q: group commands need group ranges", spec)
+	}
+	if len(r.Services) > 0 && len(r.Ranges) > 0 && len(r.Devices) == 0 {
+		return r, fmt.Errorf("invalid policy rule %q: device services need individual ranges", spec)
+	}
+	return r, nil
+}
+
+func (r PolicyRule) matches(e Event) bool {
+	if r.Topic != "" && r.Topic != e.topic {
+		return false
+	}
+	if r.Commands != nil && !r.Commands[e.Command] {
+		return false
+	}
+	if len(r.Ranges) == 0 {
+		return len(r.Devices) == 0
+	}
+	for _, gr := range r.Ranges {
+		if gr.Contains(e.Destination) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesDevice reports whether the rule applies to a device management request.
+// Rules with only group ranges do not.
+func (r PolicyRule) matchesDevice(req DeviceRequest) bool {
+	if r.Topic != "" && r.Topic != req.topic {
+		return false
+	}
+	if r.Services != nil && !r.Services[req.Service] {
+		return false
+	}
+	if len(r.Devices) == 0 {
+		return len(r.Ranges) == 0
+	}
+	for _, ir := range r.Devices {
+		if ir.Contains(req.Device) {
+			return true
+		}
+	}
+	return false
+}
+
+// Policy decides which commands received from MQTT can be sent to KNX.
+// Rules are checked in order and the first one matching decides;
+// if none matches, the command is allowed (or denied, with DefaultDeny).
+// In read-only mode, only reads are allowed.
+type Policy struct {
+	ReadOnly    bool
+	DefaultDeny bool
+	Rules       []PolicyRule
+}
+
+// CheckDevice returns an error if a device management request is not allowed,
+// checking the rules as Check does.
+// In read-only mode, only the services which do not modify the device are allowed.
+func (p *Policy) CheckDevice(r DeviceRequest) error {
+	if p.ReadOnly && !r.Service.ReadOnly() {
+		return fmt.Errorf("%s to %s denied: read-only mode", r.Service, r.Device)
+	}
+	for i, rule := range p.Rules {
+		if rule.matchesDevice(r) {
+			if !rule.Allow {
+				return fmt.Errorf("%s to %s denied by policy rule %d", r.Service, r.Device, i+1)
+			}
+			return nil
+		}
+	}
+	if p.DefaultDeny {
+		return fmt.Errorf("%s to %s denied: no policy rule allows it", r.Service, r.Device)
+	}
+	return nil
+}
+
+// Check returns an error if e is not allowed.
+func (p *Policy) Check(e Event) error {
+	if p.ReadOnly && e.Command != knx.GroupRead {
+		return fmt.Errorf("%s to %s denied: read-only mode", e.Command, e.Destination)
+	}
+	for i, r := range p.Rules {
+		if r.matches(e) {
+			if !r.Allow {
+				return fmt.Errorf("%s to %s denied by policy rule %d", e.Command, e.Destination, i+1)
+			}
+			return nil
+		}
+	}
+	if p.DefaultDeny {
+		return fmt.Errorf("%s to %s denied: no policy rule allows it", e.Command, e.Destination)
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/vapourismo/knx-go/knx"
+	"github.com/vapourismo/knx-go/knx/cemi"
+)
+
+func TestPolicyDefaultDeny(t *testing.T) {
+	rule, err := ParsePolicyRule("allow topic=knx/cmd/heating write 3/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := Policy{DefaultDeny: true, Rules: []PolicyRule{rule}}
+	event := func(topic string, command knx.GroupCommand, dest cemi.GroupAddr) Event {
+		e := Event{GroupEvent: knx.GroupEvent{Command: command, Destination: dest}}
+		e.topic = topic
+		return e
+	}
+	tests := []struct {
+		name    string
+		e       Event
+		allowed bool
+	}{
+		{"allowed by the rule", event("knx/cmd/heating", knx.GroupWrite, cemi.NewGroupAddr3(3, 1, 2)), true},
+		{"other topic", event("knx/cmd/lights", knx.GroupWrite, cemi.NewGroupAddr3(3, 1, 2)), false},
+		{"other command", event("knx/cmd/heating", knx.GroupRead, cemi.NewGroupAddr3(3, 1, 2)), false},
+		{"other address", event("knx/cmd/heating", knx.GroupWrite, cemi.NewGroupAddr3(4, 1, 2)), false},
+	}
+	for _, test := range tests {
+		if err := p.Check(test.e); (err == nil) != test.allowed {
+			t.Errorf("%s: %v", test.name, err)
+		}
+	}
+	if err := p.CheckDevice(DeviceRequest{Service: DescriptorRead, Device: 0x1105}); err == nil {
+		t.Errorf("device request allowed")
+	}
+}
+
+func TestPolicyDevice(t *testing.T) {
+	var rules []PolicyRule
+	for _, spec := range []string{
+		"deny restart 1.1.1",
+		"allow topic=knx/mgmt/installer all 1.1.",
+		"allow descriptorread,propertyread 1.1.0-1.2.255",
+		"allow all 3/",
+		"deny all",
+	} {
+		r, err := ParsePolicyRule(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rules = append(rules, r)
+	}
+	p := Policy{Rules: rules}
+	request := func(topic string, service DeviceService, device string) DeviceRequest {
+		addr, err := cemi.NewIndividualAddrString(device)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return DeviceRequest{Service: service, Device: addr, topic: topic}
+	}
+	tests := []struct {
+		name    string
+		req     DeviceRequest
+		allowed bool
+	}{
+		{"denied service", request("knx/mgmt/installer", Restart, "1.1.1"), false},
+		{"installer in its line", request("knx/mgmt/installer", Restart, "1.1.2"), true},
+		{"installer in other line", request("knx/mgmt/installer", Restart, "1.2.2"), false},
+		{"reading", request("knx/mgmt", PropertyRead, "1.2.2"), true},
+		{"writing", request("knx/mgmt", PropertyWrite, "1.2.2"), false},
+		{"outside the ranges", request("knx/mgmt", DescriptorRead, "2.1.1"), false},
+	}
+	for _, test := range tests {
+		if err := p.CheckDevice(test.req); (err == nil) != test.allowed {
+			t.Errorf("%s: %v", test.name, err)
+		}
+	}
+
+	// group commands only match the rules without individual ranges
+	e := Event{GroupEvent: knx.GroupEvent{Command: knx.GroupWrite, Destination: cemi.NewGroupAddr3(3, 0, 1)}}
+	e.topic = "knx/cmd/installer"
+	if err := p.Check(e); err != nil {
+		t.Errorf("group write to 3/0/1: %v", err)
+	}
+	e.Destination = cemi.NewGroupAddr3(1, 1, 1)
+	if err := p.Check(e); err == nil {
+		t.Errorf("group write to 1/1/1 allowed")
+	}
+}
+
+func TestParsePolicyRule(t *testing.T) {
+	tests := []struct {
+		spec string
+		ok   bool
+	}{
+		{"allow write 1/", true},
+		{"deny restart 1.1.", true},
+		{"allow all 1/ 1.1.", true},
+		{"allow write,restart 1/ 1.1.", true},
+		{"deny topic=knx/cmd/x all", true},
+		{"deny write 1.1.", false},
+		{"deny read,response 1.1.1", false},
+		{"deny restart 1/", false},
+		{"deny propertywrite 1/2/3", false},
+		{"deny jump 1/", false},
+		{"maybe write 1/", false},
+		{"deny topic=knx/cmd/x", false},
+		{"deny write 40/", false},
+	}
+	for _, test := range tests {
+		if _, err := ParsePolicyRule(test.spec); (err == nil) != test.ok {
+			t.Errorf("%s: error %v", test.spec, err)
+		}
+	}
+}
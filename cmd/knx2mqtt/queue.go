@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/vapourismo/knx-go/knx"
+)
+
+// Priority of a telegram in the transmit queue.
+// Telegrams with higher priority are always sent first.
+type Priority int
+
+const (
+	PriorityLow Priority = iota
+	PriorityNormal
+	PriorityHigh
+	numPriorities
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityLow:
+		return "low"
+	case PriorityNormal:
+		return "normal"
+	case PriorityHigh:
+		return "high"
+	}
+	return "unknown"
+}
+
+func ParsePriority(s string) (Priority, error) {
+	switch s {
+	case "low", "Low":
+		return PriorityLow, nil
+	case "", "normal", "Normal":
+		return PriorityNormal, nil
+	case "high", "High":
+		return PriorityHigh, nil
+	}
+	return PriorityNormal, fmt.Errorf("unknown priority %q", s)
+}
+
+// Origins of the telegrams in a TxQueue.
+const (
+	OriginMQTT    = "mqtt"    // commands received from MQTT
+	OriginForward = "forward" // telegrams forwarded from another gateway
+	OriginReadout = "readout" // reads sent after connecting
+)
+
+// QueueStats are the counters of a TxQueue.
+type QueueStats struct {
+	Queued    uint64 // telegrams accepted in the queue
+	Sent      uint64 // telegrams taken from the queue and sent
+	Discarded uint64 // telegrams taken from the queue but not sent (not connected or send error)
+	Coalesced uint64 // writes replaced by a newer value before being sent
+	Dropped   uint64 // telegrams discarded because the queue was full
+	Length    int    // telegrams currently waiting
+}
+
+// QueuedEvent is a telegram waiting in a TxQueue.
+type QueuedEvent struct {
+	knx.GroupEvent
+	Queued time.Time
+	Origin string                         // OriginMQTT, OriginForward or OriginReadout
+	Done   func(status string, err error) // if not nil, called when the telegram is sent or discarded
+}
+
+func (e QueuedEvent) done(status string, err error) {
+	if e.Done != nil {
+		e.Done(status, err)
+	}
+}
+
+// TxQueue is a rate-limited, prioritized queue of telegrams to be sent to one KNX gateway.
+// Writes to a group address which is already waiting in the queue with the same
+// priority replace the old value instead of being queued again.
+type TxQueue struct {
+	mu       sync.Mutex
+	queues   [numPriorities][]QueuedEvent
+	max      int
+	interval time.Duration
+	last     time.Time
+	busy     bool // a telegram has been taken but not sent yet
+	ready    chan struct{}
+	stats    QueueStats
+}
+
+// NewTxQueue creates a queue holding at most max telegrams,
+// which are delivered at no more than rate telegrams per second.
+func NewTxQueue(rate float64, max int) *TxQueue {
+	q := &TxQueue{
+		max:   max,
+		ready: make(chan struct{}, 1),
+	}
+	if rate > 0 {
+		q.interval = time.Duration(float64(time.Second) / rate)
+	}
+	return q
+}
+
+// Push adds e, coming from origin, to the queue.  It returns false if it had to be dropped.
+// If done is not nil, it is called with the fate of the telegram:
+// "sent", "coalesced" (replaced by a newer write), "dropped" or "discarded".
+// The callbacks of coalesced or dropped telegrams are called after unlocking the queue.
+func (q *TxQueue) Push(e knx.GroupEvent, prio Priority, origin string, done func(status string, err error)) bool {
+	q.mu.Lock()
+	if e.Command == knx.GroupWrite {
+		for i, old := range q.queues[prio] {
+			if old.Command == knx.GroupWrite && old.Destination == e.Destination {
+				q.queues[prio][i] = QueuedEvent{e, old.Queued, origin, done}
+				q.stats.Coalesced++
+				q.mu.Unlock()
+				old.done("coalesced", nil)
+				return true
+			}
+		}
+	}
+	if q.max > 0 && q.stats.Length >= q.max {
+		q.stats.Dropped++
+		q.mu.Unlock()
+		QueuedEvent{Done: done}.done("dropped", errors.New("transmit queue full"))
+		return false
+	}
+	defer q.mu.Unlock()
+	q.queues[prio] = append(q.queues[prio], QueuedEvent{e, time.Now(), origin, done})
+	q.stats.Queued++
+	q.stats.Length++
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// Pop waits until there is a telegram in the queue and the rate limit allows
+// sending it, and returns it.
+func (q *TxQueue) Pop() QueuedEvent {
+	for {
+		q.mu.Lock()
+		wait := q.interval - time.Since(q.last)
+		if wait <= 0 {
+			for p := numPriorities - 1; p >= 0; p-- {
+				if len(q.queues[p]) > 0 {
+					e := q.queues[p][0]
+					q.queues[p] = q.queues[p][1:]
+					q.stats.Length--
+					q.last = time.Now()
+					q.busy = true
+					q.mu.Unlock()
+					return e
+				}
+			}
+		}
+		q.mu.Unlock()
+
+		if wait > 0 {
+			time.Sleep(wait)
+		} else {
+			<-q.ready
+		}
+	}
+}
+
+// Done must be called after sending each telegram returned by Pop,
+// telling whether it was sent or discarded.
+func (q *TxQueue) Done(sent bool) {
+	q.mu.Lock()
+	q.busy = false
+	if sent {
+		q.stats.Sent++
+	} else {
+		q.stats.Discarded++
+	}
+	q.mu.Unlock()
+}
+
+// Drained reports whether all the queued telegrams have been sent.
+func (q *TxQueue) Drained() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.stats.Length == 0 && !q.busy
+}
+
+// Stats returns a copy of the counters of the queue.
+func (q *TxQueue) Stats() QueueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.stats
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/vapourismo/knx-go/knx"
+	"github.com/vapourismo/knx-go/knx/cemi"
+)
+
+func groupWrite(addr cemi.GroupAddr, value byte) knx.GroupEvent {
+	return knx.GroupEvent{Command: knx.GroupWrite, Destination: addr, Data: []byte{value}}
+}
+
+func TestQueueCoalesce(t *testing.T) {
+	q := NewTxQueue(0, 0)
+	addr := cemi.NewGroupAddr3(1, 2, 3)
+	var status []string
+	done := func(s string, err error) {
+		// the callbacks are called with the queue unlocked
+		q.Stats()
+		status = append(status, s)
+	}
+	q.Push(groupWrite(addr, 1), PriorityNormal, OriginMQTT, done)
+	q.Push(knx.GroupEvent{Command: knx.GroupRead, Destination: addr}, PriorityNormal, OriginMQTT, done)
+	q.Push(groupWrite(addr, 2), PriorityNormal, OriginMQTT, done)
+	q.Push(groupWrite(addr, 3), PriorityHigh, OriginMQTT, done) // other priority: not coalesced
+
+	if len(status) != 1 || status[0] != "coalesced" {
+		t.Errorf("callbacks %v", status)
+	}
+	stats := q.Stats()
+	if stats.Queued != 3 || stats.Coalesced != 1 || stats.Length != 3 {
+		t.Errorf("stats %+v", stats)
+	}
+	var got []knx.GroupEvent
+	for i := 0; i < 3; i++ {
+		got = append(got, q.Pop().GroupEvent)
+		q.Done(true)
+	}
+	if got[0].Data[0] != 3 || got[1].Data[0] != 2 || got[2].Command != knx.GroupRead {
+		t.Errorf("popped %v", got)
+	}
+}
+
+func TestQueuePriority(t *testing.T) {
+	q := NewTxQueue(0, 0)
+	q.Push(groupWrite(cemi.NewGroupAddr3(0, 0, 1), 1), PriorityLow, OriginMQTT, nil)
+	q.Push(groupWrite(cemi.NewGroupAddr3(0, 0, 2), 1), PriorityNormal, OriginMQTT, nil)
+	q.Push(groupWrite(cemi.NewGroupAddr3(0, 0, 3), 1), PriorityHigh, OriginMQTT, nil)
+	q.Push(groupWrite(cemi.NewGroupAddr3(0, 0, 4), 1), PriorityNormal, OriginMQTT, nil)
+	q.Push(groupWrite(cemi.NewGroupAddr3(0, 0, 5), 1), PriorityHigh, OriginMQTT, nil)
+
+	want := []cemi.GroupAddr{
+		cemi.NewGroupAddr3(0, 0, 3), cemi.NewGroupAddr3(0, 0, 5),
+		cemi.NewGroupAddr3(0, 0, 2), cemi.NewGroupAddr3(0, 0, 4),
+		cemi.NewGroupAddr3(0, 0, 1),
+	}
+	for i, addr := range want {
+		e := q.Pop()
+		if e.Destination != addr {
+			t.Errorf("telegram %d to %s, want %s", i, e.Destination, addr)
+		}
+		q.Done(i%2 == 0)
+	}
+	stats := q.Stats()
+	if !q.Drained() || stats.Sent != 3 || stats.Discarded != 2 {
+		t.Errorf("stats %+v", stats)
+	}
+}
+
+func TestQueueMaxLength(t *testing.T) {
+	q := NewTxQueue(0, 2)
+	var status string
+	var err error
+	done := func(s string, e error) {
+		q.Stats()
+		status, err = s, e
+	}
+	if !q.Push(groupWrite(cemi.NewGroupAddr3(0, 0, 1), 1), PriorityNormal, OriginMQTT, nil) ||
+		!q.Push(groupWrite(cemi.NewGroupAddr3(0, 0, 2), 1), PriorityNormal, OriginMQTT, nil) {
+		t.Fatal("telegram dropped")
+	}
+	if q.Push(groupWrite(cemi.NewGroupAddr3(0, 0, 3), 1), PriorityHigh, OriginMQTT, done) {
+		t.Error("telegram queued in a full queue")
+	}
+	if status != "dropped" || err == nil {
+		t.Errorf("callback: %q %v", status, err)
+	}
+	// writes to an address already waiting are not dropped
+	if !q.Push(groupWrite(cemi.NewGroupAddr3(0, 0, 2), 2), PriorityNormal, OriginMQTT, nil) {
+		t.Error("coalesced telegram dropped")
+	}
+	stats := q.Stats()
+	if stats.Queued != 2 || stats.Dropped != 1 || stats.Coalesced != 1 || stats.Length != 2 {
+		t.Errorf("stats %+v", stats)
+	}
+}
+
+func TestQueueRate(t *testing.T) {
+	const rate = 50
+	q := NewTxQueue(rate, 0)
+	for i := 0; i < 5; i++ {
+		q.Push(groupWrite(cemi.NewGroupAddr3(0, 0, uint8(i)), 1), PriorityNormal, OriginMQTT, nil)
+	}
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		q.Pop()
+		q.Done(true)
+	}
+	// the first one is sent at once, and the other four wait for the interval
+	if d, min := time.Since(start), 4*time.Second/rate; d < min {
+		t.Errorf("5 telegrams sent in %v, want at least %v", d, min)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/vapourismo/knx-go/knx"
+	"github.com/vapourismo/knx-go/knx/cemi"
+)
+
+// Reply is published to the ReplyTo topic of a read request or a device
+// management request, either with the result or with an error.
+type Reply struct {
+	topic         string
+	CorrelationID string        `json:",omitempty"`
+	Error         string        `json:",omitempty"`
+	Event         *Event        `json:",omitempty"`
+	Device        *DeviceResult `json:",omitempty"`
+}
+
+type pendingRead struct {
+	replyTo       string
+	correlationID string
+	timer         *time.Timer
+}
+
+// ReadTracker keeps the read requests received from MQTT which are
+// waiting for a GroupResponse from any of the KNX gateways.
+type ReadTracker struct {
+	mu      sync.Mutex
+	timeout time.Duration
+	pending map[cemi.GroupAddr][]*pendingRead
+	replies chan<- Reply
+}
+
+func NewReadTracker(replies chan<- Reply, timeout time.Duration) *ReadTracker {
+	return &ReadTracker{
+		timeout: timeout,
+		pending: make(map[cemi.GroupAddr][]*pendingRead),
+		replies: replies,
+	}
+}
+
+// Add registers a read request.  If no response arrives before its timeout,
+// an error is sent to its reply topic.
+func (t *ReadTracker) Add(e Event) {
+	timeout := e.Timeout
+	if timeout <= 0 {
+		timeout = t.timeout
+	}
+	r := &pendingRead{replyTo: e.ReplyTo, correlationID: e.CorrelationID}
+	addr := e.Destination
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pending[addr] = append(t.pending[addr], r)
+	r.timer = time.AfterFunc(timeout, func() {
+		if !t.remove(addr, r) {
+			return
+		}
+		t.replies <- Reply{
+			topic:         r.replyTo,
+			CorrelationID: r.correlationID,
+			Error:         "timeout waiting for response from " + addr.String(),
+		}
+	})
+}
+
+// remove deletes r from the list of pending requests.
+// It returns false if it was already answered.
+func (t *ReadTracker) remove(addr cemi.GroupAddr, r *pendingRead) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	list := t.pending[addr]
+	for i := range list {
+		if list[i] == r {
+			t.pending[addr] = append(list[:i], list[i+1:]...)
+			if len(t.pending[addr]) == 0 {
+				delete(t.pending, addr)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// reply sends r without blocking: the channel is read by the same goroutine
+// which publishes the events, and it can be waiting for the caller.
+func (t *ReadTracker) reply(r Reply) {
+	go func() { t.replies <- r }()
+}
+
+// Answer sends e to all the pending requests for its destination, if it is a response.
+func (t *ReadTracker) Answer(e Event) {
+	if e.Command != knx.GroupResponse {
+		return
+	}
+	t.mu.Lock()
+	list := t.pending[e.Destination]
+	delete(t.pending, e.Destination)
+	t.mu.Unlock()
+
+	for _, r := range list {
+		r.timer.Stop()
+		t.reply(Reply{
+			topic:         r.replyTo,
+			CorrelationID: r.correlationID,
+			Event:         &e,
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/vapourismo/knx-go/knx"
+	"github.com/vapourismo/knx-go/knx/cemi"
+)
+
+// More pending reads than the size of the replies channel are answered
+// without blocking the caller, which is also the one reading the channel.
+func TestReadTrackerAnswer(t *testing.T) {
+	replies := make(chan Reply, 5)
+	tracker := NewReadTracker(replies, time.Minute)
+	addr := cemi.NewGroupAddr3(1, 2, 3)
+	const reads = 12
+	for i := 0; i < reads; i++ {
+		e := Event{GroupEvent: knx.GroupEvent{Command: knx.GroupRead, Destination: addr}}
+		e.ReplyTo = "knx/reply"
+		e.CorrelationID = fmt.Sprint(i)
+		tracker.Add(e)
+	}
+
+	answered := make(chan struct{})
+	go func() {
+		tracker.Answer(Event{GroupEvent: knx.GroupEvent{Command: knx.GroupResponse, Destination: addr, Data: []byte{1}}})
+		close(answered)
+	}()
+	select {
+	case <-answered:
+	case <-time.After(time.Second):
+		t.Fatal("Answer blocked")
+	}
+
+	seen := make(map[string]bool)
+	for i := 0; i < reads; i++ {
+		select {
+		case r := <-replies:
+			if r.topic != "knx/reply" || r.Error != "" || r.Event == nil || r.Event.Destination != addr {
+				t.Errorf("reply %+v", r)
+			}
+			seen[r.CorrelationID] = true
+		case <-time.After(time.Second):
+			t.Fatalf("only %d replies", i)
+		}
+	}
+	if len(seen) != reads {
+		t.Errorf("replies to %d requests, want %d", len(seen), reads)
+	}
+}
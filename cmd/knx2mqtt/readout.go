@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/vapourismo/knx-go/knx"
+	"github.com/vapourismo/knx-go/knx/cemi"
+)
+
+// ParseReadout parses a read-out specification: a gateway followed by
+// the group ranges to read after connecting to it:
+//
+//	192.168.1.50 1/ 2/5/0-2/5/127
+func ParseReadout(spec string) (gw string, ranges []GroupRange, err error) {
+	tokens := strings.Fields(spec)
+	if len(tokens) < 2 {
+		return "", nil, fmt.Errorf("invalid read-out %q: must have a gateway and at least one group range", spec)
+	}
+	for _, t := range tokens[1:] {
+		r, err := ParseGroupRange(t)
+		if err != nil {
+			return "", nil, err
+		}
+		ranges = append(ranges, r)
+	}
+	return gatewayAddr(tokens[0]), ranges, nil
+}
+
+// readout sends a GroupRead to every address in ranges through a gateway,
+// with low priority and without overflowing its transmit queue, and then
+// reports the addresses which did not answer and the ones whose read could not
+// be sent.  It stops when ctx is done, without reporting anything; ctx has to be
+// canceled with s.mu held, before starting another read-out for the same gateway.
+func (s *Server) readout(ctx context.Context, gwName string, ranges []GroupRange) {
+	var addrs []cemi.GroupAddr
+	seen := make(map[cemi.GroupAddr]bool)
+	for _, r := range ranges {
+		for a := int(r.First); a <= int(r.Last); a++ {
+			if !seen[cemi.GroupAddr(a)] {
+				seen[cemi.GroupAddr(a)] = true
+				addrs = append(addrs, cemi.GroupAddr(a))
+			}
+		}
+	}
+
+	gw := s.gws[gwName]
+	notSent := make(map[cemi.GroupAddr]bool) // protected by s.mu
+	s.mu.Lock()
+	gw.Readout = seen
+	s.mu.Unlock()
+
+	logKNX.Info("starting read-out", "gateway", gwName, "addresses", len(addrs))
+	for _, addr := range addrs {
+		for s.KNXQueueLen > 0 && gw.Queue.Stats().Length >= s.KNXQueueLen/2 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(100 * time.Millisecond):
+			}
+		}
+		addr := addr
+		gw.Queue.Push(knx.GroupEvent{Command: knx.GroupRead, Destination: addr, Data: []byte{0}}, PriorityLow, OriginReadout, func(status string, err error) {
+			if status != "sent" {
+				s.mu.Lock()
+				notSent[addr] = true
+				s.mu.Unlock()
+			}
+		})
+	}
+	for !gw.Queue.Drained() {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	select {
+	case <-ctx.Done():
+		return
+	case <-time.After(s.ReadTimeout):
+	}
+
+	s.mu.Lock()
+	if ctx.Err() != nil {
+		// another read-out has started
+		s.mu.Unlock()
+		return
+	}
+	var missing, unsent []string
+	for _, addr := range addrs {
+		switch {
+		case !gw.Readout[addr]:
+			// answered
+		case notSent[addr]:
+			unsent = append(unsent, addr.String())
+		default:
+			missing = append(missing, addr.String())
+		}
+	}
+	gw.Readout = nil
+	s.mu.Unlock()
+
+	logKNX.Info("read-out finished", "gateway", gwName, "addresses", len(addrs),
+		"answered", len(addrs)-len(missing)-len(unsent), "unsent", len(unsent))
+	if len(missing) > 0 {
+		logKNX.Warn("addresses not answering to read-out", "gateway", gwName, "missing", strings.Join(missing, " "))
+	}
+	if len(unsent) > 0 {
+		logKNX.Warn("read-out not sent to some addresses", "gateway", gwName, "unsent", strings.Join(unsent, " "))
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cespedes/knx2mqtt/internal/logging"
+	"github.com/vapourismo/knx-go/knx/cemi"
+)
+
+// IndividualRange is a range of individual addresses, both inclusive.
+type IndividualRange struct {
+	First cemi.IndividualAddr
+	Last  cemi.IndividualAddr
+}
+
+// Contains reports whether addr is in the range.
+func (r IndividualRange) Contains(addr cemi.IndividualAddr) bool {
+	return addr >= r.First && addr <= r.Last
+}
+
+// parseIndividualAddr parses an individual address "area.line.device",
+// checking that each part is in its range.
+func parseIndividualAddr(s string) (cemi.IndividualAddr, error) {
+	var a, b, c uint
+	if n, _ := fmt.Sscanf(s, "%d.%d.%d", &a, &b, &c); n != 3 || strings.Count(s, ".") != 2 {
+		return 0, fmt.Errorf("invalid individual address %q", s)
+	}
+	if a > 15 || b > 15 || c > 255 {
+		return 0, fmt.Errorf("individual address %q out of range", s)
+	}
+	return cemi.NewIndividualAddr3(uint8(a), uint8(b), uint8(c)), nil
+}
+
+// ParseIndividualRange parses a range of individual addresses.  It can be a single
+// address ("1.1.5"), a line ("1.1.") or two addresses separated by a dash ("1.1.0-1.1.255").
+func ParseIndividualRange(s string) (IndividualRange, error) {
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		first, err := parseIndividualAddr(s[:i])
+		if err != nil {
+			return IndividualRange{}, fmt.Errorf("invalid individual address range %q: %w", s, err)
+		}
+		last, err := parseIndividualAddr(s[i+1:])
+		if err != nil {
+			return IndividualRange{}, fmt.Errorf("invalid individual address range %q: %w", s, err)
+		}
+		if last < first {
+			return IndividualRange{}, fmt.Errorf("invalid individual address range %q", s)
+		}
+		return IndividualRange{first, last}, nil
+	}
+	var a, b uint
+	if n, _ := fmt.Sscanf(s, "%d.%d.", &a, &b); n == 2 && strings.Count(s, ".") == 2 && strings.HasSuffix(s, ".") {
+		if a > 15 || b > 15 {
+			return IndividualRange{}, fmt.Errorf("invalid individual address range %q: line out of range", s)
+		}
+		first := cemi.NewIndividualAddr3(uint8(a), uint8(b), 0)
+		return IndividualRange{first, first | 0xff}, nil
+	}
+	addr, err := parseIndividualAddr(s)
+	if err != nil {
+		return IndividualRange{}, fmt.Errorf("invalid individual address range %q: %w", s, err)
+	}
+	return IndividualRange{addr, addr}, nil
+}
+
+// ScannedDevice is a device which answered to a bus scan.
+type ScannedDevice struct {
+	Address     cemi.IndividualAddr
+	MaskVersion string
+	Serial      string // empty if it could not be read
+}
+
+// ScanDevice connects to a device and reads its descriptor and serial number.
+func ScanDevice(conn ManagementConn, addr cemi.IndividualAddr, timeout time.Duration) (*ScannedDevice, error) {
+	d := &deviceSession{conn: conn, dst: addr, deadline: time.After(timeout)}
+	if err := d.connect(); err != nil {
+		return nil, err
+	}
+	defer d.disconnect()
+	desc, err := d.readDescriptor()
+	if err != nil {
+		return nil, err
+	}
+	dev := &ScannedDevice{Address: addr, MaskVersion: fmt.Sprintf("%04X", desc)}
+	// PID_SERIAL_NUMBER, in the device object
+	d.deadline = time.After(timeout)
+	if serial, err := d.property(0, 11, 1, 1, nil); err == nil {
+		dev.Serial = fmt.Sprintf("%X", serial)
+	} else {
+		logKNX.Debug("could not read serial number", "device", addr.String(), "error", err)
+	}
+	return dev, nil
+}
+
+// scanMain implements "knx2mqtt scan": it probes every individual address
+// in the given ranges and lists the devices which answer.
+func scanMain(args []string) {
+	fs := flag.NewFlagSet("knx2mqtt scan", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: knx2mqtt scan [options] range...\n")
+		fs.PrintDefaults()
+	}
+	logOpts := logging.AddFlags(fs)
+	gw := fs.String("knx", "", "KNX Gateway")
+	timeout := fs.Duration("timeout", time.Second, "Time to wait for each device")
+	config := fs.Bool("config", false, "Print the devices as \"device\" lines for the knx2mqtt-pretty config")
+	fs.Parse(args)
+
+	if err := logging.Setup(logOpts, "knx2mqtt"); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if *gw == "" {
+		logging.Fatal(logConfig, "no KNX gateway specified")
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	var ranges []IndividualRange
+	for _, arg := range fs.Args() {
+		r, err := ParseIndividualRange(arg)
+		if err != nil {
+			logging.Fatal(logConfig, "invalid range", "error", err)
+		}
+		ranges = append(ranges, r)
+	}
+
+	if _, ok := knxdGateway(*gw); ok {
+		logging.Fatal(logConfig, "device management is not available through knxd gateways", "gateway", *gw)
+	}
+	if _, _, ok := secureGateway(*gw); ok {
+		logging.Fatal(logConfig, "scanning is not available through secure gateways", "gateway", *gw)
+	}
+	conn, err := DialTunnel(gatewayAddr(*gw))
+	if err != nil {
+		logging.Fatal(logKNX, "could not connect", "gateway", *gw, "error", err)
+	}
+	defer conn.Close()
+	// the group telegrams are not used
+	go func() {
+		for range conn.Inbound() {
+		}
+	}()
+
+	found := 0
+	for _, r := range ranges {
+		for a := int(r.First); a <= int(r.Last); a++ {
+			addr := cemi.IndividualAddr(a)
+			logKNX.Debug("probing device", "device", addr.String())
+			dev, err := ScanDevice(conn, addr, *timeout)
+			if err != nil {
+				logKNX.Debug("no answer", "device", addr.String(), "error", err)
+				continue
+			}
+			found++
+			serial := dev.Serial
+			if serial == "" {
+				serial = "?"
+			}
+			if *config {
+				fmt.Printf("device %s device-%s # mask %s serial %s\n", dev.Address, dev.Address, dev.MaskVersion, serial)
+			} else {
+				fmt.Printf("%-9s mask=%s serial=%s\n", dev.Address, dev.MaskVersion, serial)
+			}
+		}
+	}
+	logKNX.Info("scan finished", "devices", found)
+}
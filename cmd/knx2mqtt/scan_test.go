@@ -0,0 +1,85 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/vapourismo/knx-go/knx/cemi"
+)
+
+func TestParseIndividualRange(t *testing.T) {
+	tests := []struct {
+		s     string
+		first cemi.IndividualAddr
+		last  cemi.IndividualAddr
+		ok    bool
+	}{
+		{"1.1.5", cemi.NewIndividualAddr3(1, 1, 5), cemi.NewIndividualAddr3(1, 1, 5), true},
+		{"1.1.", cemi.NewIndividualAddr3(1, 1, 0), cemi.NewIndividualAddr3(1, 1, 255), true},
+		{"15.15.", cemi.NewIndividualAddr3(15, 15, 0), cemi.NewIndividualAddr3(15, 15, 255), true},
+		{"1.1.0-1.2.255", cemi.NewIndividualAddr3(1, 1, 0), cemi.NewIndividualAddr3(1, 2, 255), true},
+		{"0.0.0-15.15.255", 0, 0xffff, true},
+		{"16.1.", 0, 0, false},
+		{"1.16.", 0, 0, false},
+		{"1.300.", 0, 0, false},
+		{"16.1.1", 0, 0, false},
+		{"1.1.256", 0, 0, false},
+		{"1.1.0-16.1.0", 0, 0, false},
+		{"1.2.0-1.1.0", 0, 0, false},
+		{"1.1", 0, 0, false},
+		{"device", 0, 0, false},
+	}
+	for _, test := range tests {
+		r, err := ParseIndividualRange(test.s)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: error %v", test.s, err)
+			continue
+		}
+		if test.ok && (r.First != test.first || r.Last != test.last) {
+			t.Errorf("%s: %s-%s, want %s-%s", test.s, r.First, r.Last, test.first, test.last)
+		}
+	}
+}
+
+func TestScanDevice(t *testing.T) {
+	descriptor := func(req *cemi.AppData) []cemi.LData {
+		if req.Command != cemi.MaskVersionRead {
+			return []cemi.LData{ack(req)}
+		}
+		return []cemi.LData{ack(req), response(cemi.MaskVersionResponse, 0, 0x07, 0x05)}
+	}
+	tests := []struct {
+		name    string
+		respond func(req *cemi.AppData) []cemi.LData
+		want    *ScannedDevice
+	}{
+		{
+			"descriptor and serial number",
+			func(req *cemi.AppData) []cemi.LData {
+				if req.Command == cemi.Escape {
+					return []cemi.LData{ack(req), response(cemi.Escape, apciPropertyValueResponse, 0, 11, 0x10, 1, 0x00, 0x83, 0, 0, 0x12, 0xab)}
+				}
+				return descriptor(req)
+			},
+			&ScannedDevice{Address: testDevice, MaskVersion: "0705", Serial: "0083000012AB"},
+		},
+		{"no serial number", descriptor, &ScannedDevice{Address: testDevice, MaskVersion: "0705"}},
+		{"no answer", func(req *cemi.AppData) []cemi.LData { return nil }, nil},
+	}
+	for _, test := range tests {
+		dev, err := ScanDevice(newFakeDevice(test.respond), testDevice, 50*time.Millisecond)
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("%s: found %+v", test.name, dev)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if *dev != *test.want {
+			t.Errorf("%s: %+v, want %+v", test.name, *dev, *test.want)
+		}
+	}
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/vapourismo/knx-go/knx/cemi"
+	"github.com/vapourismo/knx-go/knx/knxnet"
+)
+
+// KNX IP Secure services (ISO 22510, AN159).
+const (
+	SecureWrapperService       knxnet.ServiceID = 0x0950
+	SessionRequestService      knxnet.ServiceID = 0x0951
+	SessionResponseService     knxnet.ServiceID = 0x0952
+	SessionAuthenticateService knxnet.ServiceID = 0x0953
+	SessionStatusService       knxnet.ServiceID = 0x0954
+)
+
+// Status codes of SESSION_STATUS.
+const (
+	SessionAuthSuccess     = 0
+	SessionAuthFailed      = 1
+	SessionUnauthenticated = 2
+	SessionTimeout         = 3
+	SessionKeepAlive       = 4
+	SessionClose           = 5
+)
+
+const (
+	// SecureHeartbeat is the interval of the connection state requests,
+	// which also keep the secure session alive.
+	SecureHeartbeat = 30 * time.Second
+	// SecureTimeout is the time to wait for an answer from the gateway.
+	SecureTimeout = 10 * time.Second
+)
+
+// counter0Handshake is the counter used to encrypt the MACs of SESSION_RESPONSE
+// and SESSION_AUTHENTICATE.
+var counter0Handshake = []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0}
+
+// hpaiTCP is the host address of a TCP connection ("route back").
+var hpaiTCP = knxnet.HostInfo{Protocol: knxnet.TCP4}
+
+// knxipHeader returns the header of a KNXnet/IP frame.
+func knxipHeader(service knxnet.ServiceID, bodyLen int) []byte {
+	h := []byte{6, 0x10, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(h[2:], uint16(service))
+	binary.BigEndian.PutUint16(h[4:], uint16(6+bodyLen))
+	return h
+}
+
+// readKNXIPFrame reads a whole KNXnet/IP frame from a TCP connection.
+func readKNXIPFrame(r io.Reader) (knxnet.ServiceID, []byte, error) {
+	header := make([]byte, 6)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	if header[0] != 6 || header[1] != 0x10 {
+		return 0, nil, errors.New("invalid KNXnet/IP header")
+	}
+	length := int(binary.BigEndian.Uint16(header[4:]))
+	if length < 6 {
+		return 0, nil, errors.New("invalid KNXnet/IP frame length")
+	}
+	frame := make([]byte, length)
+	copy(frame, header)
+	if _, err := io.ReadFull(r, frame[6:]); err != nil {
+		return 0, nil, err
+	}
+	return knxnet.ServiceID(binary.BigEndian.Uint16(header[2:])), frame, nil
+}
+
+// secureMAC calculates the CBC-MAC of a frame, before encrypting it.
+func secureMAC(key, block0, ad, payload []byte) []byte {
+	data := make([]byte, 0, len(block0)+2+len(ad)+len(payload)+aes.BlockSize)
+	data = append(data, block0...)
+	data = binary.BigEndian.AppendUint16(data, uint16(len(ad)))
+	data = append(data, ad...)
+	data = append(data, payload...)
+	if n := len(data) % aes.BlockSize; n != 0 {
+		data = append(data, make([]byte, aes.BlockSize-n)...)
+	}
+	block, _ := aes.NewCipher(key)
+	cipher.NewCBCEncrypter(block, make([]byte, aes.BlockSize)).CryptBlocks(data, data)
+	return data[len(data)-aes.BlockSize:]
+}
+
+// secureCTR encrypts or decrypts a MAC and a payload in CTR mode, starting with counter0
+// for the MAC.
+func secureCTR(key, counter0, mac, payload []byte) (macOut, payloadOut []byte) {
+	block, _ := aes.NewCipher(key)
+	data := append(append([]byte{}, mac...), payload...)
+	cipher.NewCTR(block, counter0).XORKeyStream(data, data)
+	return data[:len(mac)], data[len(mac):]
+}
+
+// secureSession has the keys of a secure session and wraps and unwraps
+// the frames sent and received in it.  It is used by both ends.
+type secureSession struct {
+	id     uint16
+	key    []byte
+	serial []byte // serial number sent in the frames (6 bytes)
+
+	mu      sync.Mutex
+	seq     uint64 // sequence number of the next frame sent
+	lastSeq uint64 // sequence number of the last frame received + 1
+}
+
+// wrap encrypts a KNXnet/IP frame in a SECURE_WRAPPER frame.
+func (s *secureSession) wrap(frame []byte) []byte {
+	s.mu.Lock()
+	seq := s.seq
+	s.seq++
+	s.mu.Unlock()
+
+	info := make([]byte, 0, 16)
+	info = append(info, byte(seq>>40), byte(seq>>32), byte(seq>>24), byte(seq>>16), byte(seq>>8), byte(seq))
+	info = append(info, s.serial...)
+	info = append(info, 0, 0) // message tag
+	header := knxipHeader(SecureWrapperService, 2+len(info)+len(frame)+16)
+	ad := binary.BigEndian.AppendUint16(header, s.id)
+
+	mac := secureMAC(s.key, binary.BigEndian.AppendUint16(info, uint16(len(frame))), ad, frame)
+	mac, encrypted := secureCTR(s.key, append(info, 0xff, 0), mac, frame)
+
+	out := append(ad, info...)
+	out = append(out, encrypted...)
+	return append(out, mac...)
+}
+
+// unwrap decrypts a SECURE_WRAPPER frame and returns the frame in it.
+func (s *secureSession) unwrap(wrapper []byte) ([]byte, error) {
+	if len(wrapper) < 6+2+14+16 {
+		return nil, errors.New("secure wrapper too short")
+	}
+	if id := binary.BigEndian.Uint16(wrapper[6:]); id != s.id {
+		return nil, fmt.Errorf("secure wrapper for session %d, not %d", id, s.id)
+	}
+	ad := wrapper[:8]
+	info := wrapper[8:22] // sequence number, serial number and message tag
+	encrypted := wrapper[22 : len(wrapper)-16]
+
+	mac, frame := secureCTR(s.key, append(append([]byte{}, info...), 0xff, 0), wrapper[len(wrapper)-16:], encrypted)
+	block0 := binary.BigEndian.AppendUint16(append([]byte{}, info...), uint16(len(frame)))
+	if !hmac.Equal(mac, secureMAC(s.key, block0, ad, frame)) {
+		return nil, errors.New("secure wrapper with wrong MAC")
+	}
+	seq := uint64(info[0])<<40 | uint64(info[1])<<32 | uint64(info[2])<<24 | uint64(info[3])<<16 | uint64(info[4])<<8 | uint64(info[5])
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if seq < s.lastSeq {
+		return nil, fmt.Errorf("secure wrapper replayed (sequence number %d)", seq)
+	}
+	s.lastSeq = seq + 1
+	return frame, nil
+}
+
+// userPasswordKey and deviceAuthKey derive the keys used to authenticate
+// a secure session from the passwords in the keyring.
+func userPasswordKey(password string) []byte {
+	return pbkdf2([]byte(password), []byte("user-password.1.secure.ip.knx.org"), 65536, 16)
+}
+
+func deviceAuthKey(code string) []byte {
+	return pbkdf2([]byte(code), []byte("device-authentication-code.1.secure.ip.knx.org"), 65536, 16)
+}
+
+// SecureTunnel is a KNXnet/IP tunnel over TCP in a KNX IP Secure session.
+type SecureTunnel struct {
+	conn    net.Conn
+	session *secureSession
+	channel uint8
+
+	mu  sync.Mutex // serializes writes
+	seq uint8      // sequence number of the tunnelling requests
+
+	inbound chan cemi.Message
+	done    chan struct{}
+	once    sync.Once
+}
+
+// DialSecureTunnel connects to a KNX IP Secure gateway, authenticating
+// with the credentials of a tunnel from the keyring.
+func DialSecureTunnel(addr string, creds *KeyringInterface) (*TunnelConn, error) {
+	t, err := dialSecureTunnel(addr, creds)
+	if err != nil {
+		return nil, err
+	}
+	return newTunnelConn(t), nil
+}
+
+func dialSecureTunnel(addr string, creds *KeyringInterface) (*SecureTunnel, error) {
+	conn, err := net.DialTimeout("tcp", addr, SecureTimeout)
+	if err != nil {
+		return nil, err
+	}
+	t := &SecureTunnel{
+		conn:    conn,
+		inbound: make(chan cemi.Message, 16),
+		done:    make(chan struct{}),
+	}
+	conn.SetDeadline(time.Now().Add(SecureTimeout))
+	if err := t.handshake(creds); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	go t.serve()
+	go t.heartbeat()
+	return t, nil
+}
+
+// handshake establishes the secure session and connects the tunnel.
+func (t *SecureTunnel) handshake(creds *KeyringInterface) error {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	clientKey := priv.PublicKey().Bytes()
+
+	// SESSION_REQUEST: our public key
+	hpai := make([]byte, hpaiTCP.Size())
+	hpaiTCP.Pack(hpai)
+	req := append(knxipHeader(SessionRequestService, len(hpai)+len(clientKey)), hpai...)
+	if _, err := t.conn.Write(append(req, clientKey...)); err != nil {
+		return err
+	}
+
+	// SESSION_RESPONSE: session ID, public key of the server and MAC
+	service, res, err := readKNXIPFrame(t.conn)
+	if err != nil {
+		return err
+	}
+	if service == SessionStatusService && len(res) >= 7 {
+		return fmt.Errorf("secure session refused (status %d)", res[6])
+	}
+	if service != SessionResponseService || len(res) != 6+2+32+16 {
+		return fmt.Errorf("unexpected answer to session request (service %v)", service)
+	}
+	sessionID := binary.BigEndian.Uint16(res[6:])
+	serverKey, err := ecdh.X25519().NewPublicKey(res[8:40])
+	if err != nil {
+		return err
+	}
+	shared, err := priv.ECDH(serverKey)
+	if err != nil {
+		return err
+	}
+	keysXOR := make([]byte, 32)
+	for i := range keysXOR {
+		keysXOR[i] = clientKey[i] ^ res[8+i]
+	}
+	if creds.Authentication != "" {
+		key := deviceAuthKey(creds.Authentication)
+		mac, _ := secureCTR(key, counter0Handshake, res[40:56], nil)
+		ad := append(append(append([]byte{}, res[:6]...), res[6:8]...), keysXOR...)
+		if !hmac.Equal(mac, secureMAC(key, make([]byte, 16), ad, nil)) {
+			return errors.New("wrong device authentication code in session response")
+		}
+	} else {
+		logKNX.Warn("no device authentication code in keyring: not authenticating the gateway", "gateway", t.conn.RemoteAddr().String())
+	}
+	sessionKey := sha256.Sum256(shared)
+	t.session = &secureSession{id: sessionID, key: sessionKey[:16], serial: []byte{0x00, 0xfa, 0x4b, 0x4e, 0x58, 0x32}}
+
+	// SESSION_AUTHENTICATE: user ID and MAC with the user password
+	key := userPasswordKey(creds.Password)
+	auth := append(knxipHeader(SessionAuthenticateService, 2+16), 0, byte(creds.UserID))
+	mac := secureMAC(key, make([]byte, 16), append(append([]byte{}, auth...), keysXOR...), nil)
+	mac, _ = secureCTR(key, counter0Handshake, mac, nil)
+	if err := t.send(append(auth, mac...)); err != nil {
+		return err
+	}
+	status, err := t.receive()
+	if err != nil {
+		return err
+	}
+	if s, ok := status.(*knxnet.UnknownService); !ok || s.Service() != SessionStatusService || len(s.Data) < 1 {
+		return errors.New("unexpected answer to session authentication")
+	} else if s.Data[0] != SessionAuthSuccess {
+		return fmt.Errorf("secure session authentication failed (status %d)", s.Data[0])
+	}
+
+	// CONNECT_REQUEST for a tunnel
+	if err := t.sendService(&knxnet.ConnReq{Control: hpaiTCP, Tunnel: hpaiTCP, Layer: knxnet.TunnelLayerData}); err != nil {
+		return err
+	}
+	msg, err := t.receive()
+	if err != nil {
+		return err
+	}
+	connRes, ok := msg.(*knxnet.ConnRes)
+	if !ok {
+		return errors.New("unexpected answer to connection request")
+	}
+	if connRes.Status != knxnet.NoError {
+		return fmt.Errorf("tunnel connection refused: %w", connRes.Status)
+	}
+	t.channel = connRes.Channel
+	return nil
+}
+
+// send sends a frame wrapped in the secure session.
+func (t *SecureTunnel) send(frame []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, err := t.conn.Write(t.session.wrap(frame))
+	return err
+}
+
+func (t *SecureTunnel) sendService(srv knxnet.ServicePackable) error {
+	return t.send(knxnet.AllocAndPack(srv))
+}
+
+// receive reads a frame from the secure session.  Frames of other
+// services (other than SESSION_STATUS) are not accepted outside of it.
+func (t *SecureTunnel) receive() (knxnet.Service, error) {
+	service, frame, err := readKNXIPFrame(t.conn)
+	if err != nil {
+		return nil, err
+	}
+	switch service {
+	case SecureWrapperService:
+		frame, err = t.session.unwrap(frame)
+		if err != nil {
+			return nil, err
+		}
+	case SessionStatusService:
+	default:
+		return nil, fmt.Errorf("unexpected frame outside of secure session (service %v)", service)
+	}
+	var msg knxnet.Service
+	if _, err := knxnet.Unpack(frame, &msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// serve receives the frames from the gateway until the connection is closed.
+func (t *SecureTunnel) serve() {
+	defer close(t.inbound)
+	defer t.conn.Close()
+	for {
+		// heartbeats are answered, so nothing received means the connection is lost
+		t.conn.SetReadDeadline(time.Now().Add(SecureHeartbeat + SecureTimeout))
+		msg, err := t.receive()
+		if err != nil {
+			select {
+			case <-t.done:
+			default:
+				logKNX.Warn("secure tunnel closed", "gateway", t.conn.RemoteAddr().String(), "error", err)
+			}
+			return
+		}
+		switch msg := msg.(type) {
+		case *knxnet.TunnelReq:
+			// over TCP, tunnelling requests are not acknowledged
+			if msg.Channel != t.channel {
+				continue
+			}
+			select {
+			case t.inbound <- msg.Payload:
+			case <-t.done:
+				return
+			}
+		case *knxnet.ConnStateRes:
+			if msg.Status != knxnet.NoError {
+				logKNX.Warn("secure tunnel closed", "gateway", t.conn.RemoteAddr().String(), "error", msg.Status)
+				return
+			}
+		case *knxnet.DiscReq:
+			t.sendService(&knxnet.DiscRes{Channel: t.channel})
+			return
+		case *knxnet.DiscRes:
+			return
+		case *knxnet.UnknownService:
+			if msg.Service() == SessionStatusService && len(msg.Data) > 0 && msg.Data[0] != SessionKeepAlive {
+				logKNX.Warn("secure session closed", "gateway", t.conn.RemoteAddr().String(), "status", msg.Data[0])
+				return
+			}
+		}
+	}
+}
+
+// heartbeat sends connection state requests, which keep the session alive.
+func (t *SecureTunnel) heartbeat() {
+	tick := time.NewTicker(SecureHeartbeat)
+	defer tick.Stop()
+	for {
+		select {
+		case <-t.done:
+			return
+		case <-tick.C:
+			t.sendService(&knxnet.ConnStateReq{Channel: t.channel, Control: hpaiTCP})
+		}
+	}
+}
+
+// Send sends a cEMI message through the tunnel.
+func (t *SecureTunnel) Send(msg cemi.Message) error {
+	t.mu.Lock()
+	seq := t.seq
+	t.seq++
+	t.mu.Unlock()
+	return t.sendService(&knxnet.TunnelReq{Channel: t.channel, SeqNumber: seq, Payload: msg})
+}
+
+// Inbound returns the channel on which the cEMI messages are received.
+// It is closed when the connection is lost.
+func (t *SecureTunnel) Inbound() <-chan cemi.Message {
+	return t.inbound
+}
+
+// Close disconnects the tunnel and closes the secure session.
+func (t *SecureTunnel) Close() {
+	t.once.Do(func() {
+		close(t.done)
+		t.sendService(&knxnet.DiscReq{Channel: t.channel, Control: hpaiTCP})
+		t.send(append(knxipHeader(SessionStatusService, 2), SessionClose, 0))
+		t.conn.Close()
+	})
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vapourismo/knx-go/knx"
+	"github.com/vapourismo/knx-go/knx/cemi"
+	"github.com/vapourismo/knx-go/knx/knxnet"
+)
+
+// secureServer is a stand-in for a KNX IP Secure gateway with one tunnel.
+type secureServer struct {
+	t        *testing.T
+	ln       net.Listener
+	password string // user password of the tunnel
+	auth     string // device authentication code
+
+	conn    net.Conn
+	session *secureSession
+	ready   chan struct{} // closed when the tunnel is connected
+}
+
+func startSecureServer(t *testing.T, password, auth string) *secureServer {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &secureServer{t: t, ln: ln, password: password, auth: auth, ready: make(chan struct{})}
+	t.Cleanup(func() {
+		ln.Close()
+		if s.conn != nil {
+			s.conn.Close()
+		}
+	})
+	go s.serve()
+	return s
+}
+
+func (s *secureServer) serve() {
+	conn, err := s.ln.Accept()
+	if err != nil {
+		return
+	}
+	s.conn = conn
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	service, req, err := readKNXIPFrame(conn)
+	if err != nil || service != SessionRequestService || len(req) != 6+8+32 {
+		s.t.Errorf("wrong session request: %v %x", err, req)
+		return
+	}
+	clientKey, err := ecdh.X25519().NewPublicKey(req[14:])
+	if err != nil {
+		s.t.Error(err)
+		return
+	}
+	priv, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	shared, _ := priv.ECDH(clientKey)
+	sessionKey := sha256.Sum256(shared)
+	s.session = &secureSession{id: 1, key: sessionKey[:16], serial: []byte{0, 0xfa, 0, 0, 0, 1}}
+	keysXOR := make([]byte, 32)
+	for i := range keysXOR {
+		keysXOR[i] = req[14+i] ^ priv.PublicKey().Bytes()[i]
+	}
+
+	res := binary.BigEndian.AppendUint16(knxipHeader(SessionResponseService, 2+32+16), s.session.id)
+	res = append(res, priv.PublicKey().Bytes()...)
+	key := deviceAuthKey(s.auth)
+	mac := secureMAC(key, make([]byte, 16), append(append([]byte{}, res[:8]...), keysXOR...), nil)
+	mac, _ = secureCTR(key, counter0Handshake, mac, nil)
+	conn.Write(append(res, mac...))
+
+	auth := s.receive()
+	if auth == nil {
+		// the client did not accept the response
+		return
+	}
+	if len(auth) != 6+2+16 || binary.BigEndian.Uint16(auth[2:]) != uint16(SessionAuthenticateService) {
+		s.t.Errorf("wrong session authenticate: %x", auth)
+		return
+	}
+	key = userPasswordKey(s.password)
+	mac, _ = secureCTR(key, counter0Handshake, auth[8:], nil)
+	status := byte(SessionAuthSuccess)
+	if !hmac.Equal(mac, secureMAC(key, make([]byte, 16), append(append([]byte{}, auth[:8]...), keysXOR...), nil)) {
+		status = SessionAuthFailed
+	}
+	s.send(append(knxipHeader(SessionStatusService, 2), status, 0))
+	if status != SessionAuthSuccess {
+		return
+	}
+
+	var msg knxnet.Service
+	if _, err := knxnet.Unpack(s.receive(), &msg); err != nil {
+		s.t.Error(err)
+		return
+	}
+	if _, ok := msg.(*knxnet.ConnReq); !ok {
+		s.t.Errorf("expected connection request, received %T", msg)
+		return
+	}
+	s.send(knxnet.AllocAndPack(&knxnet.ConnRes{Channel: 7, Control: hpaiTCP}))
+	close(s.ready)
+}
+
+// receive reads a frame from the client and unwraps it.  It returns nil
+// if the client closes the connection.
+func (s *secureServer) receive() []byte {
+	service, frame, err := readKNXIPFrame(s.conn)
+	if err != nil {
+		return nil
+	}
+	if service != SecureWrapperService {
+		s.t.Errorf("expected secure wrapper: %v %x", err, frame)
+		return nil
+	}
+	frame, err = s.session.unwrap(frame)
+	if err != nil {
+		s.t.Error(err)
+		return nil
+	}
+	return frame
+}
+
+func (s *secureServer) send(frame []byte) {
+	s.conn.Write(s.session.wrap(frame))
+}
+
+func TestSecureTunnel(t *testing.T) {
+	creds := &KeyringInterface{Type: "Tunneling", UserID: 2, Password: "tunnel2pass", Authentication: "devauth"}
+	s := startSecureServer(t, creds.Password, creds.Authentication)
+	conn, err := DialSecureTunnel(s.ln.Addr().String(), creds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	<-s.ready
+
+	// a group telegram from the bus
+	ind := &cemi.LDataInd{LData: cemi.LData{
+		Control1:    cemi.Control1StdFrame,
+		Control2:    cemi.Control2GroupAddr,
+		Source:      0x1105,
+		Destination: uint16(cemi.NewGroupAddr3(5, 0, 27)),
+		Data:        &cemi.AppData{Command: cemi.GroupValueWrite, Data: []byte{1}},
+	}}
+	s.send(knxnet.AllocAndPack(&knxnet.TunnelReq{Channel: 7, Payload: ind}))
+	select {
+	case e := <-conn.Inbound():
+		if e.Command != knx.GroupWrite || e.Source != 0x1105 || e.Destination != cemi.NewGroupAddr3(5, 0, 27) {
+			t.Errorf("received %+v", e)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no group event received")
+	}
+
+	// a group telegram to the bus
+	if err := conn.Send(knx.GroupEvent{Command: knx.GroupRead, Destination: cemi.NewGroupAddr3(1, 2, 3)}); err != nil {
+		t.Fatal(err)
+	}
+	var msg knxnet.Service
+	if _, err := knxnet.Unpack(s.receive(), &msg); err != nil {
+		t.Fatal(err)
+	}
+	req, ok := msg.(*knxnet.TunnelReq)
+	if !ok || req.Channel != 7 {
+		t.Fatalf("expected tunnelling request, received %+v", msg)
+	}
+	if r, ok := req.Payload.(*cemi.LDataReq); !ok || r.Destination != uint16(cemi.NewGroupAddr3(1, 2, 3)) {
+		t.Errorf("wrong telegram %+v", req.Payload)
+	}
+
+	// closing disconnects the tunnel and the session
+	conn.Close()
+	if _, err := knxnet.Unpack(s.receive(), &msg); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := msg.(*knxnet.DiscReq); !ok {
+		t.Errorf("expected disconnection request, received %+v", msg)
+	}
+	if status := s.receive(); len(status) != 8 || status[6] != SessionClose {
+		t.Errorf("expected session close, received %x", status)
+	}
+}
+
+func TestSecureTunnelRefused(t *testing.T) {
+	creds := &KeyringInterface{Type: "Tunneling", UserID: 2, Password: "tunnel2pass", Authentication: "devauth"}
+	tests := []struct {
+		name           string
+		password, auth string
+		err            string
+	}{
+		{"wrong password", "other", creds.Authentication, "authentication failed"},
+		{"wrong device authentication", creds.Password, "other", "device authentication"},
+	}
+	for _, test := range tests {
+		s := startSecureServer(t, test.password, test.auth)
+		_, err := DialSecureTunnel(s.ln.Addr().String(), creds)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: error %v", test.name, err)
+		}
+	}
+}
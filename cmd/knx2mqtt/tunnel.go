@@ -0,0 +1,112 @@
+package main
+
+import (
+	"github.com/vapourismo/knx-go/knx"
+	"github.com/vapourismo/knx-go/knx/cemi"
+	"github.com/vapourismo/knx-go/knx/knxnet"
+)
+
+// cemiConn is a tunnel which sends and receives cEMI messages:
+// a knx.Tunnel or a SecureTunnel.
+type cemiConn interface {
+	Send(msg cemi.Message) error
+	Inbound() <-chan cemi.Message
+	Close()
+}
+
+// TunnelConn is a KNXnet/IP tunnel which, unlike knx.GroupTunnel, does not
+// discard the point-to-point telegrams, so it can be used for device management.
+type TunnelConn struct {
+	tunnel  cemiConn
+	inbound chan knx.GroupEvent
+	p2p     chan cemi.LData
+}
+
+// DialTunnel connects to a KNXnet/IP gateway.
+func DialTunnel(addr string) (*TunnelConn, error) {
+	tunnel, err := knx.NewTunnel(addr, knxnet.TunnelLayerData, knx.DefaultTunnelConfig)
+	if err != nil {
+		return nil, err
+	}
+	return newTunnelConn(tunnel), nil
+}
+
+func newTunnelConn(tunnel cemiConn) *TunnelConn {
+	t := &TunnelConn{
+		tunnel:  tunnel,
+		inbound: make(chan knx.GroupEvent),
+		p2p:     make(chan cemi.LData, 16),
+	}
+	go t.serve()
+	return t
+}
+
+// serve splits the telegrams received in group events and point-to-point
+// telegrams.  The latter are discarded if nobody is reading them.
+func (t *TunnelConn) serve() {
+	defer close(t.inbound)
+	for msg := range t.tunnel.Inbound() {
+		ind, ok := msg.(*cemi.LDataInd)
+		if !ok {
+			continue
+		}
+		if !ind.Control2.IsGroupAddr() {
+			select {
+			case t.p2p <- ind.LData:
+			default:
+			}
+			continue
+		}
+		app, ok := ind.Data.(*cemi.AppData)
+		if !ok || !app.Command.IsGroupCommand() {
+			continue
+		}
+		t.inbound <- knx.GroupEvent{
+			Command:     knx.GroupCommand(app.Command),
+			Source:      ind.Source,
+			Destination: cemi.GroupAddr(ind.Destination),
+			Data:        app.Data,
+		}
+	}
+}
+
+// Send a group telegram.
+func (t *TunnelConn) Send(event knx.GroupEvent) error {
+	ldata := cemi.LData{
+		Control1:    cemi.Control1NoRepeat | cemi.Control1NoSysBroadcast | cemi.Control1WantAck | cemi.Control1Prio(cemi.PrioLow),
+		Control2:    cemi.Control2GroupAddr | cemi.Control2Hops(6),
+		Destination: uint16(event.Destination),
+		Data:        &cemi.AppData{Command: cemi.APCI(event.Command), Data: event.Data},
+	}
+	if len(event.Data) <= 15 {
+		ldata.Control1 |= cemi.Control1StdFrame
+	}
+	return t.tunnel.Send(&cemi.LDataReq{LData: ldata})
+}
+
+// Close disconnects the tunnel.
+func (t *TunnelConn) Close() {
+	t.tunnel.Close()
+}
+
+// Inbound returns the channel on which group telegrams are received.
+func (t *TunnelConn) Inbound() <-chan knx.GroupEvent {
+	return t.inbound
+}
+
+// SendTo sends a transport unit to an individual address.
+func (t *TunnelConn) SendTo(dst cemi.IndividualAddr, tpdu cemi.TransportUnit) error {
+	ldata := cemi.LData{
+		Control1:    cemi.Control1StdFrame | cemi.Control1NoRepeat | cemi.Control1NoSysBroadcast | cemi.Control1WantAck | cemi.Control1Prio(cemi.PrioLow),
+		Control2:    cemi.Control2Hops(6),
+		Destination: uint16(dst),
+		Data:        tpdu,
+	}
+	return t.tunnel.Send(&cemi.LDataReq{LData: ldata})
+}
+
+// PointToPoint returns the channel on which telegrams sent to
+// individual addresses are received.
+func (t *TunnelConn) PointToPoint() <-chan cemi.LData {
+	return t.p2p
+}
@@ -3,10 +3,11 @@ package main
 import (
 	"flag"
 	"fmt"
-	"log"
+	"os"
 	"time"
 
-	"github.com/at-wat/mqtt-go"
+	"github.com/cespedes/knx2mqtt/internal/logging"
+	"github.com/cespedes/knx2mqtt/internal/mqttclient"
 	"github.com/sj14/astral/pkg/astral"
 )
 
@@ -14,18 +15,24 @@ const (
 	MQTTPort = 1883
 )
 
+var (
+	logMQTT   = logging.Get("mqtt")
+	logConfig = logging.Get("config")
+	logTimer  = logging.Get("timer")
+)
+
 type Config struct {
-	Debug      bool
-	MQTTServer string
-	MQTTPrefix string
-	Lat        float64
-	Lon        float64
-	Elev       float64
+	Logging     *logging.Config
+	MQTTServer  string
+	MQTTPrefix  string
+	MQTTVersion mqttclient.Version
+	Lat         float64
+	Lon         float64
+	Elev        float64
 }
 
 type Server struct {
-	debug      bool
-	mqtt       mqtt.Client
+	mqtt       *mqttclient.Client
 	mqttPrefix string
 	observer   astral.Observer
 	last       struct {
@@ -79,16 +86,15 @@ func formatDuration(d time.Duration) string {
 }
 
 func announce(s *Server, key, value string) {
-	if s.debug {
-		log.Printf("MQTT: %s = %s\n", key, value)
+	logMQTT.Debug("publishing", "key", key, "value", value)
+	err := s.mqtt.Publish(fmt.Sprintf("%s/%s", s.mqttPrefix, key), value)
+	if err != nil {
+		logMQTT.Error("could not publish", "key", key, "error", err)
 	}
-	mqttPublish(s.mqtt, fmt.Sprintf("%s/%s", s.mqttPrefix, key), value)
 }
 
 func loop(s *Server, t time.Time) {
-	if s.debug {
-		log.Printf("tick: %s\n", t.Format("2006-01-02/15:04:05.000000"))
-	}
+	logTimer.Debug("tick", "time", t.Format("2006-01-02/15:04:05.000000"))
 
 	if s.last.nextSunrise == (time.Time{}) || t.After(s.last.nextSunrise) {
 		fSunrise := func(observer astral.Observer, t time.Time) time.Time {
@@ -170,37 +176,35 @@ func loop(s *Server, t time.Time) {
 func main() {
 	var err error
 	var config Config
-	flag.BoolVar(&config.Debug, "debug", false, "Debugging")
+	config.Logging = logging.AddFlags(flag.CommandLine)
 	flag.StringVar(&config.MQTTServer, "mqtt", "", "MQTT server")
 	flag.StringVar(&config.MQTTPrefix, "mqtt-prefix", "timer", "MQTT prefix to use")
+	flag.Var(&config.MQTTVersion, "mqtt-version", "MQTT protocol version (3.1.1 or 5)")
 	flag.Float64Var(&config.Lat, "lat", 40.417, "Latitude (degrees)")
 	flag.Float64Var(&config.Lon, "lon", -3.703, "Longitude (degrees)")
 	flag.Float64Var(&config.Elev, "elev", 650, "Elevation (meters)")
 	flag.Parse()
 
-	if config.Debug {
-		log.Printf("config = %+v\n", config)
+	if err := logging.Setup(config.Logging, "time2mqtt"); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
+	logConfig.Debug("configuration read", "config", fmt.Sprintf("%+v", config))
 
 	if len(config.MQTTServer) == 0 {
-		log.Fatalf("No MQTT server specified")
+		logging.Fatal(logConfig, "no MQTT server specified")
 	}
 
 	var server Server
-	server.debug = config.Debug
 	server.mqttPrefix = config.MQTTPrefix
 
 	// get channel to write MQTT messages
-	if config.Debug {
-		log.Printf("connecting to MQTT server %s\n", config.MQTTServer)
-	}
-	server.mqtt, err = mqttConnect(config.MQTTServer, MQTTPort)
+	logMQTT.Debug("connecting", "server", config.MQTTServer)
+	server.mqtt, err = mqttclient.New(config.MQTTServer, MQTTPort, mqttclient.Options{Version: config.MQTTVersion})
 	if err != nil {
-		log.Fatalf("MQTT: Could not connect to %q: %v", config.MQTTServer, err)
-	}
-	if config.Debug {
-		log.Printf("MQTT: Connected.")
+		logging.Fatal(logMQTT, "could not connect", "server", config.MQTTServer, "error", err)
 	}
+	logMQTT.Info("connected", "server", config.MQTTServer)
 
 	server.observer = astral.Observer{Latitude: config.Lat, Longitude: config.Lon, Elevation: config.Elev}
 
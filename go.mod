@@ -1,17 +1,21 @@
 module github.com/cespedes/knx2mqtt
 
-go 1.17
+go 1.21
 
 require (
 	github.com/at-wat/mqtt-go v0.16.0
-	github.com/gorilla/websocket v1.4.2
+	github.com/eclipse/paho.golang v0.22.0
+	github.com/mochi-mqtt/server/v2 v2.7.9
 	github.com/sj14/astral v0.2.0
 	github.com/vapourismo/knx-go v0.0.0-20220125154407-729c89830c6e
 )
 
 require (
-	golang.org/x/net v0.0.0-20220127200216-cd36cc0744dd // indirect
-	golang.org/x/text v0.3.7 // indirect
+	github.com/gorilla/websocket v1.5.3 // indirect
+	github.com/rs/xid v1.4.0 // indirect
+	golang.org/x/net v0.33.0 // indirect
+	golang.org/x/text v0.21.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
 
 replace github.com/vapourismo/knx-go => ../knx-go
@@ -0,0 +1,122 @@
+// Package cfgfile reads the lines of the config files shared by knx2mqtt-pretty
+// and knx2mqtt-log (knx.cfg), following their include lines.
+//
+// Each command parses the lines itself; this package only strips comments and
+// empty lines, splits them in tokens and replaces the lines
+//
+//	include file.cfg
+//	include dir/*.cfg
+//
+// with the lines of the included files (in lexical order for patterns).
+// Relative paths are relative to the directory of the file with the include.
+package cfgfile
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Line is a non-empty line of a config file, without comments.
+type Line struct {
+	File   string // name of the file, as given in Read or in the include line
+	Num    int    // line number in File
+	Tokens []string
+}
+
+func (l Line) String() string {
+	return fmt.Sprintf("%s line %d", l.File, l.Num)
+}
+
+// Read returns the lines of the config file filename and of the files included in it.
+// The errors in include lines cite the file and line number of the include.
+func Read(filename string) ([]Line, error) {
+	var r reader
+	if err := r.read(filename, nil); err != nil {
+		return nil, err
+	}
+	return r.lines, nil
+}
+
+type reader struct {
+	lines []Line
+	stack []string // absolute paths of the files being read, to detect cycles
+}
+
+func (r *reader) read(filename string, from *Line) error {
+	abs, err := filepath.Abs(filename)
+	if err != nil {
+		return err
+	}
+	for i, f := range r.stack {
+		if f == abs {
+			cycle := append(append([]string{}, r.stack[i:]...), abs)
+			return fmt.Errorf("error in %s: include cycle: %s", from, strings.Join(cycle, " -> "))
+		}
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		if from != nil {
+			return fmt.Errorf("error in %s: %w", from, err)
+		}
+		return err
+	}
+	defer f.Close()
+	r.stack = append(r.stack, abs)
+	defer func() { r.stack = r.stack[:len(r.stack)-1] }()
+
+	s := bufio.NewScanner(f)
+	lineNum := 0
+	for s.Scan() {
+		lineNum++
+		line := strings.TrimSpace(s.Text())
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			// strip comments
+			line = strings.TrimSpace(line[0:i])
+		}
+		if len(line) == 0 {
+			// empty line
+			continue
+		}
+		l := Line{File: filename, Num: lineNum, Tokens: strings.Fields(line)}
+		if l.Tokens[0] != "include" {
+			r.lines = append(r.lines, l)
+			continue
+		}
+		if len(l.Tokens) != 2 {
+			return fmt.Errorf("syntax error in %s", l)
+		}
+		if err := r.include(l); err != nil {
+			return err
+		}
+	}
+	if err := s.Err(); err != nil {
+		return fmt.Errorf("error reading %s: %w", filename, err)
+	}
+	return nil
+}
+
+// include reads the files of an include line.  A pattern may match no files,
+// but a file without wildcards must exist.
+func (r *reader) include(l Line) error {
+	pattern := l.Tokens[1]
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(filepath.Dir(l.File), pattern)
+	}
+	files := []string{pattern}
+	if strings.ContainsAny(pattern, "*?[") {
+		var err error
+		files, err = filepath.Glob(pattern)
+		if err != nil {
+			return fmt.Errorf("error in %s: %w", l, err)
+		}
+	}
+	for _, file := range files {
+		if err := r.read(file, &l); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package cfgfile
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeFiles writes the files, with names relative to a new temporary directory,
+// and returns the directory.
+func writeFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, contents := range files {
+		filename := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(filename), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filename, []byte(contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestRead(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"knx.cfg": `# main file
+mqtt-server 127.0.0.1
+include sub/devices.cfg   # nested include
+
+address 1/1/1 1.001 kitchen/light
+`,
+		"sub/devices.cfg": `
+device 1.1.1 a
+include ../knx.d/*.cfg
+include ../empty.d/*.cfg
+device 1.1.2 b
+`,
+		"knx.d/20-hall.cfg":    "address 2/1/1 1.001 hall/light\n",
+		"knx.d/10-kitchen.cfg": "\taddress 1/2/1 9.001   kitchen/temperature  \n\naddress 1/2/2 9.001 kitchen/setpoint\n",
+		"knx.d/notes.txt":      "not included\n",
+	})
+	lines, err := Read(filepath.Join(dir, "knx.cfg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := func(name string) string { return filepath.Join(dir, name) }
+	want := []Line{
+		{file("knx.cfg"), 2, []string{"mqtt-server", "127.0.0.1"}},
+		{file("sub/devices.cfg"), 2, []string{"device", "1.1.1", "a"}},
+		{file("knx.d/10-kitchen.cfg"), 1, []string{"address", "1/2/1", "9.001", "kitchen/temperature"}},
+		{file("knx.d/10-kitchen.cfg"), 3, []string{"address", "1/2/2", "9.001", "kitchen/setpoint"}},
+		{file("knx.d/20-hall.cfg"), 1, []string{"address", "2/1/1", "1.001", "hall/light"}},
+		{file("sub/devices.cfg"), 5, []string{"device", "1.1.2", "b"}},
+		{file("knx.cfg"), 5, []string{"address", "1/1/1", "1.001", "kitchen/light"}},
+	}
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("lines:\n%v\nwant:\n%v", lines, want)
+	}
+	// problems found in the lines are reported with the included file and line
+	if s := lines[3].String(); s != file("knx.d/10-kitchen.cfg")+" line 3" {
+		t.Errorf("line %s", s)
+	}
+}
+
+func TestReadErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		err   string // with "DIR/" instead of the directory
+	}{
+		{"cycle", map[string]string{
+			"knx.cfg": "include a.cfg\n",
+			"a.cfg":   "device 1.1.1 a\ninclude b.cfg\n",
+			"b.cfg":   "\ninclude a.cfg\n",
+		}, "error in DIR/b.cfg line 2: include cycle: DIR/a.cfg -> DIR/b.cfg -> DIR/a.cfg"},
+		{"itself", map[string]string{
+			"knx.cfg": "include knx.cfg\n",
+		}, "error in DIR/knx.cfg line 1: include cycle: DIR/knx.cfg -> DIR/knx.cfg"},
+		{"missing include", map[string]string{
+			"knx.cfg": "mqtt-server 127.0.0.1\ninclude devices.cfg\n",
+		}, "error in DIR/knx.cfg line 2: open DIR/devices.cfg: no such file or directory"},
+		{"syntax", map[string]string{
+			"knx.cfg": "include a.cfg b.cfg\n",
+		}, "syntax error in DIR/knx.cfg line 1"},
+		{"pattern", map[string]string{
+			"knx.cfg": "include [.cfg\n",
+		}, "error in DIR/knx.cfg line 1: syntax error in pattern"},
+	}
+	for _, test := range tests {
+		dir := writeFiles(t, test.files)
+		_, err := Read(filepath.Join(dir, "knx.cfg"))
+		want := strings.ReplaceAll(test.err, "DIR/", dir+string(filepath.Separator))
+		if err == nil || err.Error() != want {
+			t.Errorf("%s: error %v, want %s", test.name, err, want)
+		}
+	}
+
+	_, err := Read(filepath.Join(t.TempDir(), "knx.cfg"))
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("missing file: error %v", err)
+	}
+}
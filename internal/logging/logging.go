@@ -0,0 +1,240 @@
+// Package logging provides levelled, structured logging shared by all the commands.
+//
+// Each subsystem (KNX, MQTT, config...) gets its own *slog.Logger with Get.
+// The loggers can be created at any time; their level, format and output
+// are taken from the flags registered by AddFlags once Setup is called.
+package logging
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Config holds the logging options.
+type Config struct {
+	Level  string // default level, optionally followed by subsystem=level pairs: "info,knx=debug"
+	Format string // "text" (logfmt) or "json"
+	Output string // "stderr", "stdout" or "syslog"
+	Debug  bool   // shortcut for Level="debug"
+}
+
+// AddFlags registers the logging flags in fs.
+func AddFlags(fs *flag.FlagSet) *Config {
+	var c Config
+	fs.StringVar(&c.Level, "log-level", "info", "Log level (debug, info, warn, error), optionally per subsystem: \"info,knx=debug\"")
+	fs.StringVar(&c.Format, "log-format", "text", "Log format (text or json)")
+	fs.StringVar(&c.Output, "log-output", "stderr", "Log output (stderr, stdout or syslog)")
+	fs.BoolVar(&c.Debug, "debug", false, "Debugging (same as -log-level debug)")
+	return &c
+}
+
+type state struct {
+	handler slog.Handler
+	level   slog.Level
+	levels  map[string]slog.Level
+}
+
+var (
+	mu      sync.RWMutex
+	current = state{
+		handler: slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug}),
+		level:   slog.LevelInfo,
+	}
+)
+
+func parseLevel(s string) (slog.Level, error) {
+	var l slog.Level
+	err := l.UnmarshalText([]byte(s))
+	return l, err
+}
+
+// Setup configures all the loggers according to c.
+func Setup(c *Config, program string) error {
+	s := state{levels: make(map[string]slog.Level)}
+	for i, part := range strings.Split(c.Level, ",") {
+		part = strings.TrimSpace(part)
+		if i == 0 && !strings.Contains(part, "=") {
+			l, err := parseLevel(part)
+			if err != nil {
+				return fmt.Errorf("-log-level: %w", err)
+			}
+			s.level = l
+			continue
+		}
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("-log-level: invalid subsystem level %q", part)
+		}
+		l, err := parseLevel(kv[1])
+		if err != nil {
+			return fmt.Errorf("-log-level: %w", err)
+		}
+		s.levels[kv[0]] = l
+	}
+	if c.Debug {
+		s.level = slog.LevelDebug
+	}
+
+	var w io.Writer
+	var sw *levelWriters // syslog has a writer for each level
+	switch c.Output {
+	case "", "stderr":
+		w = os.Stderr
+	case "stdout":
+		w = os.Stdout
+	case "syslog":
+		var err error
+		sw, err = newSyslogWriters(program)
+		if err != nil {
+			return fmt.Errorf("-log-output: %w", err)
+		}
+	default:
+		return fmt.Errorf("-log-output: unknown output %q", c.Output)
+	}
+
+	opts := &slog.HandlerOptions{Level: slog.LevelDebug}
+	if c.Output == "syslog" {
+		// syslog adds its own timestamp
+		opts.ReplaceAttr = func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey && len(groups) == 0 {
+				return slog.Attr{}
+			}
+			return a
+		}
+	}
+	var newHandler func(io.Writer, *slog.HandlerOptions) slog.Handler
+	switch c.Format {
+	case "", "text":
+		newHandler = func(w io.Writer, opts *slog.HandlerOptions) slog.Handler { return slog.NewTextHandler(w, opts) }
+	case "json":
+		newHandler = func(w io.Writer, opts *slog.HandlerOptions) slog.Handler { return slog.NewJSONHandler(w, opts) }
+	default:
+		return fmt.Errorf("-log-format: unknown format %q", c.Format)
+	}
+	if sw != nil {
+		s.handler = &levelHandler{
+			Error: newHandler(sw.Error, opts),
+			Warn:  newHandler(sw.Warn, opts),
+			Info:  newHandler(sw.Info, opts),
+			Debug: newHandler(sw.Debug, opts),
+		}
+	} else {
+		s.handler = newHandler(w, opts)
+	}
+
+	mu.Lock()
+	current = s
+	mu.Unlock()
+	return nil
+}
+
+// Get returns the logger for a subsystem.
+func Get(subsystem string) *slog.Logger {
+	return slog.New(&handler{subsystem: subsystem})
+}
+
+// Fatal logs msg as an error and exits the program.
+func Fatal(l *slog.Logger, msg string, args ...any) {
+	l.Error(msg, args...)
+	os.Exit(1)
+}
+
+// handler sends the records to the handler configured by Setup,
+// filtering them by the level of its subsystem.
+type handler struct {
+	subsystem string
+	ops       []func(slog.Handler) slog.Handler // WithAttrs and WithGroup calls, in order
+}
+
+func (h *handler) Enabled(_ context.Context, level slog.Level) bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	if l, ok := current.levels[h.subsystem]; ok {
+		return level >= l
+	}
+	return level >= current.level
+}
+
+func (h *handler) Handle(ctx context.Context, r slog.Record) error {
+	mu.RLock()
+	base := current.handler
+	mu.RUnlock()
+	base = base.WithAttrs([]slog.Attr{slog.String("subsystem", h.subsystem)})
+	for _, op := range h.ops {
+		base = op(base)
+	}
+	return base.Handle(ctx, r)
+}
+
+func (h *handler) with(op func(slog.Handler) slog.Handler) *handler {
+	ops := make([]func(slog.Handler) slog.Handler, len(h.ops), len(h.ops)+1)
+	copy(ops, h.ops)
+	return &handler{subsystem: h.subsystem, ops: append(ops, op)}
+}
+
+func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.with(func(base slog.Handler) slog.Handler {
+		return base.WithAttrs(attrs)
+	})
+}
+
+func (h *handler) WithGroup(name string) slog.Handler {
+	return h.with(func(base slog.Handler) slog.Handler {
+		return base.WithGroup(name)
+	})
+}
+
+// levelWriters are the outputs of the messages of each level,
+// to send them to syslog with different priorities.
+type levelWriters struct {
+	Error, Warn, Info, Debug io.Writer
+}
+
+// levelHandler sends each record to the handler of its level.
+type levelHandler struct {
+	Error, Warn, Info, Debug slog.Handler
+}
+
+func (h *levelHandler) handler(level slog.Level) slog.Handler {
+	switch {
+	case level >= slog.LevelError:
+		return h.Error
+	case level >= slog.LevelWarn:
+		return h.Warn
+	case level >= slog.LevelInfo:
+		return h.Info
+	}
+	return h.Debug
+}
+
+func (h *levelHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.handler(level).Enabled(ctx, level)
+}
+
+func (h *levelHandler) Handle(ctx context.Context, r slog.Record) error {
+	return h.handler(r.Level).Handle(ctx, r)
+}
+
+func (h *levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &levelHandler{
+		Error: h.Error.WithAttrs(attrs),
+		Warn:  h.Warn.WithAttrs(attrs),
+		Info:  h.Info.WithAttrs(attrs),
+		Debug: h.Debug.WithAttrs(attrs),
+	}
+}
+
+func (h *levelHandler) WithGroup(name string) slog.Handler {
+	return &levelHandler{
+		Error: h.Error.WithGroup(name),
+		Warn:  h.Warn.WithGroup(name),
+		Info:  h.Info.WithGroup(name),
+		Debug: h.Debug.WithGroup(name),
+	}
+}
@@ -0,0 +1,30 @@
+package logging
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestLevelHandler(t *testing.T) {
+	var bufs [4]bytes.Buffer
+	opts := &slog.HandlerOptions{Level: slog.LevelDebug}
+	h := &levelHandler{
+		Error: slog.NewTextHandler(&bufs[0], opts),
+		Warn:  slog.NewTextHandler(&bufs[1], opts),
+		Info:  slog.NewTextHandler(&bufs[2], opts),
+		Debug: slog.NewTextHandler(&bufs[3], opts),
+	}
+	l := slog.New(h).With("subsystem", "knx")
+	l.Error("e")
+	l.Warn("w")
+	l.Info("i")
+	l.Debug("d")
+	for i, msg := range []string{"msg=e", "msg=w", "msg=i", "msg=d"} {
+		out := bufs[i].String()
+		if strings.Count(out, "\n") != 1 || !strings.Contains(out, msg) || !strings.Contains(out, "subsystem=knx") {
+			t.Errorf("output %d: %q", i, out)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+//go:build !windows && !plan9
+
+package logging
+
+import (
+	"log/syslog"
+)
+
+// newSyslogWriters returns the writers to send the messages to syslog with
+// the priority of each level: error, warning, info and debug.
+func newSyslogWriters(program string) (*levelWriters, error) {
+	w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, program)
+	if err != nil {
+		return nil, err
+	}
+	return &levelWriters{
+		Error: writerFunc(w.Err),
+		Warn:  writerFunc(w.Warning),
+		Info:  writerFunc(w.Info),
+		Debug: writerFunc(w.Debug),
+	}, nil
+}
+
+// writerFunc is a syslog.Writer method used as an io.Writer.
+type writerFunc func(string) error
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	if err := f(string(p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
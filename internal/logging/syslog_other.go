@@ -0,0 +1,11 @@
+//go:build windows || plan9
+
+package logging
+
+import (
+	"errors"
+)
+
+func newSyslogWriters(program string) (*levelWriters, error) {
+	return nil, errors.New("syslog is not supported on this system")
+}
@@ -0,0 +1,318 @@
+// Package mqttclient is the MQTT client shared by all the commands.
+//
+// It keeps the connection to the server, reconnecting and subscribing again
+// to every topic when it is lost, and speaks MQTT 3.1.1 (the default) or
+// MQTT v5.  With v5 the messages can carry a content type, user properties,
+// a message expiry and a response topic with correlation data, and the reason
+// codes sent by the server are returned in the errors and logged.
+// With 3.1.1 those fields are ignored when publishing and empty when receiving.
+package mqttclient
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cespedes/knx2mqtt/internal/logging"
+)
+
+var logMQTT = logging.Get("mqtt")
+
+// Version is the MQTT protocol version, as sent in the CONNECT packet.
+// It can be used as a flag.Value.
+type Version int
+
+const (
+	V311 Version = 4 // MQTT 3.1.1 (the zero Version is the same)
+	V5   Version = 5 // MQTT v5
+)
+
+func (v Version) String() string {
+	if v == V5 {
+		return "5"
+	}
+	return "3.1.1"
+}
+
+// Set parses "3.1.1" (or "4") and "5" (or "5.0").
+func (v *Version) Set(s string) error {
+	switch s {
+	case "3.1.1", "4":
+		*v = V311
+	case "5", "5.0":
+		*v = V5
+	default:
+		return fmt.Errorf("unsupported MQTT version %q (must be 3.1.1 or 5)", s)
+	}
+	return nil
+}
+
+// UserProperty is a name-value pair sent with a message (MQTT v5 only).
+// The same name can appear more than once.
+type UserProperty struct {
+	Key, Value string
+}
+
+// Message is a message published or received.
+type Message struct {
+	Topic   string
+	Payload []byte
+	Retain  bool
+
+	// MQTT v5 only:
+	ContentType     string
+	UserProperties  []UserProperty
+	Expiry          time.Duration // the server discards the message if it cannot deliver it in time (0: never)
+	ResponseTopic   string
+	CorrelationData []byte
+}
+
+// Property returns the value of the first user property named key, or "".
+func (m *Message) Property(key string) string {
+	for _, p := range m.UserProperties {
+		if p.Key == key {
+			return p.Value
+		}
+	}
+	return ""
+}
+
+// Options are the connection options.
+type Options struct {
+	Version Version
+	Will    *Message // published by the server if the connection is lost
+}
+
+// conn is a connection to the server using one of the protocol versions.
+// The messages received are passed to the handle function given when dialing.
+type conn interface {
+	publish(ctx context.Context, msg *Message) error
+	subscribe(ctx context.Context, topics ...string) error
+	disconnect(ctx context.Context) error
+	done() <-chan struct{}
+}
+
+type subscription struct {
+	topic string
+	ch    chan *Message
+}
+
+// Client is a connection to an MQTT server which is reestablished when lost.
+type Client struct {
+	server string
+	port   int
+	opts   Options
+
+	mutex         sync.Mutex
+	conn          conn
+	closed        bool
+	quit          chan struct{} // closed by Close, so that no message is waiting to be delivered
+	onReconnect   func()
+	subscriptions []subscription
+}
+
+func (c *Client) dial() (conn, error) {
+	addr := fmt.Sprintf("%s:%d", c.server, c.port)
+	id := fmt.Sprint(rand.Uint64())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	if c.opts.Version == V5 {
+		return dialV5(ctx, addr, id, c.opts.Will, c.handle)
+	}
+	return dialV311(ctx, addr, id, c.opts.Will, c.handle)
+}
+
+// New connects to an MQTT server.
+func New(server string, port int, opts Options) (*Client, error) {
+	c := &Client{server: server, port: port, opts: opts, quit: make(chan struct{})}
+
+	var err error
+	c.conn, err = c.dial()
+	if err != nil {
+		return nil, err
+	}
+	go c.keepConnected()
+	return c, nil
+}
+
+// keepConnected reconnects when the connection is lost, until Close is called.
+func (c *Client) keepConnected() {
+	for {
+		c.mutex.Lock()
+		done := c.conn.done()
+		c.mutex.Unlock()
+		<-done
+
+		c.mutex.Lock()
+		closed := c.closed
+		c.mutex.Unlock()
+		if closed {
+			return
+		}
+		// Connection closed; will have to reconnect
+		var conn conn
+		var err error
+		for {
+			time.Sleep(500 * time.Millisecond)
+			logMQTT.Warn("connection closed; reconnecting", "server", c.server)
+			conn, err = c.dial()
+			if err == nil {
+				break
+			}
+			logMQTT.Error("could not connect", "server", c.server, "error", err)
+			time.Sleep(500 * time.Millisecond)
+		}
+		c.mutex.Lock()
+		c.conn = conn
+		for _, sub := range c.subscriptions {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			err := conn.subscribe(ctx, sub.topic)
+			cancel()
+			if err != nil {
+				logMQTT.Error("could not subscribe", "topic", sub.topic, "error", err)
+			}
+		}
+		onReconnect := c.onReconnect
+		c.mutex.Unlock()
+		if onReconnect != nil {
+			onReconnect()
+		}
+	}
+}
+
+// handle sends a message received to the channels of the subscriptions
+// which match its topic.
+func (c *Client) handle(m *Message) {
+	var chans []chan *Message
+	c.mutex.Lock()
+	for _, sub := range c.subscriptions {
+		if !match(sub.topic, m.Topic) {
+			continue
+		}
+		dup := false
+		for _, ch := range chans {
+			dup = dup || ch == sub.ch
+		}
+		if !dup {
+			chans = append(chans, sub.ch)
+		}
+	}
+	c.mutex.Unlock()
+	for _, ch := range chans {
+		select {
+		case ch <- m:
+		case <-c.quit:
+			return
+		}
+	}
+}
+
+// match reports whether a topic matches a topic filter, which may have
+// the wildcards + (one level) and # (any number of levels, at the end).
+func match(filter, topic string) bool {
+	if strings.HasPrefix(topic, "$") && !strings.HasPrefix(filter, "$") {
+		// topics starting with $ are not matched by wildcards at the first level
+		return false
+	}
+	f := strings.Split(filter, "/")
+	t := strings.Split(topic, "/")
+	for i, level := range f {
+		if level == "#" {
+			return true
+		}
+		if i >= len(t) {
+			return false
+		}
+		if level != "+" && level != t[i] {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
+
+// OnReconnect sets a function to be called after reconnecting to the server.
+func (c *Client) OnReconnect(f func()) {
+	c.mutex.Lock()
+	c.onReconnect = f
+	c.mutex.Unlock()
+}
+
+// PublishMessage publishes a message.
+func (c *Client) PublishMessage(msg *Message) error {
+	c.mutex.Lock()
+	conn := c.conn
+	c.mutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	return conn.publish(ctx, msg)
+}
+
+// Publish publishes a message which is not retained.
+func (c *Client) Publish(topic string, payload string) error {
+	return c.PublishMessage(&Message{
+		Topic:   topic,
+		Payload: []byte(payload),
+	})
+}
+
+// PublishRetain publishes a message which is retained by the server.
+func (c *Client) PublishRetain(topic string, payload string) error {
+	return c.PublishMessage(&Message{
+		Topic:   topic,
+		Retain:  true,
+		Payload: []byte(payload),
+	})
+}
+
+// Subscribe subscribes to one or more topics, and returns a channel with
+// the messages received in any of them.
+func (c *Client) Subscribe(topics ...string) (chan *Message, error) {
+	ch := make(chan *Message)
+
+	c.mutex.Lock()
+	conn := c.conn
+	for _, topic := range topics {
+		c.subscriptions = append(c.subscriptions, subscription{topic, ch})
+	}
+	c.mutex.Unlock()
+
+	if len(topics) == 0 {
+		return ch, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := conn.subscribe(ctx, topics...); err != nil {
+		c.mutex.Lock()
+		subs := c.subscriptions[:0]
+		for _, sub := range c.subscriptions {
+			if sub.ch != ch {
+				subs = append(subs, sub)
+			}
+		}
+		c.subscriptions = subs
+		c.mutex.Unlock()
+		return nil, err
+	}
+	return ch, nil
+}
+
+// Close disconnects from the server, without trying to reconnect.
+func (c *Client) Close() error {
+	c.mutex.Lock()
+	if !c.closed {
+		close(c.quit)
+	}
+	c.closed = true
+	conn := c.conn
+	c.mutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	return conn.disconnect(ctx)
+}
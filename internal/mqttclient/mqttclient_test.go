@@ -0,0 +1,235 @@
+package mqttclient
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+)
+
+// startBroker starts a local MQTT server which accepts everything except
+// publishing and subscribing to denied/#, and returns its host and port.
+func startBroker(t *testing.T) (string, int) {
+	t.Helper()
+	server := mqtt.New(&mqtt.Options{
+		InlineClient: true,
+		Logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	err := server.AddHook(new(auth.Hook), &auth.Options{
+		Ledger: &auth.Ledger{
+			Auth: auth.AuthRules{{Allow: true}},
+			ACL: auth.ACLRules{{Filters: auth.Filters{
+				"denied/#": auth.Deny,
+			}}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcp := listeners.NewTCP(listeners.Config{ID: "test", Address: "127.0.0.1:0"})
+	if err := server.AddListener(tcp); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Serve(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+
+	host, port, err := net.SplitHostPort(tcp.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, _ := strconv.Atoi(port)
+	return host, p
+}
+
+func connect(t *testing.T, host string, port int, version Version) *Client {
+	t.Helper()
+	c, err := New(host, port, Options{Version: version})
+	if err != nil {
+		t.Fatalf("MQTT %v: %v", version, err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func receive(t *testing.T, ch chan *Message) *Message {
+	t.Helper()
+	select {
+	case m := <-ch:
+		return m
+	case <-time.After(2 * time.Second):
+		t.Fatal("no message received")
+		return nil
+	}
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		filter, topic string
+		match         bool
+	}{
+		{"knx/cmd", "knx/cmd", true},
+		{"knx/cmd", "knx/cmd/x", false},
+		{"knx/cmd/+", "knx/cmd/x", true},
+		{"knx/cmd/+", "knx/cmd", false},
+		{"knx/cmd/+", "knx/cmd/x/y", false},
+		{"knx/#", "knx", true},
+		{"knx/#", "knx/1/2/3", true},
+		{"+/+/get", "rooms/light/get", true},
+		{"#", "$SYS/uptime", false},
+	}
+	for _, test := range tests {
+		if got := match(test.filter, test.topic); got != test.match {
+			t.Errorf("match(%q, %q) = %v", test.filter, test.topic, got)
+		}
+	}
+}
+
+func TestVersion(t *testing.T) {
+	var v Version
+	if v.String() != "3.1.1" {
+		t.Errorf("default version is %v", v)
+	}
+	if err := v.Set("5"); err != nil || v != V5 {
+		t.Errorf("Set(5): %v, %v", v, err)
+	}
+	if err := v.Set("3"); err == nil {
+		t.Errorf("Set(3): no error")
+	}
+}
+
+func TestPublishV5(t *testing.T) {
+	host, port := startBroker(t)
+	sub := connect(t, host, port, V5)
+	pub := connect(t, host, port, V5)
+
+	ch, err := sub.Subscribe("knx/#")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent := &Message{
+		Topic:           "knx/5/0/27",
+		Payload:         []byte(`{"Command":"Write"}`),
+		ContentType:     "application/json",
+		UserProperties:  []UserProperty{{"gateway", "192.168.1.10:3671"}, {"source", "1.1.5"}},
+		Expiry:          1500 * time.Millisecond,
+		ResponseTopic:   "app/reply",
+		CorrelationData: []byte("42"),
+	}
+	if err := pub.PublishMessage(sent); err != nil {
+		t.Fatal(err)
+	}
+	m := receive(t, ch)
+	if m.Topic != sent.Topic || string(m.Payload) != string(sent.Payload) {
+		t.Errorf("received %s %s", m.Topic, m.Payload)
+	}
+	if m.ContentType != sent.ContentType || m.ResponseTopic != sent.ResponseTopic || string(m.CorrelationData) != "42" {
+		t.Errorf("wrong properties: %+v", m)
+	}
+	if !reflect.DeepEqual(m.UserProperties, sent.UserProperties) || m.Property("source") != "1.1.5" {
+		t.Errorf("wrong user properties: %v", m.UserProperties)
+	}
+	// rounded up to 2s, and maybe decremented by the server
+	if m.Expiry <= 0 || m.Expiry > 2*time.Second {
+		t.Errorf("wrong expiry %v", m.Expiry)
+	}
+}
+
+func TestPublishV311(t *testing.T) {
+	host, port := startBroker(t)
+	sub := connect(t, host, port, V311)
+	pub := connect(t, host, port, V5)
+
+	ch, err := sub.Subscribe("knx/cmd", "knx/cmd/+")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = pub.PublishMessage(&Message{
+		Topic:          "knx/cmd/app",
+		Payload:        []byte("on"),
+		UserProperties: []UserProperty{{"dpt", "1.001"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := receive(t, ch)
+	if m.Topic != "knx/cmd/app" || string(m.Payload) != "on" || m.UserProperties != nil {
+		t.Errorf("received %+v", m)
+	}
+
+	// properties are not sent with 3.1.1
+	if err := sub.PublishMessage(&Message{Topic: "knx/cmd", Payload: []byte("off"), ContentType: "text/plain"}); err != nil {
+		t.Fatal(err)
+	}
+	m = receive(t, ch)
+	if m.Topic != "knx/cmd" || string(m.Payload) != "off" || m.ContentType != "" {
+		t.Errorf("received %+v", m)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	host, port := startBroker(t)
+	pub := connect(t, host, port, V5)
+
+	err := pub.PublishMessage(&Message{Topic: "knx/cmd", Payload: []byte("stale"), Retain: true, Expiry: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = pub.PublishMessage(&Message{Topic: "knx/status", Payload: []byte("online"), Retain: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2100 * time.Millisecond)
+
+	// the expired command is not delivered to new subscribers, the other message is
+	sub := connect(t, host, port, V5)
+	ch, err := sub.Subscribe("knx/#")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := receive(t, ch)
+	if m.Topic != "knx/status" {
+		t.Errorf("received %s %s", m.Topic, m.Payload)
+	}
+	select {
+	case m := <-ch:
+		t.Errorf("received %s %s", m.Topic, m.Payload)
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+func TestReasonCodes(t *testing.T) {
+	host, port := startBroker(t)
+	c := connect(t, host, port, V5)
+
+	var re *ReasonError
+	err := c.Publish("denied/cmd", "on")
+	if !errors.As(err, &re) || re.Packet != "PUBACK" || re.Code != 0x87 {
+		t.Errorf("publishing to denied topic: %v", err)
+	}
+	_, err = c.Subscribe("denied/#")
+	if !errors.As(err, &re) || re.Packet != "SUBACK" || re.Code != 0x87 {
+		t.Errorf("subscribing to denied topic: %v", err)
+	}
+
+	// the connection is still usable
+	ch, err := c.Subscribe("knx/#")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Publish("knx/status", "online"); err != nil {
+		t.Fatal(err)
+	}
+	if m := receive(t, ch); string(m.Payload) != "online" {
+		t.Errorf("received %+v", m)
+	}
+}
@@ -0,0 +1,65 @@
+package mqttclient
+
+import (
+	"context"
+
+	"github.com/at-wat/mqtt-go"
+)
+
+// connV311 is a connection using MQTT 3.1.1.
+type connV311 struct {
+	client mqtt.ClientCloser
+}
+
+func dialV311(ctx context.Context, addr string, id string, will *Message, handle func(*Message)) (conn, error) {
+	client, err := mqtt.DialContext(ctx, "mqtt://"+addr)
+	if err != nil {
+		return nil, err
+	}
+	client.Handle(mqtt.HandlerFunc(func(m *mqtt.Message) {
+		handle(&Message{
+			Topic:   m.Topic,
+			Payload: m.Payload,
+			Retain:  m.Retain,
+		})
+	}))
+
+	var opts []mqtt.ConnectOption
+	if will != nil {
+		opts = append(opts, mqtt.WithWill(&mqtt.Message{
+			Topic:   will.Topic,
+			Retain:  will.Retain,
+			Payload: will.Payload,
+		}))
+	}
+	if _, err := client.Connect(ctx, id, opts...); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &connV311{client}, nil
+}
+
+func (c *connV311) publish(ctx context.Context, msg *Message) error {
+	return c.client.Publish(ctx, &mqtt.Message{
+		Topic:   msg.Topic,
+		Retain:  msg.Retain,
+		Payload: msg.Payload,
+	})
+}
+
+func (c *connV311) subscribe(ctx context.Context, topics ...string) error {
+	var subs []mqtt.Subscription
+	for _, topic := range topics {
+		subs = append(subs, mqtt.Subscription{Topic: topic})
+	}
+	_, err := c.client.Subscribe(ctx, subs...)
+	return err
+}
+
+func (c *connV311) disconnect(ctx context.Context) error {
+	return c.client.Disconnect(ctx)
+}
+
+func (c *connV311) done() <-chan struct{} {
+	return c.client.Done()
+}
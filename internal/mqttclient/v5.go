@@ -0,0 +1,182 @@
+package mqttclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+)
+
+// connV5 is a connection using MQTT v5.  Messages are published with QoS 1,
+// so that the server answers with a reason code.
+type connV5 struct {
+	client *paho.Client
+}
+
+// ReasonError is an error returned by the server in a reason code.
+type ReasonError struct {
+	Packet string // CONNACK, PUBACK or SUBACK
+	Code   byte   // reason code (0x80 or greater)
+	Reason string // reason string sent by the server, if any
+}
+
+func (e *ReasonError) Error() string {
+	s := fmt.Sprintf("%s reason code 0x%02x", e.Packet, e.Code)
+	if e.Reason != "" {
+		s += " (" + e.Reason + ")"
+	}
+	return s
+}
+
+func dialV5(ctx context.Context, addr string, id string, will *Message, handle func(*Message)) (conn, error) {
+	nc, err := new(net.Dialer).DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	client := paho.NewClient(paho.ClientConfig{
+		Conn: nc,
+		OnPublishReceived: []func(paho.PublishReceived) (bool, error){
+			func(r paho.PublishReceived) (bool, error) {
+				handle(fromPublish(r.Packet))
+				return true, nil
+			},
+		},
+		OnServerDisconnect: func(d *paho.Disconnect) {
+			var reason string
+			if d.Properties != nil {
+				reason = d.Properties.ReasonString
+			}
+			logMQTT.Warn("disconnected by server", "reason_code", fmt.Sprintf("0x%02x", d.ReasonCode), "reason", reason)
+		},
+		OnClientError: func(err error) {
+			if errors.Is(err, net.ErrClosed) {
+				// closed by Close
+				return
+			}
+			logMQTT.Warn("connection error", "error", err)
+		},
+	})
+
+	cp := &paho.Connect{
+		ClientID:   id,
+		KeepAlive:  30,
+		CleanStart: true,
+	}
+	if will != nil {
+		p := toPublish(will)
+		cp.WillMessage = &paho.WillMessage{
+			Retain:  p.Retain,
+			QoS:     p.QoS,
+			Topic:   p.Topic,
+			Payload: p.Payload,
+		}
+		cp.WillProperties = &paho.WillProperties{
+			MessageExpiry:   p.Properties.MessageExpiry,
+			ContentType:     p.Properties.ContentType,
+			ResponseTopic:   p.Properties.ResponseTopic,
+			CorrelationData: p.Properties.CorrelationData,
+			User:            p.Properties.User,
+		}
+	}
+	ca, err := client.Connect(ctx, cp)
+	if err != nil {
+		nc.Close()
+		if ca != nil && ca.ReasonCode >= 0x80 {
+			e := &ReasonError{Packet: "CONNACK", Code: ca.ReasonCode}
+			if ca.Properties != nil {
+				e.Reason = ca.Properties.ReasonString
+			}
+			return nil, e
+		}
+		return nil, err
+	}
+	return &connV5{client}, nil
+}
+
+func toPublish(msg *Message) *paho.Publish {
+	p := &paho.Publish{
+		QoS:     1,
+		Retain:  msg.Retain,
+		Topic:   msg.Topic,
+		Payload: msg.Payload,
+		Properties: &paho.PublishProperties{
+			ContentType:     msg.ContentType,
+			ResponseTopic:   msg.ResponseTopic,
+			CorrelationData: msg.CorrelationData,
+		},
+	}
+	for _, up := range msg.UserProperties {
+		p.Properties.User.Add(up.Key, up.Value)
+	}
+	if msg.Expiry > 0 {
+		// in seconds, rounding up
+		expiry := uint32((msg.Expiry + time.Second - 1) / time.Second)
+		p.Properties.MessageExpiry = &expiry
+	}
+	return p
+}
+
+func fromPublish(p *paho.Publish) *Message {
+	m := &Message{
+		Topic:   p.Topic,
+		Payload: p.Payload,
+		Retain:  p.Retain,
+	}
+	if p.Properties == nil {
+		return m
+	}
+	m.ContentType = p.Properties.ContentType
+	m.ResponseTopic = p.Properties.ResponseTopic
+	m.CorrelationData = p.Properties.CorrelationData
+	for _, up := range p.Properties.User {
+		m.UserProperties = append(m.UserProperties, UserProperty{up.Key, up.Value})
+	}
+	if p.Properties.MessageExpiry != nil {
+		m.Expiry = time.Duration(*p.Properties.MessageExpiry) * time.Second
+	}
+	return m
+}
+
+func (c *connV5) publish(ctx context.Context, msg *Message) error {
+	pr, err := c.client.Publish(ctx, toPublish(msg))
+	if pr != nil && pr.ReasonCode >= 0x80 {
+		e := &ReasonError{Packet: "PUBACK", Code: pr.ReasonCode}
+		if pr.Properties != nil {
+			e.Reason = pr.Properties.ReasonString
+		}
+		return e
+	}
+	return err
+}
+
+func (c *connV5) subscribe(ctx context.Context, topics ...string) error {
+	s := &paho.Subscribe{}
+	for _, topic := range topics {
+		s.Subscriptions = append(s.Subscriptions, paho.SubscribeOptions{Topic: topic})
+	}
+	sa, err := c.client.Subscribe(ctx, s)
+	if sa != nil {
+		for i, code := range sa.Reasons {
+			if code < 0x80 || i >= len(topics) {
+				continue
+			}
+			e := &ReasonError{Packet: "SUBACK", Code: code}
+			if sa.Properties != nil {
+				e.Reason = sa.Properties.ReasonString
+			}
+			return fmt.Errorf("%s: %w", topics[i], e)
+		}
+	}
+	return err
+}
+
+func (c *connV5) disconnect(ctx context.Context) error {
+	return c.client.Disconnect(&paho.Disconnect{})
+}
+
+func (c *connV5) done() <-chan struct{} {
+	return c.client.Done()
+}